@@ -1,7 +1,10 @@
 package api
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
@@ -9,8 +12,19 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/dbubel/intake"
 
+	"github.com/dbubel/jackstand-api/audit"
+	"github.com/dbubel/jackstand-api/boltdb"
+	"github.com/dbubel/jackstand-api/cacher"
 	"github.com/dbubel/jackstand-api/config"
+	"github.com/dbubel/jackstand-api/envelope"
+	"github.com/dbubel/jackstand-api/filesystem"
+	"github.com/dbubel/jackstand-api/history"
+	"github.com/dbubel/jackstand-api/manifest"
+	"github.com/dbubel/jackstand-api/memory"
 	"github.com/dbubel/jackstand-api/middleware"
+	"github.com/dbubel/jackstand-api/s3"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/dbubel/jackstand-api/trash"
 	"github.com/sirupsen/logrus"
 )
 
@@ -20,7 +34,19 @@ type ServeCommand struct {
 }
 
 func (c *ServeCommand) Help() string {
-	return "jackstand serve"
+	return `Usage: jackstand serve [options] [local]
+
+  Runs the jackstand API server. Passing local keeps credentials in memory so
+  the server runs without S3 or an emulator; they are lost on exit.
+
+Options:
+
+  -storage=s3    Credential storage backend: s3, fs, bolt or memory.
+                 Defaults to STORAGE.
+  -endpoint=url  S3 endpoint, e.g. localstack. Defaults to S3_ENDPOINT.
+  -root=path     Root directory for the fs backend. Defaults to STORAGE_ROOT.
+  -db=path       Database file for the bolt backend. Defaults to BOLT_PATH.
+`
 }
 
 func (c *ServeCommand) Synopsis() string {
@@ -29,25 +55,23 @@ func (c *ServeCommand) Synopsis() string {
 
 func (c *ServeCommand) Run(args []string) int {
 	c.Log.WithFields(logrus.Fields{"args": args}).Debug("serve command args")
-	var awsConfig aws.Config
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.StringVar(&c.Cfg.Storage, "storage", c.Cfg.Storage, "credential storage backend")
+	flags.StringVar(&c.Cfg.S3Endpoint, "endpoint", c.Cfg.S3Endpoint, "s3 endpoint")
+	flags.StringVar(&c.Cfg.StorageRoot, "root", c.Cfg.StorageRoot, "root directory for the fs backend")
+	flags.StringVar(&c.Cfg.BoltPath, "db", c.Cfg.BoltPath, "database file for the bolt backend")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
 
-	if len(args) > 0 {
-		if args[0] == "local" {
-			pathStyle := true
-			testEndpoint := "http://localhost:5002"
-			awsConfig = aws.Config{
-				Region:           aws.String("us-east-1"),
-				Endpoint:         &testEndpoint,
-				S3ForcePathStyle: &pathStyle,
-			}
-		}
-	} else {
-		awsConfig = aws.Config{
-			Region: aws.String("us-east-1"),
-		}
+	if flags.NArg() > 0 && flags.Arg(0) == "local" {
+		c.Cfg.Storage = "memory"
 	}
 
-	awsSession, err := session.NewSession(&awsConfig)
+	store, closer, err := openStore(c.Cfg, c.Log, c.Cfg.Storage)
+	if closer != nil {
+		defer closer.Close()
+	}
 
 	if err != nil {
 		c.Log.WithError(err).Fatalln()
@@ -67,8 +91,8 @@ func (c *ServeCommand) Run(args []string) int {
 	// Handle CORS for OPTIONS
 	app.Router.GlobalOPTIONS = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Authorization, If-Match, If-None-Match, If-Modified-Since, X-Import-Password, X-Export-Password")
 		w.WriteHeader(http.StatusNoContent)
 	})
 
@@ -76,7 +100,13 @@ func (c *ServeCommand) Run(args []string) int {
 	app.AddGlobal(app.Logging)
 	app.AddGlobal(app.Recover)
 	app.AddGlobal(middleware.Cors)
-	app.AddGlobal(app.Timeout(time.Second * 5))
+	// Imports, exports and batches get longer than the other requests, since
+	// they write or read many of a user's credentials.
+	app.AddGlobal(middleware.Timeout(time.Second*5, map[string]time.Duration{
+		"/users/import": c.Cfg.BulkTimeout,
+		"/users/export": c.Cfg.BulkTimeout,
+		batchRoute:      c.Cfg.BulkTimeout,
+	}))
 
 	// Setup firebaseEndpoints struct
 	fb := FireBaseAuth{
@@ -87,10 +117,44 @@ func (c *ServeCommand) Run(args []string) int {
 	firebaseEndpoints := GetUserManagementEndpoints(fb)
 
 	// Setup the Credentials struct
+	// Keep the credential manifests in sync with the stored credentials
+	index := manifest.New(c.Log, store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if c.Cfg.ManifestReconcileInterval > 0 {
+		go index.Run(ctx, c.Cfg.ManifestReconcileInterval)
+	}
+
+	// Cache credential reads in front of the store. The manifest keeps using
+	// the store directly so the reconciler sees what is really stored, as do
+	// the reads checking If-Match and preceding updates and deletes.
+	var cache *cacher.Cacher
+	credentialStore := store
+	if c.Cfg.CacheTTL > 0 {
+		cache = cacher.NewCacher(c.Cfg.CacheTTL, c.Cfg.CacheMaxItems)
+		credentialStore = cacher.NewStore(store, cache)
+	}
+
+	// Deleted credentials wait in the trash for TRASH_RETENTION
+	hist := history.New(store, c.Cfg.HistoryVersions)
+	bin := trash.New(c.Log, store, hist)
+	if c.Cfg.TrashPurgeInterval > 0 {
+		go bin.Run(ctx, c.Cfg.TrashPurgeInterval, c.Cfg.TrashRetention)
+	}
+
 	creds := Credentials{
-		bucket: c.Cfg.S3Bucket,
-		sess:   awsSession,
-		log:    c.Log,
+		store:    credentialStore,
+		cache:    cache,
+		uncached: store,
+		manifest: index,
+		history:  hist,
+		trash:    bin,
+		audit:    audit.New(store),
+		locks:    newUserLocks(),
+		log:      c.Log,
+
+		requireIfMatch:    c.Cfg.RequireIfMatch,
+		exportMaxTokenAge: c.Cfg.ExportMaxTokenAge,
 	}
 	// Setup GetCredentialEndpoints from  middleware to GetCredentialEndpoints group
 	credentialEndpoints := GetCredentialEndpoints(creds, middleware.Auth)
@@ -100,14 +164,93 @@ func (c *ServeCommand) Run(args []string) int {
 		credentialEndpoints,
 	)
 
-	// Run the server
+	// Run the server. Bulk requests may still undo a batch and rebuild the
+	// manifest once their time is up, so they get that long to respond.
 	app.Run(&http.Server{
 		Addr:           fmt.Sprintf(":%d", c.Cfg.Port),
-		Handler:        app.Router,
+		Handler:        RouteBatch(app.Router),
 		ReadTimeout:    time.Second * 10,
-		WriteTimeout:   time.Second * 10,
+		WriteTimeout:   c.Cfg.BulkTimeout + rollbackTimeout + rebuildTimeout,
 		MaxHeaderBytes: 1 << 20,
 	})
 
 	return 0
 }
+
+// openStore builds the store for the named backend, encrypting what it stores
+// when a master key is configured.
+func openStore(cfg config.Config, log *logrus.Logger, backend string) (storage.CredentialStore, io.Closer, error) {
+	store, err := newStore(cfg, log, backend)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	closer, _ := store.(io.Closer)
+	master, err := masterKeys(cfg)
+	if err != nil || master == nil {
+		return store, closer, err
+	}
+
+	log.WithFields(logrus.Fields{"masterKeyId": master.Current(), "encryption": cfg.Encryption}).Info("encrypting credentials")
+	switch cfg.Encryption {
+	case "full":
+		return envelope.NewStore(store, master), closer, nil
+	case "fields":
+		return envelope.NewFieldStore(store, master), closer, nil
+	default:
+		return nil, closer, fmt.Errorf("unknown encryption %s", cfg.Encryption)
+	}
+}
+
+// masterKeys loads the configured master key along with the previous master
+// keys still accepted while rotating, returning nil when none is configured.
+func masterKeys(cfg config.Config) (*envelope.MasterKeys, error) {
+	key, err := envelope.LoadMasterKey(cfg.MasterKey, cfg.MasterKeyFile)
+	if err != nil || key == nil {
+		return nil, err
+	}
+
+	var previous [][]byte
+	for i := range cfg.PreviousMasterKeys {
+		old, err := envelope.LoadMasterKey(cfg.PreviousMasterKeys[i], "")
+		if err != nil {
+			return nil, fmt.Errorf("previous master key %d %w", i+1, err)
+		}
+
+		if old != nil {
+			previous = append(previous, old)
+		}
+	}
+	return envelope.NewMasterKeys(key, previous...)
+}
+
+// newStore builds the credential store for the named backend.
+func newStore(cfg config.Config, log *logrus.Logger, backend string) (storage.CredentialStore, error) {
+	log.WithFields(logrus.Fields{"storage": backend}).Info("using credential storage")
+	switch backend {
+	case "s3":
+		awsConfig := aws.Config{
+			Region: aws.String("us-east-1"),
+		}
+
+		if cfg.S3Endpoint != "" {
+			pathStyle := true
+			awsConfig.Endpoint = aws.String(cfg.S3Endpoint)
+			awsConfig.S3ForcePathStyle = &pathStyle
+		}
+
+		awsSession, err := session.NewSession(&awsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return s3.NewStore(log, awsSession, cfg.S3Bucket), nil
+	case "fs":
+		return filesystem.NewStore(log, cfg.StorageRoot)
+	case "bolt":
+		return boltdb.NewStore(log, cfg.BoltPath)
+	case "memory":
+		return memory.NewStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
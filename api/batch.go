@@ -0,0 +1,353 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dbubel/intake"
+	"github.com/dbubel/jackstand-api/history"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/settings"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/dbubel/jackstand-api/subendpoints"
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// batchPath is the public path of the batch endpoint. httprouter cannot
+	// route a literal colon next to /users/credentials/:credentialUid, so
+	// RouteBatch rewrites it to batchRoute, where the endpoint is registered.
+	batchPath  = "/users/credentials:batch"
+	batchRoute = "/users/batch"
+
+	// maxBatchSize caps the number of operations in a batch.
+	maxBatchSize = 1000
+	// batchConcurrency is how many operations of a batch run at once.
+	batchConcurrency = 8
+	// rollbackTimeout bounds undoing an atomic batch, which runs even when
+	// the batch used up the request's time.
+	rollbackTimeout = 30 * time.Second
+)
+
+// Batch operations.
+const (
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+)
+
+// errRolledBack is reported for operations of an atomic batch that were
+// undone or never run because another operation failed.
+var errRolledBack = errors.New("rolled back because another operation failed")
+
+type batchRequest struct {
+	// Atomic applies every operation or none of them.
+	Atomic     bool             `json:"atomic"`
+	Operations []batchOperation `json:"operations" validate:"required,min=1,dive"`
+}
+
+// batchOperation creates a credential, replaces one like PUT or deletes one
+// like DELETE. IfMatch works like the If-Match header of those endpoints.
+type batchOperation struct {
+	Op         string          `json:"op" validate:"required,oneof=create update delete"`
+	Uid        uuid.UUID       `json:"uid"`
+	IfMatch    string          `json:"ifMatch"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+// batchResult is the outcome of one operation, with the status code the
+// single credential endpoint would have responded with.
+type batchResult struct {
+	Status int       `json:"status"`
+	Uid    uuid.UUID `json:"uid"`
+	ETag   string    `json:"etag,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results    []batchResult `json:"results"`
+	RolledBack bool          `json:"rolledBack,omitempty"`
+}
+
+// batchItem is an operation checked and ready to run.
+type batchItem struct {
+	op         string
+	credential models.Credential
+	existing   models.Credential
+	// history is the existing credential's history before the batch, kept
+	// for atomic updates to put back when they are undone.
+	history *history.History
+	done    bool
+	result  batchResult
+}
+
+func (i *batchItem) fail(status int, err error) {
+	i.result.Status = status
+	i.result.Error = err.Error()
+}
+
+// RouteBatch serves the batch endpoint at its public path, see batchPath.
+func RouteBatch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == batchPath {
+			u := *r.URL
+			u.Path, u.RawPath = batchRoute, ""
+			r = r.Clone(r.Context())
+			r.URL = &u
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// batchCredentials creates, replaces and deletes many credentials in one
+// request, running the operations concurrently. Each operation gets its own
+// result. An atomic batch checks every operation before running any and
+// undoes the ones that succeeded if another fails, responding 409.
+func (c *Credentials) batchCredentials(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		var req batchRequest
+		if err := intake.UnmarshalJSON(r.Body, &req); err != nil {
+			intake.RespondError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		if len(req.Operations) > maxBatchSize {
+			intake.RespondError(w, r, fmt.Errorf("a batch has at most %d operations", maxBatchSize), http.StatusBadRequest)
+			return
+		}
+
+		seen := make(map[uuid.UUID]bool, len(req.Operations))
+		for i, op := range req.Operations {
+			if op.Op == batchCreate {
+				continue
+			}
+
+			if op.Uid == uuid.Nil {
+				intake.RespondError(w, r, fmt.Errorf("operation %d needs a uid", i), http.StatusBadRequest)
+				return
+			}
+
+			if seen[op.Uid] {
+				intake.RespondError(w, r, fmt.Errorf("credential %s appears more than once", op.Uid), http.StatusBadRequest)
+				return
+			}
+			seen[op.Uid] = true
+		}
+
+		s, err := settings.Get(r.Context(), c.store, userId)
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		unlock := c.locks.lock(userId)
+		defer unlock()
+
+		items := make([]batchItem, len(req.Operations))
+		forEach(len(items), func(i int) {
+			items[i] = c.prepareBatch(r.Context(), userId, s.Mode, req.Atomic, req.Operations[i])
+		})
+
+		if req.Atomic && failed(items) {
+			for i := range items {
+				if items[i].result.Error == "" {
+					items[i].fail(http.StatusFailedDependency, errRolledBack)
+				}
+			}
+			respondBatch(w, r, http.StatusConflict, items, true)
+			return
+		}
+
+		forEach(len(items), func(i int) {
+			if items[i].result.Error == "" {
+				c.runBatch(r.Context(), userId, &items[i])
+			}
+		})
+
+		// The request's context may be done when the batch failed, and its
+		// writes have to be undone and the manifest caught up anyway.
+		rolledBack := req.Atomic && failed(items)
+		if rolledBack {
+			ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+			forEach(len(items), func(i int) {
+				c.rollbackBatch(ctx, userId, &items[i])
+			})
+			cancel()
+		}
+
+		// Rebuilding the manifest once is cheaper than updating it for
+		// every operation.
+		ctx, cancel := context.WithTimeout(context.Background(), rebuildTimeout)
+		defer cancel()
+		if _, _, err := c.manifest.Rebuild(ctx, userId); err != nil {
+			c.log.WithError(err).WithFields(logrus.Fields{"userId": userId}).Warn("error rebuilding manifest")
+		}
+
+		status := http.StatusOK
+		if rolledBack {
+			status = http.StatusConflict
+		}
+		respondBatch(w, r, status, items, rolledBack)
+	})
+}
+
+// prepareBatch parses an operation and checks its preconditions. Updates in
+// an atomic batch keep the credential's history so it can be undone.
+func (c *Credentials) prepareBatch(ctx context.Context, userId, mode string, atomic bool, op batchOperation) batchItem {
+	item := batchItem{op: op.Op, result: batchResult{Uid: op.Uid}}
+	if op.Op != batchDelete {
+		credential, err := parseCredential(mode, bytes.NewReader(op.Credential))
+		if err != nil {
+			item.fail(http.StatusBadRequest, err)
+			return item
+		}
+		item.credential = credential
+	}
+
+	if op.Op == batchCreate {
+		item.credential.Uid = uuid.Must(uuid.NewV4())
+		item.result.Uid = item.credential.Uid
+		return item
+	}
+
+	existing, err := c.uncached.Get(ctx, userId, op.Uid)
+	if errors.Is(err, storage.ErrNotFound) {
+		item.fail(http.StatusBadRequest, err)
+		return item
+	} else if err != nil {
+		item.fail(http.StatusInternalServerError, err)
+		return item
+	}
+	item.existing = existing
+
+	switch {
+	case op.IfMatch == "" && c.requireIfMatch:
+		item.fail(http.StatusPreconditionRequired, errors.New("ifMatch required"))
+	case op.IfMatch != "" && !etagMatches(op.IfMatch, existing.ETag()):
+		item.result.ETag = existing.ETag()
+		item.fail(http.StatusPreconditionFailed, errors.New("credential has been modified"))
+	}
+
+	item.credential.Uid = existing.Uid
+	item.credential.CreatedAt = existing.CreatedAt
+	if atomic && op.Op == batchUpdate && item.result.Error == "" {
+		hist, err := c.history.Get(ctx, userId, existing.Uid)
+		if err != nil {
+			item.fail(http.StatusInternalServerError, err)
+			return item
+		}
+		item.history = &hist
+	}
+	return item
+}
+
+// runBatch runs a prepared operation the way its single credential endpoint
+// would.
+func (c *Credentials) runBatch(ctx context.Context, userId string, item *batchItem) {
+	now := models.CustomTime(time.Now())
+	var err error
+	switch item.op {
+	case batchCreate:
+		item.credential.CreatedAt, item.credential.UpdatedAt = now, now
+		err = c.store.Create(ctx, userId, item.credential)
+	case batchUpdate:
+		item.credential.UpdatedAt = now
+		if err = c.history.Record(ctx, userId, item.existing); err == nil {
+			err = c.store.Update(ctx, userId, item.credential)
+		}
+	case batchDelete:
+		if err = c.trash.Put(ctx, userId, item.existing); err == nil {
+			err = c.store.Delete(ctx, userId, item.existing.Uid)
+		}
+	}
+
+	if err != nil {
+		item.fail(http.StatusInternalServerError, err)
+		return
+	}
+
+	item.done = true
+	item.result.Status = http.StatusOK
+	if item.op != batchDelete {
+		item.result.ETag = item.credential.ETag()
+	}
+}
+
+// rollbackBatch undoes an operation that succeeded: created credentials are
+// deleted, replaced ones restored along with their history and deleted ones
+// taken back out of the trash. Failures are logged and reported, since the
+// credential may now be in either state.
+func (c *Credentials) rollbackBatch(ctx context.Context, userId string, item *batchItem) {
+	if !item.done {
+		// A failed update may have recorded its history before failing.
+		if item.op == batchUpdate && item.history != nil {
+			if err := c.history.Put(ctx, userId, item.existing.Uid, *item.history); err != nil {
+				c.log.WithError(err).WithFields(logrus.Fields{"userId": userId, "credentialUid": item.result.Uid}).Error("error rolling back credential history")
+			}
+		}
+		return
+	}
+
+	var err error
+	switch item.op {
+	case batchCreate:
+		err = c.store.Delete(ctx, userId, item.credential.Uid)
+	case batchUpdate:
+		if err = c.store.Update(ctx, userId, item.existing); err == nil && item.history != nil {
+			err = c.history.Put(ctx, userId, item.existing.Uid, *item.history)
+		}
+	case batchDelete:
+		if err = c.store.Create(ctx, userId, item.existing); err == nil {
+			err = c.trash.Remove(ctx, userId, item.existing.Uid)
+		}
+	}
+
+	item.result.ETag = ""
+	if err != nil {
+		c.log.WithError(err).WithFields(logrus.Fields{"userId": userId, "credentialUid": item.result.Uid}).Error("error rolling back batch operation")
+		item.fail(http.StatusInternalServerError, fmt.Errorf("error rolling back %w", err))
+		return
+	}
+	item.fail(http.StatusFailedDependency, errRolledBack)
+}
+
+func failed(items []batchItem) bool {
+	for i := range items {
+		if items[i].result.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func respondBatch(w http.ResponseWriter, r *http.Request, status int, items []batchItem, rolledBack bool) {
+	resp := batchResponse{Results: make([]batchResult, len(items)), RolledBack: rolledBack}
+	for i := range items {
+		resp.Results[i] = items[i].result
+	}
+	intake.RespondJSON(w, r, status, resp)
+}
+
+// forEach calls fn for 0 to n-1, batchConcurrency at a time.
+func forEach(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchConcurrency)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
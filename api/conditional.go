@@ -0,0 +1,67 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dbubel/jackstand-api/manifest"
+)
+
+// listETag derives the entity tag of a listing from the user's manifest and
+// the query parameters, so a client polling an unchanged vault can be
+// answered without reading any credentials. Every summary in the manifest
+// carries the entity tag of its credential, so the tag is a hash of the
+// content and changes with any write, however close together.
+func listETag(r *http.Request, m manifest.Manifest) string {
+	b, err := json.Marshal(m.Credentials)
+	if err != nil {
+		return ""
+	}
+
+	h := sha256.New()
+	h.Write([]byte(r.URL.Query().Encode()))
+	h.Write([]byte{0})
+	h.Write(b)
+	return fmt.Sprintf("%q", hex.EncodeToString(h.Sum(nil)[:16]))
+}
+
+// setValidators sets the ETag and Last-Modified headers of a response.
+func setValidators(w http.ResponseWriter, etag string, modified time.Time) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified evaluates the If-None-Match and If-Modified-Since headers of a
+// GET. If-Modified-Since is only considered when If-None-Match is absent.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if etag == "" {
+			return false
+		}
+
+		// If-None-Match uses the weak comparison.
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
@@ -1,28 +1,55 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/dbubel/intake"
+	"github.com/dbubel/jackstand-api/audit"
+	"github.com/dbubel/jackstand-api/cacher"
+	"github.com/dbubel/jackstand-api/history"
+	"github.com/dbubel/jackstand-api/manifest"
 	"github.com/dbubel/jackstand-api/models"
-	"github.com/dbubel/jackstand-api/s3"
+	"github.com/dbubel/jackstand-api/settings"
+	"github.com/dbubel/jackstand-api/storage"
 	"github.com/dbubel/jackstand-api/subendpoints"
+	"github.com/dbubel/jackstand-api/trash"
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 )
 
 type Credentials struct {
-	bucket string
-	sess   *session.Session
-	log    *logrus.Logger
-	//cache  *cacher.Cacher
+	store    storage.CredentialStore
+	manifest *manifest.Index
+	history  *history.Recorder
+	trash    *trash.Bin
+	audit    *audit.Trail
+	locks    *userLocks
+	log      *logrus.Logger
+	// cache is the cache store reads go through, nil when caching is off.
+	cache *cacher.Cacher
+	// uncached is the store behind the cache. Reads that answer a
+	// precondition or decide a write go to it, since another instance may
+	// have changed the credential after it was cached.
+	uncached storage.CredentialStore
+
+	// requireIfMatch rejects updates and deletes that do not send an
+	// If-Match header instead of applying them unconditionally.
+	requireIfMatch bool
+
+	// exportMaxTokenAge is how recently a user must have signed in to export
+	// their credentials in plaintext.
+	exportMaxTokenAge time.Duration
 }
 
-const NOT_FOUND = "error listing credentials list no results found"
-
 func (c *Credentials) updateUsername(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	subendpoints.UserIdFromClaims(w, r, func(userId string) {
 		subendpoints.CredentialIdFromParams(w, r, params, func(credentialUid uuid.UUID) {
@@ -35,23 +62,7 @@ func (c *Credentials) updateUsername(w http.ResponseWriter, r *http.Request, par
 				return
 			}
 
-			var existingCredential models.Credential
-			objectKey := s3.GetKeyForSingleCredential(userId, credentialUid)
-
-			if err := s3.GetCredential(c.log, c.sess, c.bucket, objectKey, &existingCredential); err != nil {
-				intake.RespondError(w, r, err, http.StatusBadRequest)
-				return
-			}
-
-			existingCredential.Username = attribute.Username
-			existingCredential.UpdatedAt = models.CustomTime(time.Now())
-
-			if err := s3.CreateCredential(c.log, c.sess, c.bucket, objectKey, existingCredential); err != nil {
-				intake.RespondError(w, r, err, http.StatusInternalServerError)
-				return
-			}
-
-			intake.RespondJSON(w, r, http.StatusOK, existingCredential)
+			c.patchFields(w, r, userId, credentialUid, map[string]string{"username": attribute.Username})
 		})
 	})
 }
@@ -68,23 +79,7 @@ func (c *Credentials) updatePassword(w http.ResponseWriter, r *http.Request, par
 				return
 			}
 
-			var existingCredential models.Credential
-			objectKey := s3.GetKeyForSingleCredential(userId, credentialUid)
-
-			if err := s3.GetCredential(c.log, c.sess, c.bucket, objectKey, &existingCredential); err != nil {
-				intake.RespondError(w, r, err, http.StatusBadRequest)
-				return
-			}
-
-			existingCredential.Password = attribute.Password
-			existingCredential.UpdatedAt = models.CustomTime(time.Now())
-
-			if err := s3.CreateCredential(c.log, c.sess, c.bucket, objectKey, existingCredential); err != nil {
-				intake.RespondError(w, r, err, http.StatusInternalServerError)
-				return
-			}
-
-			intake.RespondJSON(w, r, http.StatusOK, existingCredential)
+			c.patchFields(w, r, userId, credentialUid, map[string]string{"password": attribute.Password})
 		})
 	})
 }
@@ -101,62 +96,88 @@ func (c *Credentials) updateServiceName(w http.ResponseWriter, r *http.Request,
 				return
 			}
 
-			var existingCredential models.Credential
-			objectKey := s3.GetKeyForSingleCredential(userId, credentialUid)
-
-			if err := s3.GetCredential(c.log, c.sess, c.bucket, objectKey, &existingCredential); err != nil {
-				intake.RespondError(w, r, err, http.StatusBadRequest)
-				return
-			}
-
-			existingCredential.Service = attribute.Service
-			existingCredential.UpdatedAt = models.CustomTime(time.Now())
-
-			if err := s3.CreateCredential(c.log, c.sess, c.bucket, objectKey, existingCredential); err != nil {
-				intake.RespondError(w, r, err, http.StatusInternalServerError)
-				return
-			}
-
-			intake.RespondJSON(w, r, http.StatusOK, existingCredential)
+			c.patchFields(w, r, userId, credentialUid, map[string]string{"service": attribute.Service})
 		})
 	})
 }
 
 func (c *Credentials) createCredential(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	subendpoints.UserIdFromClaims(w, r, func(userId string) {
-		var credential models.Credential
-
-		if err := intake.UnmarshalJSON(r.Body, &credential); err != nil {
-			intake.RespondError(w, r, err, http.StatusBadRequest)
+		credential, ok := c.decodeCredential(w, r, userId)
+		if !ok {
 			return
 		}
 
 		credential.Uid = uuid.Must(uuid.NewV4())
 		credential.CreatedAt = models.CustomTime(time.Now())
 		credential.UpdatedAt = models.CustomTime(time.Now())
-		objectKey := s3.GetKeyForSingleCredential(userId, credential.Uid)
 
-		if err := s3.CreateCredential(c.log, c.sess, c.bucket, objectKey, credential); err != nil {
+		if err := c.store.Create(r.Context(), userId, credential); err != nil {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		if err := c.indexCredential(r.Context(), userId, credential); err != nil {
 			intake.RespondError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 
+		w.Header().Set("ETag", credential.ETag())
 		intake.RespondJSON(w, r, http.StatusOK, credential)
 	})
 }
 
+// replaceCredential replaces every field of a credential, which is the only
+// way to change a credential in vault mode.
+func (c *Credentials) replaceCredential(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		subendpoints.CredentialIdFromParams(w, r, params, func(credentialUid uuid.UUID) {
+			replacement, ok := c.decodeCredential(w, r, userId)
+			if !ok {
+				return
+			}
+
+			c.modifyCredential(w, r, userId, credentialUid, func(credential *models.Credential) error {
+				replacement.Uid = credential.Uid
+				replacement.CreatedAt = credential.CreatedAt
+				*credential = replacement
+				return nil
+			})
+		})
+	})
+}
+
 func (c *Credentials) getCredential(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	subendpoints.UserIdFromClaims(w, r, func(userId string) {
 		subendpoints.CredentialIdFromParams(w, r, params, func(credentialUid uuid.UUID) {
-			var data models.Credential
-			objectKey := s3.GetKeyForSingleCredential(userId, credentialUid)
+			if r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") != "" {
+				// The manifest knows when the credential last changed, which
+				// saves reading the credential when it has not.
+				if m, err := c.manifest.Get(r.Context(), userId); err == nil {
+					if summary, ok := m.Find(credentialUid); ok && notModified(r, "", time.Time(summary.UpdatedAt)) {
+						setValidators(w, "", time.Time(summary.UpdatedAt))
+						intake.Respond(w, r, http.StatusNotModified, nil)
+						return
+					}
+				}
+			}
+
+			store := c.store
+			if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+				store = c.uncached
+			}
 
-			// Check s3 for credential
-			err := s3.GetCredential(c.log, c.sess, c.bucket, objectKey, &data)
+			data, err := store.Get(r.Context(), userId, credentialUid)
 			if err != nil {
 				intake.RespondError(w, r, err, http.StatusBadRequest)
 				return
 			}
+
+			etag, modified := data.ETag(), time.Time(data.UpdatedAt)
+			setValidators(w, etag, modified)
+			if notModified(r, etag, modified) {
+				intake.Respond(w, r, http.StatusNotModified, nil)
+				return
+			}
 			intake.RespondJSON(w, r, http.StatusOK, data)
 		})
 	})
@@ -164,29 +185,162 @@ func (c *Credentials) getCredential(w http.ResponseWriter, r *http.Request, para
 
 func (c *Credentials) getCredentials(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	subendpoints.UserIdFromClaims(w, r, func(userId string) {
-		objectKey := s3.GetKeyForAllCredentials(userId)
-		var ts []models.Credential
+		q, err := listQuery(r)
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		view, err := parseListView(r)
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		summary := view.summary()
+
+		// The manifest changes whenever any credential does, so it answers
+		// conditional requests without reading the credentials themselves.
+		m, err := c.manifest.Get(r.Context(), userId)
+		if err != nil && summary {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		} else if err != nil {
+			c.log.WithError(err).WithFields(logrus.Fields{"userId": userId}).Warn("error reading manifest")
+		}
 
-		// Check S3 for the credentials
-		if err := s3.GetCredentials(r.Context(), c.log, c.sess, c.bucket, objectKey, &ts); err != nil {
-			if err.Error() == NOT_FOUND {
-				intake.Respond(w, r, http.StatusNoContent, nil)
+		var etag string
+		var modified time.Time
+		if err == nil {
+			etag, modified = listETag(r, m), time.Time(m.UpdatedAt)
+			if notModified(r, etag, modified) {
+				setValidators(w, etag, modified)
+				intake.Respond(w, r, http.StatusNotModified, nil)
 				return
 			}
+		}
+
+		// The manifest has everything but what free text searches look at.
+		if summary && q.Search == "" {
+			setValidators(w, etag, modified)
+			c.getSummaries(w, r, m, q, view)
+			return
+		}
+
+		page, err := storage.Run(r.Context(), c.store, userId, q)
+		var partial *storage.PartialError
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			intake.RespondError(w, r, err, http.StatusBadRequest)
+			return
+		} else if errors.As(err, &partial) {
+			// Serve what could be read rather than failing the whole vault
+			// because of a few bad objects. An incomplete listing must not be
+			// cached, so it carries no validators.
+			c.log.WithFields(logrus.Fields{"userId": userId, "failures": partial.Failures}).Warn("partial credential listing")
+			w.Header().Set("Warning", fmt.Sprintf("199 jackstand %q", partial.Error()))
+		} else if err != nil {
 			intake.RespondError(w, r, err, http.StatusInternalServerError)
 			return
+		} else {
+			setValidators(w, etag, modified)
 		}
 
-		intake.RespondJSON(w, r, http.StatusOK, ts)
+		if page.Next != "" {
+			w.Header().Set("X-Next-Cursor", page.Next)
+		}
+		respondList(w, r, view, page.Credentials)
 	})
 }
 
+// searchCredentials finds credentials whose service, username or url
+// metadata equal the given values, ignoring case and for urls everything but
+// the host. Encrypted credentials are matched by their blind index, so only
+// the matches are decrypted.
+func (c *Credentials) searchCredentials(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		search := storage.Search{
+			Service:  r.URL.Query().Get("service"),
+			Username: r.URL.Query().Get("username"),
+			URL:      r.URL.Query().Get("url"),
+		}
+
+		view, err := parseListView(r)
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		credentials, err := storage.RunSearch(r.Context(), c.store, userId, search)
+		var partial *storage.PartialError
+		if errors.Is(err, storage.ErrEmptySearch) {
+			intake.RespondError(w, r, err, http.StatusBadRequest)
+			return
+		} else if errors.As(err, &partial) {
+			c.log.WithFields(logrus.Fields{"userId": userId, "failures": partial.Failures}).Warn("partial credential search")
+			w.Header().Set("Warning", fmt.Sprintf("199 jackstand %q", partial.Error()))
+		} else if err != nil {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		respondList(w, r, view, credentials)
+	})
+}
+
+// getSummaries serves a credential listing from the user's manifest, which
+// takes a single read no matter how many credentials the user has.
+func (c *Credentials) getSummaries(w http.ResponseWriter, r *http.Request, m manifest.Manifest, q storage.Query, view listView) {
+	credentials := make([]models.Credential, 0, len(m.Credentials))
+	for i := range m.Credentials {
+		credentials = append(credentials, models.Credential{
+			Uid:       m.Credentials[i].Uid,
+			Service:   m.Credentials[i].Service,
+			Username:  m.Credentials[i].Username,
+			Tags:      m.Credentials[i].Tags,
+			CreatedAt: m.Credentials[i].CreatedAt,
+			UpdatedAt: m.Credentials[i].UpdatedAt,
+		})
+	}
+
+	page, err := q.Apply(credentials)
+	if err != nil {
+		intake.RespondError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	if page.Next != "" {
+		w.Header().Set("X-Next-Cursor", page.Next)
+	}
+	respondList(w, r, view, page.Credentials)
+}
+
 func (c *Credentials) deleteCredential(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	subendpoints.UserIdFromClaims(w, r, func(userId string) {
 		subendpoints.CredentialIdFromParams(w, r, params, func(credentialUid uuid.UUID) {
-			objectKey := s3.GetKeyForSingleCredential(userId, credentialUid)
+			unlock := c.locks.lock(userId)
+			defer unlock()
+
+			existingCredential, err := c.uncached.Get(r.Context(), userId, credentialUid)
+			if err != nil {
+				intake.RespondError(w, r, err, http.StatusBadRequest)
+				return
+			}
 
-			if err := s3.DeleteCredential(c.log, c.sess, c.bucket, objectKey); err != nil {
+			if !c.checkIfMatch(w, r, existingCredential) {
+				return
+			}
+
+			// Trash the credential before deleting it so it can be restored
+			// until the purger removes it for good.
+			if err := c.trash.Put(r.Context(), userId, existingCredential); err != nil {
+				intake.RespondError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+
+			if err := c.store.Delete(r.Context(), userId, credentialUid); err != nil {
+				intake.RespondError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			if err := c.unindexCredential(r.Context(), userId, credentialUid); err != nil {
 				intake.RespondError(w, r, err, http.StatusInternalServerError)
 				return
 			}
@@ -198,3 +352,423 @@ func (c *Credentials) deleteCredential(w http.ResponseWriter, r *http.Request, p
 		})
 	})
 }
+
+func (c *Credentials) getTrash(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		view, err := parseListView(r)
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		items, err := c.trash.List(r.Context(), userId)
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		body, err := view.renderTrash(items)
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		intake.RespondJSON(w, r, http.StatusOK, body)
+	})
+}
+
+func (c *Credentials) restoreTrash(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		subendpoints.CredentialIdFromParams(w, r, params, func(credentialUid uuid.UUID) {
+			unlock := c.locks.lock(userId)
+			defer unlock()
+
+			item, err := c.trash.Get(r.Context(), userId, credentialUid)
+			if errors.Is(err, storage.ErrNotFound) {
+				intake.RespondError(w, r, err, http.StatusNotFound)
+				return
+			} else if err != nil {
+				intake.RespondError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+
+			credential := item.Credential
+			credential.UpdatedAt = models.CustomTime(time.Now())
+			if err := c.store.Create(r.Context(), userId, credential); err != nil {
+				intake.RespondError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			if err := c.indexCredential(r.Context(), userId, credential); err != nil {
+				intake.RespondError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+
+			if err := c.trash.Remove(r.Context(), userId, credentialUid); err != nil {
+				c.log.WithError(err).WithFields(logrus.Fields{"userId": userId, "credentialUid": credentialUid}).Warn("error removing restored credential from trash")
+			}
+
+			w.Header().Set("ETag", credential.ETag())
+			intake.RespondJSON(w, r, http.StatusOK, credential)
+		})
+	})
+}
+
+func (c *Credentials) purgeTrash(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		subendpoints.CredentialIdFromParams(w, r, params, func(credentialUid uuid.UUID) {
+			unlock := c.locks.lock(userId)
+			defer unlock()
+
+			if _, err := c.trash.Get(r.Context(), userId, credentialUid); errors.Is(err, storage.ErrNotFound) {
+				intake.RespondError(w, r, err, http.StatusNotFound)
+				return
+			} else if err != nil {
+				intake.RespondError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+
+			if err := c.trash.Purge(r.Context(), userId, credentialUid); err != nil {
+				intake.RespondError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+
+			intake.RespondJSON(w, r, http.StatusOK, map[string]string{
+				"status":      "purged",
+				"description": "credential permanently deleted OK",
+			})
+		})
+	})
+}
+
+func (c *Credentials) getHistory(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		subendpoints.CredentialIdFromParams(w, r, params, func(credentialUid uuid.UUID) {
+			if _, err := c.store.Get(r.Context(), userId, credentialUid); err != nil {
+				intake.RespondError(w, r, err, http.StatusBadRequest)
+				return
+			}
+
+			hist, err := c.history.Get(r.Context(), userId, credentialUid)
+			if err != nil {
+				intake.RespondError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			intake.RespondJSON(w, r, http.StatusOK, hist)
+		})
+	})
+}
+
+func (c *Credentials) restoreVersion(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		subendpoints.CredentialIdFromParams(w, r, params, func(credentialUid uuid.UUID) {
+			n, err := strconv.Atoi(params.ByName("version"))
+			if err != nil {
+				intake.RespondError(w, r, err, http.StatusBadRequest)
+				return
+			}
+
+			version, err := c.history.Version(r.Context(), userId, credentialUid, n)
+			if errors.Is(err, history.ErrVersionNotFound) {
+				intake.RespondError(w, r, err, http.StatusNotFound)
+				return
+			} else if err != nil {
+				intake.RespondError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+
+			// Restoring is an update like any other, so the version being
+			// replaced is kept and can be restored in turn.
+			c.modifyCredential(w, r, userId, credentialUid, func(credential *models.Credential) error {
+				restored := version.Credential
+				restored.Uid = credential.Uid
+				restored.CreatedAt = credential.CreatedAt
+				*credential = restored
+				return nil
+			})
+		})
+	})
+}
+
+func (c *Credentials) getSettings(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		s, err := settings.Get(r.Context(), c.store, userId)
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		intake.RespondJSON(w, r, http.StatusOK, s)
+	})
+}
+
+// updateSettings changes the user's settings. The mode can only change while
+// the user has no credentials, trashed ones included, since credentials are
+// not converted between modes.
+func (c *Credentials) updateSettings(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		var s settings.Settings
+		if err := intake.UnmarshalJSON(r.Body, &s); err != nil {
+			intake.RespondError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		unlock := c.locks.lock(userId)
+		defer unlock()
+
+		existing, err := settings.Get(r.Context(), c.store, userId)
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		if existing.Mode != s.Mode {
+			credentials, err := c.uncached.List(r.Context(), userId)
+			if err != nil {
+				intake.RespondError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+
+			trashed, err := c.trash.List(r.Context(), userId)
+			if err != nil {
+				intake.RespondError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+
+			if len(credentials) > 0 || len(trashed) > 0 {
+				intake.RespondError(w, r, errors.New("the mode can only change while there are no credentials"), http.StatusConflict)
+				return
+			}
+		}
+
+		if err := settings.Put(r.Context(), c.store, userId, s); err != nil {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		intake.RespondJSON(w, r, http.StatusOK, s)
+	})
+}
+
+// decodeCredential reads a credential from the request body, see
+// parseCredential.
+func (c *Credentials) decodeCredential(w http.ResponseWriter, r *http.Request, userId string) (models.Credential, bool) {
+	s, err := settings.Get(r.Context(), c.store, userId)
+	if err != nil {
+		intake.RespondError(w, r, err, http.StatusInternalServerError)
+		return models.Credential{}, false
+	}
+
+	credential, err := parseCredential(s.Mode, r.Body)
+	if err != nil {
+		intake.RespondError(w, r, err, http.StatusBadRequest)
+		return credential, false
+	}
+	return credential, true
+}
+
+// parseCredential reads a credential written by a client in the mode. In vault
+// mode only a client encrypted blob is accepted, and any plaintext field is
+// rejected so it cannot reach the server by mistake.
+func parseCredential(mode string, body io.Reader) (models.Credential, error) {
+	var credential models.Credential
+	if mode != settings.ModeVault {
+		if err := intake.UnmarshalJSON(body, &credential); err != nil {
+			return credential, err
+		}
+
+		credential.Blob = nil
+		credential.BlindIndex = nil
+		credential.Envelope = nil
+		return credential, nil
+	}
+
+	item := struct {
+		Blob *models.Blob `json:"blob"`
+	}{}
+
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&item); err != nil {
+		return credential, fmt.Errorf("vault credentials only have a blob %w", err)
+	}
+
+	if item.Blob == nil {
+		return credential, errors.New("blob is required")
+	}
+
+	if err := item.Blob.Validate(); err != nil {
+		return credential, err
+	}
+
+	credential.Blob = item.Blob
+	return credential, nil
+}
+
+// checkStandardMode reports whether the user is in standard mode, responding
+// 409 when they are in vault mode, where the server cannot change individual
+// fields of a credential.
+func (c *Credentials) checkStandardMode(w http.ResponseWriter, r *http.Request, userId string) bool {
+	s, err := settings.Get(r.Context(), c.store, userId)
+	if err != nil {
+		intake.RespondError(w, r, err, http.StatusInternalServerError)
+		return false
+	}
+
+	if s.Mode == settings.ModeVault {
+		intake.RespondError(w, r, errors.New("fields cannot be updated in vault mode, replace the credential instead"), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// modifyCredential applies fn to the stored credential and writes it back,
+// provided the request's If-Match header still matches the stored version.
+// An error from fn is the client's and fails the request with 400.
+func (c *Credentials) modifyCredential(w http.ResponseWriter, r *http.Request, userId string, credentialUid uuid.UUID, fn func(credential *models.Credential) error) {
+	unlock := c.locks.lock(userId)
+	defer unlock()
+
+	existingCredential, err := c.uncached.Get(r.Context(), userId, credentialUid)
+	if err != nil {
+		intake.RespondError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	if !c.checkIfMatch(w, r, existingCredential) {
+		return
+	}
+
+	credential := existingCredential
+	if err := fn(&credential); err != nil {
+		intake.RespondError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	credential.UpdatedAt = models.CustomTime(time.Now())
+
+	// Keep the version being replaced, failing the update rather than
+	// losing it.
+	if err := c.history.Record(r.Context(), userId, existingCredential); err != nil {
+		intake.RespondError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err := c.store.Update(r.Context(), userId, credential); err != nil {
+		intake.RespondError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if err := c.indexCredential(r.Context(), userId, credential); err != nil {
+		intake.RespondError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", credential.ETag())
+	intake.RespondJSON(w, r, http.StatusOK, credential)
+}
+
+// checkIfMatch reports whether the request's If-Match header allows it to
+// modify the credential, responding 412 when the credential has changed since
+// the client read it and 428 when a required header is missing.
+func (c *Credentials) checkIfMatch(w http.ResponseWriter, r *http.Request, credential models.Credential) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if c.requireIfMatch {
+			intake.RespondError(w, r, errors.New("If-Match header required"), http.StatusPreconditionRequired)
+			return false
+		}
+		return true
+	}
+
+	etag := credential.ETag()
+	if etagMatches(header, etag) {
+		return true
+	}
+
+	w.Header().Set("ETag", etag)
+	intake.RespondError(w, r, errors.New("credential has been modified"), http.StatusPreconditionFailed)
+	return false
+}
+
+// etagMatches reports whether an If-Match header matches the entity tag.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		// If-Match uses the strong comparison, so weak tags never match.
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// maxListLimit caps the page size a client can ask the list endpoint for.
+const maxListLimit = 1000
+
+// listQuery reads the service, username, sort, order, limit and cursor query
+// parameters of the list endpoint.
+func listQuery(r *http.Request) (storage.Query, error) {
+	values := r.URL.Query()
+	q := storage.Query{
+		Service:  values.Get("service"),
+		Username: values.Get("username"),
+		Search:   values.Get("q"),
+		Tags:     values["tag"],
+		SortBy:   values.Get("sort"),
+		Cursor:   values.Get("cursor"),
+	}
+
+	for param, t := range map[string]*time.Time{
+		"createdAfter":  &q.CreatedAfter,
+		"createdBefore": &q.CreatedBefore,
+		"updatedAfter":  &q.UpdatedAfter,
+		"updatedBefore": &q.UpdatedBefore,
+	} {
+		if value := values.Get(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 time", param)
+			}
+			*t = parsed
+		}
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxListLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		q.Limit = n
+	}
+
+	switch q.SortBy {
+	case "", storage.SortByService, storage.SortByUsername, storage.SortByCreatedAt, storage.SortByUpdatedAt:
+	default:
+		return q, fmt.Errorf("unknown sort %q", q.SortBy)
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("unknown order %q", values.Get("order"))
+	}
+	return q, nil
+}
+
+// indexCredential records a written credential in the user's manifest. The
+// manifest is dropped when it cannot be updated, so an error means listings
+// may answer from a stale manifest and the write has to be reported as
+// failed.
+func (c *Credentials) indexCredential(ctx context.Context, userId string, credential models.Credential) error {
+	if err := c.manifest.Put(ctx, userId, credential); err != nil {
+		c.log.WithError(err).WithFields(logrus.Fields{"userId": userId, "credentialUid": credential.Uid}).Error("error updating manifest")
+		return fmt.Errorf("credential was saved but the index could not be updated %w", err)
+	}
+	return nil
+}
+
+// unindexCredential drops a deleted credential from the user's manifest, see
+// indexCredential.
+func (c *Credentials) unindexCredential(ctx context.Context, userId string, credentialUid uuid.UUID) error {
+	if err := c.manifest.Remove(ctx, userId, credentialUid); err != nil {
+		c.log.WithError(err).WithFields(logrus.Fields{"userId": userId, "credentialUid": credentialUid}).Error("error updating manifest")
+		return fmt.Errorf("credential was deleted but the index could not be updated %w", err)
+	}
+	return nil
+}
@@ -3,41 +3,46 @@ package api
 import (
 	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
 	"math/rand"
+	"os"
 	"time"
 
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/brianvoe/gofakeit"
 	"github.com/dbubel/intake"
+	"github.com/dbubel/jackstand-api/archive"
+	"github.com/dbubel/jackstand-api/audit"
+	"github.com/dbubel/jackstand-api/cacher"
+	"github.com/dbubel/jackstand-api/history"
+	"github.com/dbubel/jackstand-api/importer"
+	"github.com/dbubel/jackstand-api/kdbx"
+	"github.com/dbubel/jackstand-api/manifest"
+	"github.com/dbubel/jackstand-api/memory"
 	"github.com/dbubel/jackstand-api/models"
-	"github.com/dbubel/jackstand-api/s3"
+	"github.com/dbubel/jackstand-api/settings"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/dbubel/jackstand-api/trash"
 	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
-var sess *session.Session
 var log *logrus.Logger
-var testBucket string = "jackstand-s3-test"
 
 func init() {
 	gofakeit.Seed(rand.Int63())
-	bs := true
-	testEndpoint := "http://localhost:5002"
-	sess, _ = session.NewSession(&aws.Config{
-		Region:           aws.String("us-east-1"),
-		Endpoint:         &testEndpoint,
-		S3ForcePathStyle: &bs,
-	})
 	log = logrus.New()
 	log.SetLevel(logrus.ErrorLevel)
 }
@@ -48,6 +53,23 @@ func FakeAuth(next intake.Handler) intake.Handler {
 	}
 }
 
+func newTestCredentials() Credentials {
+	store := memory.NewStore()
+	hist := history.New(store, 3)
+	return Credentials{
+		store:    store,
+		uncached: store,
+		manifest: manifest.New(log, store),
+		history:  hist,
+		trash:    trash.New(log, store, hist),
+		audit:    audit.New(store),
+		locks:    newUserLocks(),
+		log:      log,
+
+		exportMaxTokenAge: 5 * time.Minute,
+	}
+}
+
 func randomCredential() models.Credential {
 	return models.Credential{
 		Uid:         uuid.Must(uuid.NewV4()),
@@ -59,28 +81,39 @@ func randomCredential() models.Credential {
 	}
 }
 
+// TestMain runs the tests in America/New_York, where models.CustomTime
+// writes times, so that they are read back as the same instants.
+func TestMain(m *testing.M) {
+	time.Local, _ = time.LoadLocation("America/New_York")
+	os.Exit(m.Run())
+}
+
+// inUTC returns the credentials with their times in UTC, like the ones they
+// were stored from.
+func inUTC(credentials ...models.Credential) []models.Credential {
+	for i := range credentials {
+		credentials[i].CreatedAt = models.CustomTime(time.Time(credentials[i].CreatedAt).UTC())
+		credentials[i].UpdatedAt = models.CustomTime(time.Time(credentials[i].UpdatedAt).UTC())
+	}
+	return credentials
+}
+
 func TestGetCredential(t *testing.T) {
 	testCredential1 := randomCredential()
 	testCredential2 := randomCredential()
 
 	app := intake.New(log)
-	credsApi := Credentials{
-		bucket: testBucket,
-		sess:   sess,
-		log:    log,
-	}
+	credsApi := newTestCredentials()
 
 	credentialsSlice := append([]models.Credential{}, testCredential1, testCredential2)
 	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
 	userIdFromClaims := gofakeit.Username()
 	userIdFromClaims2 := gofakeit.Username()
 	_ = userIdFromClaims2
-	objectKey := s3.GetKeyForSingleCredential(userIdFromClaims, testCredential1.Uid)
-	err := s3.CreateCredential(log, sess, credsApi.bucket, objectKey, testCredential1)
+	err := credsApi.store.Create(context.Background(), userIdFromClaims, testCredential1)
 	assert.NoError(t, err)
 
-	objectKey = s3.GetKeyForSingleCredential(userIdFromClaims, testCredential2.Uid)
-	err = s3.CreateCredential(log, sess, credsApi.bucket, objectKey, testCredential2)
+	err = credsApi.store.Create(context.Background(), userIdFromClaims, testCredential2)
 	assert.NoError(t, err)
 
 	t.Run("test getting a specific credential for a user", func(t *testing.T) {
@@ -93,11 +126,11 @@ func TestGetCredential(t *testing.T) {
 		err := json.Unmarshal(body, &c)
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, w.Code)
-		assert.Equal(t, testCredential1, c)
+		assert.Equal(t, testCredential1, inUTC(c)[0])
 	})
 
 	t.Run("test getting all credentials for a user", func(t *testing.T) {
-		r := httptest.NewRequest(http.MethodGet, "/users/credentials", nil)
+		r := httptest.NewRequest(http.MethodGet, "/users/credentials?view=full", nil)
 		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
 		w := httptest.NewRecorder()
 		app.Router.ServeHTTP(w, r.WithContext(ctx))
@@ -107,12 +140,12 @@ func TestGetCredential(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Len(t, c, 2)
 		assert.Equal(t, http.StatusOK, w.Code, fmt.Sprintf("resp:%s", string(body)))
-		assert.Contains(t, credentialsSlice, c[0])
+		assert.Contains(t, credentialsSlice, inUTC(c[0])[0])
 		//assert.Contains(t, credentialsSlice, c[1])
 	})
 
 	t.Run("test getting all credentials for a user", func(t *testing.T) {
-		r := httptest.NewRequest(http.MethodGet, "/users/credentials", nil)
+		r := httptest.NewRequest(http.MethodGet, "/users/credentials?view=full", nil)
 		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
 		w := httptest.NewRecorder()
 		app.Router.ServeHTTP(w, r.WithContext(ctx))
@@ -122,8 +155,8 @@ func TestGetCredential(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Len(t, c, 2)
 		assert.Equal(t, http.StatusOK, w.Code, fmt.Sprintf("resp:%s", string(body)))
-		assert.Contains(t, credentialsSlice, c[0])
-		assert.Contains(t, credentialsSlice, c[1])
+		assert.Contains(t, credentialsSlice, inUTC(c[0])[0])
+		assert.Contains(t, credentialsSlice, inUTC(c[1])[0])
 	})
 
 	t.Run("test get credentialId does not exist", func(t *testing.T) {
@@ -163,7 +196,7 @@ func TestGetCredential(t *testing.T) {
 	t.Run("nuke bucket", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
-		err := s3.DeleteAll(ctx, log, sess, testBucket, "users/")
+		err := credsApi.store.DeleteAll(ctx, userIdFromClaims)
 		assert.NoError(t, err)
 	})
 }
@@ -177,12 +210,7 @@ func TestCreateCredential(t *testing.T) {
 	_, _ = userIdFromClaims, userIdFromClaims2
 
 	app := intake.New(log)
-	credsApi := Credentials{
-		bucket: testBucket,
-		sess:   sess,
-		log:    log,
-		//cache:  cacher.NewCacherDefault(),
-	}
+	credsApi := newTestCredentials()
 	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
 
 	t.Run("test creating a new credential for a user", func(t *testing.T) {
@@ -196,9 +224,7 @@ func TestCreateCredential(t *testing.T) {
 		err := json.Unmarshal(body, &c)
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, w.Code)
-		objectKey := s3.GetKeyForSingleCredential(userIdFromClaims, c.Uid)
-		var objectFroms3 models.Credential
-		err = s3.GetCredential(log, sess, testBucket, objectKey, &objectFroms3)
+		objectFroms3, err := credsApi.store.Get(context.Background(), userIdFromClaims, c.Uid)
 		assert.NoError(t, err)
 		assert.Equal(t, testCredential1.Username, c.Username)
 		assert.Equal(t, testCredential1.Username, objectFroms3.Username)
@@ -214,7 +240,7 @@ func TestCreateCredential(t *testing.T) {
 		// check how many objects exist
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
-		countOld, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countOld, err := credsApi.store.List(ctx, userIdFromClaims)
 		assert.NoError(t, err)
 		requestBody := []byte(` { "Password": "coffee", "Service":"github" }`)
 		r := httptest.NewRequest(http.MethodPost, "/users/credentials", bytes.NewReader(requestBody))
@@ -228,16 +254,16 @@ func TestCreateCredential(t *testing.T) {
 			string(body),
 		)
 
-		countNew, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countNew, err := credsApi.store.List(ctx, userIdFromClaims)
 		// ensure no new objects were created
-		assert.Equal(t, len(countOld.Contents), len(countNew.Contents))
+		assert.Equal(t, len(countOld), len(countNew))
 	})
 
 	t.Run("test create credential missing password", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
 		// check how many objects exist
-		countOld, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countOld, err := credsApi.store.List(ctx, userIdFromClaims)
 		assert.NoError(t, err)
 		requestBody := []byte(` { "Username": "coffee", "Service":"github" }`)
 		r := httptest.NewRequest(http.MethodPost, "/users/credentials", bytes.NewReader(requestBody))
@@ -251,16 +277,16 @@ func TestCreateCredential(t *testing.T) {
 			string(body),
 		)
 
-		countNew, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countNew, err := credsApi.store.List(ctx, userIdFromClaims)
 		// ensure no new objects were created
-		assert.Equal(t, len(countOld.Contents), len(countNew.Contents))
+		assert.Equal(t, len(countOld), len(countNew))
 	})
 
 	t.Run("test create credential missing service", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
 		// check how many objects exist
-		countOld, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countOld, err := credsApi.store.List(ctx, userIdFromClaims)
 		assert.NoError(t, err)
 		requestBody := []byte(` { "Username": "coffee", "Password":"github" }`)
 		r := httptest.NewRequest(http.MethodPost, "/users/credentials", bytes.NewReader(requestBody))
@@ -274,16 +300,16 @@ func TestCreateCredential(t *testing.T) {
 			string(body),
 		)
 
-		countNew, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countNew, err := credsApi.store.List(ctx, userIdFromClaims)
 		// ensure no new objects were created
-		assert.Equal(t, len(countOld.Contents), len(countNew.Contents))
+		assert.Equal(t, len(countOld), len(countNew))
 	})
 
 	t.Run("test create credential bad json", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
 		// check how many objects exist
-		countOld, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countOld, err := credsApi.store.List(ctx, userIdFromClaims)
 		assert.NoError(t, err)
 		requestBody := []byte(` { "Username": "coff`)
 		r := httptest.NewRequest(http.MethodPost, "/users/credentials", bytes.NewReader(requestBody))
@@ -297,15 +323,15 @@ func TestCreateCredential(t *testing.T) {
 			string(body),
 		)
 
-		countNew, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countNew, err := credsApi.store.List(ctx, userIdFromClaims)
 		// ensure no new objects were created
-		assert.Equal(t, len(countOld.Contents), len(countNew.Contents))
+		assert.Equal(t, len(countOld), len(countNew))
 	})
 
 	t.Run("nuke bucket", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
-		err := s3.DeleteAll(ctx, log, sess, testBucket, "users/")
+		err := credsApi.store.DeleteAll(ctx, userIdFromClaims)
 		assert.NoError(t, err)
 	})
 }
@@ -319,22 +345,17 @@ func TestUpdateCredential(t *testing.T) {
 	_, _ = userIdFromClaims, userIdFromClaims2
 
 	app := intake.New(log)
-	credsApi := Credentials{
-		bucket: testBucket,
-		sess:   sess,
-		log:    log,
-	}
+	credsApi := newTestCredentials()
 
 	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
 
-	var credentialToModify models.Credential
-	s3.CreateCredential(log, sess, testBucket, s3.GetKeyForSingleCredential(userIdFromClaims, testCredential1.Uid), testCredential1)
-	s3.GetCredential(log, sess, testBucket, s3.GetKeyForSingleCredential(userIdFromClaims, testCredential1.Uid), &credentialToModify)
+	credsApi.store.Create(context.Background(), userIdFromClaims, testCredential1)
+	credentialToModify, _ := credsApi.store.Get(context.Background(), userIdFromClaims, testCredential1.Uid)
 
 	t.Run("test updating username for a credential", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
-		countOld, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countOld, err := credsApi.store.List(ctx, userIdFromClaims)
 		requestBody := []byte(` { "Username": "coffee" }`)
 		r := httptest.NewRequest(http.MethodPut, "/users/credentials/"+credentialToModify.Uid.String()+"/username", bytes.NewReader(requestBody))
 		ctx = context.WithValue(ctx, "userId", userIdFromClaims)
@@ -346,8 +367,7 @@ func TestUpdateCredential(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, w.Code)
 
-		var objectFroms3 models.Credential
-		err = s3.GetCredential(log, sess, testBucket, s3.GetKeyForSingleCredential(userIdFromClaims, recievedCred.Uid), &objectFroms3)
+		objectFroms3, err := credsApi.store.Get(context.Background(), userIdFromClaims, recievedCred.Uid)
 		assert.NoError(t, err)
 		assert.NotEqual(t, testCredential1.Username, recievedCred.Username)
 		assert.NotEqual(t, testCredential1.Username, objectFroms3.Username)
@@ -361,15 +381,15 @@ func TestUpdateCredential(t *testing.T) {
 		assert.Equal(t, testCredential1.Service, recievedCred.Service)
 		assert.Equal(t, testCredential1.Service, objectFroms3.Service)
 
-		countNew, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countNew, err := credsApi.store.List(ctx, userIdFromClaims)
 		// ensure no new objects were created
-		assert.Equal(t, len(countOld.Contents), len(countNew.Contents))
+		assert.Equal(t, len(countOld), len(countNew))
 	})
 
 	t.Run("test updating password for a credential", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
-		countOld, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countOld, err := credsApi.store.List(ctx, userIdFromClaims)
 		requestBody := []byte(` { "Password": "passwordisweak" }`)
 		r := httptest.NewRequest(http.MethodPut, "/users/credentials/"+credentialToModify.Uid.String()+"/password", bytes.NewReader(requestBody))
 		ctx = context.WithValue(r.Context(), "userId", userIdFromClaims)
@@ -381,8 +401,7 @@ func TestUpdateCredential(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, w.Code)
 
-		var objectFroms3 models.Credential
-		err = s3.GetCredential(log, sess, testBucket, s3.GetKeyForSingleCredential(userIdFromClaims, recievedCred.Uid), &objectFroms3)
+		objectFroms3, err := credsApi.store.Get(context.Background(), userIdFromClaims, recievedCred.Uid)
 		assert.NoError(t, err)
 
 		assert.Equal(t, recievedCred.Password, "passwordisweak")
@@ -394,15 +413,15 @@ func TestUpdateCredential(t *testing.T) {
 		assert.Equal(t, testCredential1.Service, recievedCred.Service)
 		assert.Equal(t, testCredential1.Service, objectFroms3.Service)
 
-		countNew, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countNew, err := credsApi.store.List(ctx, userIdFromClaims)
 		// ensure no new objects were created
-		assert.Equal(t, len(countOld.Contents), len(countNew.Contents))
+		assert.Equal(t, len(countOld), len(countNew))
 	})
 
 	t.Run("test updating service for a credential", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
-		countOld, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countOld, err := credsApi.store.List(ctx, userIdFromClaims)
 		requestBody := []byte(` { "Service": "serviceisweak" }`)
 		r := httptest.NewRequest(http.MethodPut, "/users/credentials/"+credentialToModify.Uid.String()+"/service", bytes.NewReader(requestBody))
 		ctx = context.WithValue(ctx, "userId", userIdFromClaims)
@@ -414,8 +433,7 @@ func TestUpdateCredential(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, w.Code)
 
-		var objectFroms3 models.Credential
-		err = s3.GetCredential(log, sess, testBucket, s3.GetKeyForSingleCredential(userIdFromClaims, recievedCred.Uid), &objectFroms3)
+		objectFroms3, err := credsApi.store.Get(context.Background(), userIdFromClaims, recievedCred.Uid)
 		assert.NoError(t, err)
 
 		assert.Equal(t, recievedCred.Password, "passwordisweak")
@@ -427,9 +445,9 @@ func TestUpdateCredential(t *testing.T) {
 		assert.Equal(t, recievedCred.Service, "serviceisweak")
 		assert.Equal(t, objectFroms3.Service, "serviceisweak")
 
-		countNew, err := s3.List(ctx, log, sess, testBucket, "users/")
+		countNew, err := credsApi.store.List(ctx, userIdFromClaims)
 		// ensure no new objects were created
-		assert.Equal(t, len(countOld.Contents), len(countNew.Contents))
+		assert.Equal(t, len(countOld), len(countNew))
 	})
 
 	t.Run("test updating service for a credential that is too long", func(t *testing.T) {
@@ -460,14 +478,1479 @@ func TestUpdateCredential(t *testing.T) {
 		//
 		//countNew, err := s3.List(log, sess, testBucket, "users/")
 		//// ensure no new objects were created
-		//assert.Equal(t, len(countOld.Contents), len(countNew.Contents))
+		//assert.Equal(t, len(countOld), len(countNew))
 	})
 
 	t.Run("nuke bucket", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
-		err := s3.DeleteAll(ctx, log, sess, testBucket, "users/")
+		err := credsApi.store.DeleteAll(ctx, userIdFromClaims)
+		assert.NoError(t, err)
+	})
+
+}
+
+func TestListCredentials(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	now := time.Now()
+	services := []string{"github", "gitlab", "amazon", "bank", "google"}
+	for i := range services {
+		c := randomCredential()
+		c.Service = services[i]
+		c.CreatedAt = models.CustomTime(now.Add(-time.Duration(i) * time.Hour))
+		if i%2 == 0 {
+			c.Tags = []string{"work"}
+		}
+		if c.Service == "bank" {
+			c.Description = "Savings account"
+			c.Metadata = map[string]string{"branch": "Main Street", "secret:pin": "4321"}
+		}
+		err := credsApi.store.Create(context.Background(), userIdFromClaims, c)
+		assert.NoError(t, err)
+	}
+
+	list := func(query string) (*httptest.ResponseRecorder, []models.Credential) {
+		r := httptest.NewRequest(http.MethodGet, "/users/credentials"+query, nil)
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		var c []models.Credential
+		json.Unmarshal(w.Body.Bytes(), &c)
+		return w, c
+	}
+
+	t.Run("test paging through credentials", func(t *testing.T) {
+		var all []models.Credential
+		query := "?limit=2"
+		for pages := 1; ; pages++ {
+			w, c := list(query)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.LessOrEqual(t, len(c), 2)
+			all = append(all, c...)
+
+			next := w.Header().Get("X-Next-Cursor")
+			if next == "" {
+				assert.Equal(t, 3, pages)
+				break
+			}
+			query = "?limit=2&cursor=" + next
+		}
+		assert.Len(t, all, len(services))
+	})
+
+	t.Run("test sorting and filtering credentials", func(t *testing.T) {
+		w, c := list("?sort=service&order=desc&service=g")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Len(t, c, 3)
+		assert.Equal(t, "google", c[0].Service)
+		assert.Equal(t, "gitlab", c[1].Service)
+		assert.Equal(t, "github", c[2].Service)
+	})
+
+	t.Run("test searching credentials", func(t *testing.T) {
+		w, c := list("?q=saving")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Len(t, c, 1)
+		assert.Equal(t, "bank", c[0].Service)
+
+		_, c = list("?q=main+street")
+		assert.Len(t, c, 1)
+
+		w, _ = list("?q=bank+nothing")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+
+		// Secret metadata values are not searched.
+		w, _ = list("?q=4321")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+
+		w, _ = list("?q=saving&view=summary")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "Savings")
+	})
+
+	t.Run("test filtering by tags and time", func(t *testing.T) {
+		_, c := list("?tag=WORK&sort=createdAt")
+		assert.Len(t, c, 3)
+		assert.Equal(t, "google", c[0].Service)
+		assert.Equal(t, "github", c[2].Service)
+
+		after := now.Add(-150 * time.Minute).UTC().Format(time.RFC3339)
+		_, c = list("?createdAfter=" + after + "&sort=createdAt&order=desc")
+		assert.Len(t, c, 3)
+		assert.Equal(t, "github", c[0].Service)
+
+		_, c = list("?createdAfter=" + after + "&tag=work&view=summary")
+		assert.Len(t, c, 2)
+	})
+
+	t.Run("test no credentials match", func(t *testing.T) {
+		w, _ := list("?service=nothing")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	})
+
+	t.Run("test invalid list parameters", func(t *testing.T) {
+		for _, query := range []string{"?limit=0", "?limit=abc", "?limit=5000", "?cursor=notacursor", "?sort=password", "?order=up", "?createdAfter=yesterday"} {
+			w, _ := list(query)
+			assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		}
+	})
+}
+
+func TestCredentialSummaries(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	do := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		return w
+	}
+
+	summaries := func() []models.CredentialSummary {
+		w := do(http.MethodGet, "/users/credentials?view=summary", nil)
+		var s []models.CredentialSummary
+		json.Unmarshal(w.Body.Bytes(), &s)
+		return s
+	}
+
+	var created models.Credential
+	t.Run("test create updates the manifest", func(t *testing.T) {
+		requestBody, _ := json.Marshal(randomCredential())
+		w := do(http.MethodPost, "/users/credentials", requestBody)
+		assert.Equal(t, http.StatusOK, w.Code)
+		json.Unmarshal(w.Body.Bytes(), &created)
+
+		s := summaries()
+		assert.Len(t, s, 1)
+		assert.Equal(t, created.Uid, s[0].Uid)
+		assert.Equal(t, created.Service, s[0].Service)
+		assert.NotContains(t, w.Body.String(), `"password":""`)
+	})
+
+	t.Run("test summaries do not contain passwords", func(t *testing.T) {
+		w := do(http.MethodGet, "/users/credentials?view=summary", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), created.Password)
+	})
+
+	t.Run("test update changes the manifest", func(t *testing.T) {
+		w := do(http.MethodPut, "/users/credentials/"+created.Uid.String()+"/username", []byte(`{"Username":"coffee"}`))
+		assert.Equal(t, http.StatusOK, w.Code)
+		s := summaries()
+		assert.Len(t, s, 1)
+		assert.Equal(t, "coffee", s[0].Username)
+	})
+
+	t.Run("test manifest is rebuilt when it drifts", func(t *testing.T) {
+		extra := randomCredential()
+		err := credsApi.store.Create(context.Background(), userIdFromClaims, extra)
+		assert.NoError(t, err)
+		assert.Len(t, summaries(), 1)
+
+		assert.NoError(t, credsApi.manifest.Reconcile(context.Background()))
+		assert.Len(t, summaries(), 2)
+	})
+
+	t.Run("test delete removes from the manifest", func(t *testing.T) {
+		w := do(http.MethodDelete, "/users/credentials/"+created.Uid.String(), nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		s := summaries()
+		assert.Len(t, s, 1)
+		assert.NotEqual(t, created.Uid, s[0].Uid)
+	})
+
+	t.Run("test unknown view", func(t *testing.T) {
+		w := do(http.MethodGet, "/users/credentials?view=everything", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestListFields(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	credential := randomCredential()
+	credential.Metadata = map[string]string{"branch": "main", "secret:pin": "4321"}
+	assert.NoError(t, credsApi.store.Create(context.Background(), userIdFromClaims, credential))
+
+	list := func(query string) (*httptest.ResponseRecorder, []map[string]interface{}) {
+		r := httptest.NewRequest(http.MethodGet, "/users/credentials"+query, nil)
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		var c []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &c)
+		return w, c
+	}
+
+	t.Run("test summaries are the default", func(t *testing.T) {
+		w, c := list("")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Len(t, c, 1)
+		assert.Equal(t, credential.Service, c[0]["service"])
+		assert.NotContains(t, c[0], "password")
+		assert.NotContains(t, w.Body.String(), "4321")
+	})
+
+	t.Run("test projecting fields", func(t *testing.T) {
+		w, c := list("?fields=service,metadata")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Len(t, c, 1)
+		assert.ElementsMatch(t, []string{"Uid", "service", "Metadata"}, keys(c[0]))
+		assert.Equal(t, map[string]interface{}{"branch": "main"}, c[0]["Metadata"])
+
+		_, c = list("?fields=password,secrets")
+		assert.Equal(t, credential.Password, c[0]["password"])
+		assert.Equal(t, "4321", c[0]["Metadata"].(map[string]interface{})["secret:pin"])
+	})
+
+	t.Run("test the full view includes secrets", func(t *testing.T) {
+		_, c := list("?view=full")
+		assert.Equal(t, credential.Password, c[0]["password"])
+	})
+
+	t.Run("test invalid fields", func(t *testing.T) {
+		for _, query := range []string{"?fields=pin", "?fields=service&view=full"} {
+			w, _ := list(query)
+			assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		}
+	})
+}
+
+func keys(m map[string]interface{}) []string {
+	k := make([]string, 0, len(m))
+	for key := range m {
+		k = append(k, key)
+	}
+	return k
+}
+
+func TestConditionalUpdates(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	credential := randomCredential()
+	err := credsApi.store.Create(context.Background(), userIdFromClaims, credential)
+	assert.NoError(t, err)
+
+	do := func(method, path, ifMatch string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		return w
+	}
+
+	path := "/users/credentials/" + credential.Uid.String()
+	w := do(http.MethodGet, path, "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	t.Run("test update with matching etag", func(t *testing.T) {
+		w := do(http.MethodPut, path+"/username", etag, []byte(`{"Username":"coffee"}`))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+		got := do(http.MethodGet, path, "", nil)
+		assert.Equal(t, w.Header().Get("ETag"), got.Header().Get("ETag"))
+	})
+
+	t.Run("test update with stale etag", func(t *testing.T) {
+		w := do(http.MethodPut, path+"/password", etag, []byte(`{"Password":"coffee"}`))
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+		stored, err := credsApi.store.Get(context.Background(), userIdFromClaims, credential.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, credential.Password, stored.Password)
+	})
+
+	t.Run("test update with wildcard etag", func(t *testing.T) {
+		w := do(http.MethodPut, path+"/service", "*", []byte(`{"Service":"github"}`))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("test weak etag does not match", func(t *testing.T) {
+		current := do(http.MethodGet, path, "", nil).Header().Get("ETag")
+		w := do(http.MethodPut, path+"/service", "W/"+current, []byte(`{"Service":"gitlab"}`))
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	})
+
+	t.Run("test delete with stale etag", func(t *testing.T) {
+		w := do(http.MethodDelete, path, etag, nil)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+		_, err := credsApi.store.Get(context.Background(), userIdFromClaims, credential.Uid)
+		assert.NoError(t, err)
+	})
+
+	t.Run("test if-match required", func(t *testing.T) {
+		credsApi := newTestCredentials()
+		credsApi.requireIfMatch = true
+		app := intake.New(log)
+		app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+		err := credsApi.store.Create(context.Background(), userIdFromClaims, credential)
+		assert.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodPut, path+"/username", bytes.NewReader([]byte(`{"Username":"coffee"}`)))
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		assert.Equal(t, http.StatusPreconditionRequired, w.Code)
+	})
+
+	t.Run("test delete with matching etag", func(t *testing.T) {
+		current := do(http.MethodGet, path, "", nil).Header().Get("ETag")
+		w := do(http.MethodDelete, path, current, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestConditionalUpdatesBypassCache(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	credsApi.cache = cacher.NewCacher(time.Minute, 100)
+	credsApi.store = cacher.NewStore(credsApi.uncached, credsApi.cache)
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	ctx := context.Background()
+	credential := randomCredential()
+	assert.NoError(t, credsApi.store.Create(ctx, userIdFromClaims, credential))
+
+	do := func(method, path string, header http.Header, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		for k := range header {
+			r.Header.Set(k, header.Get(k))
+		}
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		return w
+	}
+
+	path := "/users/credentials/" + credential.Uid.String()
+	cached := do(http.MethodGet, path, nil, nil).Header().Get("ETag")
+
+	// Another instance updates the credential behind this one's cache.
+	changed := credential
+	changed.Username = "coffee"
+	assert.NoError(t, credsApi.uncached.Update(ctx, userIdFromClaims, changed))
+	assert.Equal(t, cached, do(http.MethodGet, path, nil, nil).Header().Get("ETag"))
+
+	t.Run("test if-none-match reads past the cache", func(t *testing.T) {
+		w := do(http.MethodGet, path, http.Header{"If-None-Match": {cached}}, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, changed.ETag(), w.Header().Get("ETag"))
+	})
+
+	t.Run("test stale cached etag does not match", func(t *testing.T) {
+		w := do(http.MethodPut, path+"/password", http.Header{"If-Match": {cached}}, []byte(`{"Password":"coffee"}`))
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	})
+
+	t.Run("test stored etag matches", func(t *testing.T) {
+		w := do(http.MethodPut, path+"/password", http.Header{"If-Match": {changed.ETag()}}, []byte(`{"Password":"coffee"}`))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		stored, err := credsApi.uncached.Get(ctx, userIdFromClaims, credential.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, "coffee", stored.Username)
+	})
+}
+
+// manifestFaults fails the writes of the manifest document, leaving every
+// other document alone.
+type manifestFaults struct {
+	*memory.Store
+	put, del error
+}
+
+func (s *manifestFaults) PutMetadata(ctx context.Context, userId, name string, v interface{}) error {
+	if name == manifest.Name && s.put != nil {
+		return s.put
+	}
+	return s.Store.PutMetadata(ctx, userId, name, v)
+}
+
+func (s *manifestFaults) DeleteMetadata(ctx context.Context, userId, name string) error {
+	if name == manifest.Name && s.del != nil {
+		return s.del
+	}
+	return s.Store.DeleteMetadata(ctx, userId, name)
+}
+
+func TestConditionalReads(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	store := credsApi.store.(*memory.Store)
+	faults := &manifestFaults{Store: store}
+	credsApi.manifest = manifest.New(log, faults)
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	do := func(method, path string, header http.Header, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		for k := range header {
+			r.Header.Set(k, header.Get(k))
+		}
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		return w
+	}
+
+	// reads counts the credential reads made by the store.
+	var reads int
+	store.SetFaults(memory.Faults{Err: func(op string) error {
+		if op == "Get" || op == "List" {
+			reads++
+		}
+		return nil
+	}})
+
+	requestBody, _ := json.Marshal(randomCredential())
+	w := do(http.MethodPost, "/users/credentials", nil, requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var created models.Credential
+	json.Unmarshal(w.Body.Bytes(), &created)
+	path := "/users/credentials/" + created.Uid.String()
+
+	t.Run("test unchanged list returns 304 without reading credentials", func(t *testing.T) {
+		w := do(http.MethodGet, "/users/credentials", nil, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		etag := w.Header().Get("ETag")
+		assert.NotEmpty(t, etag)
+		assert.NotEmpty(t, w.Header().Get("Last-Modified"))
+
+		reads = 0
+		w = do(http.MethodGet, "/users/credentials", http.Header{"If-None-Match": {etag}}, nil)
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Empty(t, w.Body.String())
+		assert.Equal(t, 0, reads)
+	})
+
+	t.Run("test list etag depends on the query", func(t *testing.T) {
+		all := do(http.MethodGet, "/users/credentials", nil, nil).Header().Get("ETag")
+		w := do(http.MethodGet, "/users/credentials?view=summary", http.Header{"If-None-Match": {all}}, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("test changed list returns 200", func(t *testing.T) {
+		etag := do(http.MethodGet, "/users/credentials", nil, nil).Header().Get("ETag")
+
+		w := do(http.MethodPut, path+"/username", nil, []byte(`{"Username":"coffee"}`))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodGet, "/users/credentials", http.Header{"If-None-Match": {etag}}, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+		since := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+		w = do(http.MethodGet, "/users/credentials", http.Header{"If-Modified-Since": {since}}, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("test password change in the same second changes the list etag", func(t *testing.T) {
+		etag := do(http.MethodGet, "/users/credentials", nil, nil).Header().Get("ETag")
+
+		w := do(http.MethodPut, path+"/password", nil, []byte(`{"Password":"coffee"}`))
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = do(http.MethodPut, path+"/password", nil, []byte(`{"Password":"tea"}`))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodGet, "/users/credentials", http.Header{"If-None-Match": {etag}}, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("test failed manifest update drops the manifest", func(t *testing.T) {
+		etag := do(http.MethodGet, "/users/credentials", nil, nil).Header().Get("ETag")
+
+		faults.put = errors.New("slow down")
+		w := do(http.MethodPut, path+"/username", nil, []byte(`{"Username":"tea"}`))
+		assert.Equal(t, http.StatusOK, w.Code)
+		faults.put = nil
+
+		w = do(http.MethodGet, "/users/credentials", http.Header{"If-None-Match": {etag}}, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("test manifest that cannot be dropped fails the write", func(t *testing.T) {
+		faults.put, faults.del = errors.New("slow down"), errors.New("slow down")
+		defer func() { faults.put, faults.del = nil, nil }()
+
+		w := do(http.MethodPut, path+"/username", nil, []byte(`{"Username":"coffee"}`))
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+
+	t.Run("test single credential with if-none-match", func(t *testing.T) {
+		w := do(http.MethodGet, path, nil, nil)
+		etag := w.Header().Get("ETag")
+
+		w = do(http.MethodGet, path, http.Header{"If-None-Match": {etag}}, nil)
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Empty(t, w.Body.String())
+
+		w = do(http.MethodGet, path, http.Header{"If-None-Match": {`"stale"`}}, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("test single credential with if-modified-since", func(t *testing.T) {
+		reads = 0
+		since := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+		w := do(http.MethodGet, path, http.Header{"If-Modified-Since": {since}}, nil)
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Equal(t, 0, reads)
+
+		since = time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+		w = do(http.MethodGet, path, http.Header{"If-Modified-Since": {since}}, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestCredentialHistory(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	do := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		return w
+	}
+
+	credential := randomCredential()
+	err := credsApi.store.Create(context.Background(), userIdFromClaims, credential)
+	assert.NoError(t, err)
+	path := "/users/credentials/" + credential.Uid.String()
+
+	t.Run("test updates are recorded", func(t *testing.T) {
+		for _, password := range []string{"one", "two"} {
+			w := do(http.MethodPut, path+"/password", []byte(`{"Password":"`+password+`"}`))
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+
+		w := do(http.MethodGet, path+"/history", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var hist history.History
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &hist))
+		assert.Len(t, hist.Versions, 2)
+		assert.Equal(t, credential.Password, hist.Versions[0].Credential.Password)
+		assert.Equal(t, "one", hist.Versions[1].Credential.Password)
+	})
+
+	t.Run("test restore", func(t *testing.T) {
+		w := do(http.MethodPost, path+"/history/1/restore", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		stored, err := credsApi.store.Get(context.Background(), userIdFromClaims, credential.Uid)
 		assert.NoError(t, err)
+		assert.Equal(t, credential.Password, stored.Password)
+
+		// The replaced version is kept, so the restore can be undone.
+		hist, err := credsApi.history.Get(context.Background(), userIdFromClaims, credential.Uid)
+		assert.NoError(t, err)
+		assert.Len(t, hist.Versions, 3)
+		assert.Equal(t, "two", hist.Versions[2].Credential.Password)
 	})
 
+	t.Run("test versions beyond the cap are dropped", func(t *testing.T) {
+		w := do(http.MethodPut, path+"/password", []byte(`{"Password":"three"}`))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodPost, path+"/history/1/restore", nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("test invalid version", func(t *testing.T) {
+		w := do(http.MethodPost, path+"/history/latest/restore", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("test history of unknown credential", func(t *testing.T) {
+		w := do(http.MethodGet, "/users/credentials/"+uuid.Must(uuid.NewV4()).String()+"/history", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("test purge drops history", func(t *testing.T) {
+		w := do(http.MethodDelete, path, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		hist, err := credsApi.history.Get(context.Background(), userIdFromClaims, credential.Uid)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, hist.Versions)
+
+		w = do(http.MethodDelete, "/users/trash/"+credential.Uid.String(), nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		hist, err = credsApi.history.Get(context.Background(), userIdFromClaims, credential.Uid)
+		assert.NoError(t, err)
+		assert.Empty(t, hist.Versions)
+	})
+}
+
+func TestTrash(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		return w
+	}
+
+	trashed := func(query string) []trash.Item {
+		w := do(http.MethodGet, "/users/trash"+query)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var items []trash.Item
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+		return items
+	}
+
+	credential := randomCredential()
+	err := credsApi.store.Create(context.Background(), userIdFromClaims, credential)
+	assert.NoError(t, err)
+
+	t.Run("test delete moves the credential to the trash", func(t *testing.T) {
+		assert.Empty(t, trashed(""))
+
+		w := do(http.MethodDelete, "/users/credentials/"+credential.Uid.String())
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		_, err := credsApi.store.Get(context.Background(), userIdFromClaims, credential.Uid)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		items := trashed("")
+		assert.Len(t, items, 1)
+		assert.Equal(t, credential.Uid, items[0].Credential.Uid)
+		assert.Empty(t, items[0].Credential.Password)
+
+		items = trashed("?view=full")
+		assert.Len(t, items, 1)
+		assert.Equal(t, credential.Password, items[0].Credential.Password)
+
+		items = trashed("?fields=service,password")
+		assert.Len(t, items, 1)
+		assert.Equal(t, credential.Password, items[0].Credential.Password)
+		assert.Empty(t, items[0].Credential.Username)
+	})
+
+	t.Run("test delete unknown credential", func(t *testing.T) {
+		w := do(http.MethodDelete, "/users/credentials/"+uuid.Must(uuid.NewV4()).String())
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("test restore", func(t *testing.T) {
+		w := do(http.MethodPost, "/users/trash/"+credential.Uid.String()+"/restore")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		stored, err := credsApi.store.Get(context.Background(), userIdFromClaims, credential.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, credential.Password, stored.Password)
+		assert.Empty(t, trashed(""))
+
+		w = do(http.MethodPost, "/users/trash/"+credential.Uid.String()+"/restore")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("test purge", func(t *testing.T) {
+		w := do(http.MethodDelete, "/users/credentials/"+credential.Uid.String())
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodDelete, "/users/trash/"+credential.Uid.String())
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, trashed(""))
+
+		w = do(http.MethodDelete, "/users/trash/"+credential.Uid.String())
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestVaultMode(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		r := httptest.NewRequest(method, path, bytes.NewReader(b))
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		return w
+	}
+
+	blob := map[string]interface{}{
+		"blob": models.Blob{KeyId: "device-1", SchemaVersion: 1, Data: []byte(gofakeit.Sentence(8))},
+	}
+
+	t.Run("test default mode is standard", func(t *testing.T) {
+		w := do(http.MethodGet, "/users/settings", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"mode":"standard"}`, w.Body.String())
+	})
+
+	t.Run("test invalid mode", func(t *testing.T) {
+		w := do(http.MethodPut, "/users/settings", map[string]string{"mode": "secret"})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("test switch to vault mode", func(t *testing.T) {
+		w := do(http.MethodPut, "/users/settings", map[string]string{"mode": "vault"})
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	var uid string
+	t.Run("test create blob credential", func(t *testing.T) {
+		w := do(http.MethodPost, "/users/credentials", blob)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var created models.Credential
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+		assert.NotNil(t, created.Blob)
+		assert.Empty(t, created.Password)
+		uid = created.Uid.String()
+	})
+
+	t.Run("test plaintext fields are rejected", func(t *testing.T) {
+		w := do(http.MethodPost, "/users/credentials", randomCredential())
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		body := map[string]interface{}{"blob": blob["blob"], "password": gofakeit.JobLevel()}
+		w = do(http.MethodPost, "/users/credentials", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("test invalid blob", func(t *testing.T) {
+		w := do(http.MethodPost, "/users/credentials", map[string]interface{}{"blob": models.Blob{KeyId: "device-1", SchemaVersion: 1}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = do(http.MethodPost, "/users/credentials", map[string]interface{}{})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("test field updates conflict", func(t *testing.T) {
+		w := do(http.MethodPut, "/users/credentials/"+uid+"/password", map[string]string{"password": gofakeit.JobLevel()})
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("test replace blob credential", func(t *testing.T) {
+		replacement := map[string]interface{}{
+			"blob": models.Blob{KeyId: "device-2", SchemaVersion: 2, Data: []byte(gofakeit.Sentence(8))},
+		}
+		w := do(http.MethodPut, "/users/credentials/"+uid, replacement)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		stored, err := credsApi.store.Get(context.Background(), userIdFromClaims, uuid.FromStringOrNil(uid))
+		assert.NoError(t, err)
+		assert.Equal(t, "device-2", stored.Blob.KeyId)
+		assert.Equal(t, 2, stored.Blob.SchemaVersion)
+	})
+
+	t.Run("test mode cannot change with credentials", func(t *testing.T) {
+		w := do(http.MethodPut, "/users/settings", map[string]string{"mode": "standard"})
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = do(http.MethodDelete, "/users/credentials/"+uid, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodPut, "/users/settings", map[string]string{"mode": "standard"})
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = do(http.MethodDelete, "/users/trash/"+uid, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodPut, "/users/settings", map[string]string{"mode": "standard"})
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestSearchCredentials(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	do := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		return w
+	}
+
+	credential := randomCredential()
+	credential.Service = "GitHub"
+	credential.Metadata = map[string]string{"url": "https://github.com"}
+	assert.NoError(t, credsApi.store.Create(context.Background(), userIdFromClaims, credential))
+	assert.NoError(t, credsApi.store.Create(context.Background(), userIdFromClaims, randomCredential()))
+
+	t.Run("test search matches normalized values", func(t *testing.T) {
+		w := do("/users/search?service=github&url=www.github.com")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var found []models.Credential
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+		assert.Len(t, found, 1)
+		assert.Equal(t, credential.Uid, found[0].Uid)
+	})
+
+	t.Run("test search only matches whole values", func(t *testing.T) {
+		w := do("/users/search?service=git")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	})
+
+	t.Run("test search without terms", func(t *testing.T) {
+		w := do("/users/search")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestPatchCredential(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	credential := randomCredential()
+	credential.Metadata = map[string]string{"branch": "main"}
+	assert.NoError(t, credsApi.store.Create(context.Background(), userIdFromClaims, credential))
+	path := "/users/credentials/" + credential.Uid.String()
+
+	do := func(contentType, body string) (*httptest.ResponseRecorder, models.Credential) {
+		r := httptest.NewRequest(http.MethodPatch, path, bytes.NewReader([]byte(body)))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		var c models.Credential
+		json.Unmarshal(w.Body.Bytes(), &c)
+		return w, c
+	}
+
+	t.Run("test merge patch", func(t *testing.T) {
+		w, c := do("application/merge-patch+json", `{"description":"work laptop","metadata":{"branch":null,"floor":"3"}}`)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "work laptop", c.Description)
+		assert.Equal(t, map[string]string{"floor": "3"}, c.Metadata)
+		assert.Equal(t, credential.Password, c.Password)
+		assert.Equal(t, credential.Uid, c.Uid)
+	})
+
+	t.Run("test json patch", func(t *testing.T) {
+		body := `[{"op":"test","path":"/Description","value":"work laptop"},{"op":"replace","path":"/password","value":"coffee"},{"op":"add","path":"/tags","value":["work"]}]`
+		w, c := do("application/json-patch+json", body)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "coffee", c.Password)
+		assert.Equal(t, []string{"work"}, c.Tags)
+
+		w, _ = do("application/json-patch+json", `[{"op":"test","path":"/password","value":"tea"}]`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("test patches are validated", func(t *testing.T) {
+		for _, body := range []string{`{"password":null}`, `{"pasword":"coffee"}`, `{"service":1}`, `[]`, `{"Service":"a","service":"b"}`} {
+			w, _ := do("", body)
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+
+		stored, err := credsApi.store.Get(context.Background(), userIdFromClaims, credential.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, "coffee", stored.Password)
+	})
+
+	t.Run("test uid cannot change", func(t *testing.T) {
+		w, c := do("", `{"Uid":"`+uuid.Must(uuid.NewV4()).String()+`"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, credential.Uid, c.Uid)
+	})
+
+	t.Run("test unsupported patch type", func(t *testing.T) {
+		w, _ := do("text/plain", `{}`)
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	})
+
+	t.Run("test patches are recorded in history", func(t *testing.T) {
+		h, err := credsApi.history.Get(context.Background(), userIdFromClaims, credential.Uid)
+		assert.NoError(t, err)
+		assert.Len(t, h.Versions, 3)
+	})
+}
+
+func TestBatch(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+	handler := RouteBatch(app.Router)
+
+	batch := func(body interface{}) (*httptest.ResponseRecorder, batchResponse) {
+		b, _ := json.Marshal(body)
+		r := httptest.NewRequest(http.MethodPost, "/users/credentials:batch", bytes.NewReader(b))
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+		var resp batchResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp
+	}
+
+	count := func() int {
+		credentials, err := credsApi.store.List(context.Background(), userIdFromClaims)
+		assert.NoError(t, err)
+		return len(credentials)
+	}
+
+	existing := randomCredential()
+	assert.NoError(t, credsApi.store.Create(context.Background(), userIdFromClaims, existing))
+
+	t.Run("test mixed batch", func(t *testing.T) {
+		var ops []map[string]interface{}
+		for i := 0; i < 20; i++ {
+			ops = append(ops, map[string]interface{}{"op": "create", "credential": randomCredential()})
+		}
+		replacement := randomCredential()
+		ops = append(ops,
+			map[string]interface{}{"op": "update", "uid": existing.Uid, "ifMatch": existing.ETag(), "credential": replacement},
+			map[string]interface{}{"op": "delete", "uid": uuid.Must(uuid.NewV4())},
+			map[string]interface{}{"op": "create", "credential": map[string]string{"service": "missing password"}},
+		)
+
+		w, resp := batch(map[string]interface{}{"operations": ops})
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Len(t, resp.Results, 23)
+		for i := 0; i < 21; i++ {
+			assert.Equal(t, http.StatusOK, resp.Results[i].Status, resp.Results[i].Error)
+			assert.NotEmpty(t, resp.Results[i].ETag)
+		}
+		assert.Equal(t, http.StatusBadRequest, resp.Results[21].Status)
+		assert.Equal(t, http.StatusBadRequest, resp.Results[22].Status)
+		assert.Equal(t, 21, count())
+
+		stored, err := credsApi.store.Get(context.Background(), userIdFromClaims, existing.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, replacement.Password, stored.Password)
+
+		m, err := credsApi.manifest.Get(context.Background(), userIdFromClaims)
+		assert.NoError(t, err)
+		assert.Len(t, m.Credentials, 21)
+	})
+
+	t.Run("test atomic batch checks every operation first", func(t *testing.T) {
+		w, resp := batch(map[string]interface{}{"atomic": true, "operations": []map[string]interface{}{
+			{"op": "create", "credential": randomCredential()},
+			{"op": "delete", "uid": existing.Uid, "ifMatch": `"stale"`},
+		}})
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.True(t, resp.RolledBack)
+		assert.Equal(t, http.StatusFailedDependency, resp.Results[0].Status)
+		assert.Equal(t, http.StatusPreconditionFailed, resp.Results[1].Status)
+		assert.Equal(t, 21, count())
+	})
+
+	t.Run("test atomic batch rolls back", func(t *testing.T) {
+		// Fail the create once the checks have passed, so the delete that
+		// already ran has to be undone.
+		store := credsApi.store.(*memory.Store)
+		var creates int32
+		store.SetFaults(memory.Faults{Err: func(op string) error {
+			if op == "Create" && atomic.AddInt32(&creates, 1) == 1 {
+				return errors.New("create failed")
+			}
+			return nil
+		}})
+		defer store.SetFaults(memory.Faults{})
+
+		w, resp := batch(map[string]interface{}{"atomic": true, "operations": []map[string]interface{}{
+			{"op": "delete", "uid": existing.Uid},
+			{"op": "create", "credential": randomCredential()},
+		}})
+		store.SetFaults(memory.Faults{})
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.True(t, resp.RolledBack)
+		assert.Equal(t, 21, count())
+
+		_, err := credsApi.store.Get(context.Background(), userIdFromClaims, existing.Uid)
+		assert.NoError(t, err)
+		items, err := credsApi.trash.List(context.Background(), userIdFromClaims)
+		assert.NoError(t, err)
+		assert.Empty(t, items)
+	})
+
+	t.Run("test atomic batch rolls back history", func(t *testing.T) {
+		// Fail the create so the update is undone, or the update itself
+		// once its history has been recorded.
+		store := credsApi.store.(*memory.Store)
+		for _, failing := range []string{"Create", "Update"} {
+			before, err := credsApi.history.Get(context.Background(), userIdFromClaims, existing.Uid)
+			assert.NoError(t, err)
+			stored, err := credsApi.store.Get(context.Background(), userIdFromClaims, existing.Uid)
+			assert.NoError(t, err)
+
+			store.SetFaults(memory.Faults{Err: func(op string) error {
+				if op == failing {
+					return errors.New("write failed")
+				}
+				return nil
+			}})
+			w, resp := batch(map[string]interface{}{"atomic": true, "operations": []map[string]interface{}{
+				{"op": "update", "uid": existing.Uid, "credential": randomCredential()},
+				{"op": "create", "credential": randomCredential()},
+			}})
+			store.SetFaults(memory.Faults{})
+			assert.Equal(t, http.StatusConflict, w.Code, failing)
+			assert.True(t, resp.RolledBack, failing)
+
+			after, err := credsApi.history.Get(context.Background(), userIdFromClaims, existing.Uid)
+			assert.NoError(t, err)
+			assert.Len(t, after.Versions, len(before.Versions), failing)
+			for i := range after.Versions {
+				assert.Equal(t, before.Versions[i].Version, after.Versions[i].Version, failing)
+				assert.Equal(t, before.Versions[i].Credential.Password, after.Versions[i].Credential.Password, failing)
+			}
+			restored, err := credsApi.store.Get(context.Background(), userIdFromClaims, existing.Uid)
+			assert.NoError(t, err)
+			assert.Equal(t, stored.Password, restored.Password, failing)
+		}
+	})
+
+	t.Run("test invalid batches", func(t *testing.T) {
+		for _, body := range []interface{}{
+			map[string]interface{}{},
+			map[string]interface{}{"operations": []map[string]interface{}{{"op": "rename"}}},
+			map[string]interface{}{"operations": []map[string]interface{}{{"op": "delete"}}},
+			map[string]interface{}{"operations": []map[string]interface{}{{"op": "delete", "uid": existing.Uid}, {"op": "delete", "uid": existing.Uid}}},
+		} {
+			w, _ := batch(body)
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+	})
+}
+
+// cutShortStore fails the batch's create once its update has been written,
+// and cancels the request's context as it does, like a request that ran out
+// of time. Writes check the context the way remote stores do.
+type cutShortStore struct {
+	storage.CredentialStore
+	cancel  context.CancelFunc
+	updated chan struct{}
+}
+
+func (s *cutShortStore) Create(ctx context.Context, userId string, credential models.Credential) error {
+	<-s.updated
+	s.cancel()
+	return context.Canceled
+}
+
+func (s *cutShortStore) Update(ctx context.Context, userId string, credential models.Credential) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := s.CredentialStore.Update(ctx, userId, credential); err != nil {
+		return err
+	}
+
+	select {
+	case <-s.updated:
+	default:
+		close(s.updated)
+	}
+	return nil
+}
+
+func TestBatchRollbackAfterTimeout(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	credsApi := newTestCredentials()
+	existing := randomCredential()
+	assert.NoError(t, credsApi.store.Create(context.Background(), userIdFromClaims, existing))
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "userId", userIdFromClaims))
+	defer cancel()
+	credsApi.store = &cutShortStore{CredentialStore: credsApi.store, cancel: cancel, updated: make(chan struct{})}
+	credsApi.uncached = credsApi.store
+	app := intake.New(log)
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	replacement := randomCredential()
+	b, _ := json.Marshal(map[string]interface{}{"atomic": true, "operations": []map[string]interface{}{
+		{"op": "update", "uid": existing.Uid, "credential": replacement},
+		{"op": "create", "credential": randomCredential()},
+	}})
+	r := httptest.NewRequest(http.MethodPost, "/users/credentials:batch", bytes.NewReader(b))
+	w := httptest.NewRecorder()
+	RouteBatch(app.Router).ServeHTTP(w, r.WithContext(ctx))
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	var resp batchResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.RolledBack)
+	if assert.Len(t, resp.Results, 2) {
+		assert.Equal(t, http.StatusFailedDependency, resp.Results[0].Status, resp.Results[0].Error)
+	}
+
+	// The update was undone even though the request's context was done.
+	got, err := credsApi.store.Get(context.Background(), userIdFromClaims, existing.Uid)
+	assert.NoError(t, err)
+	assert.Equal(t, existing.Username, got.Username)
+}
+
+func TestImportCredentials(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	export := "name,url,username,password\n" +
+		"GitHub,https://github.com,octocat,secret\n" +
+		"Example,https://example.com,alice,\n"
+
+	upload := func(path, body string) (*httptest.ResponseRecorder, importer.Report) {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		var report importer.Report
+		json.Unmarshal(w.Body.Bytes(), &report)
+		return w, report
+	}
+
+	t.Run("test dry run", func(t *testing.T) {
+		w, report := upload("/users/import?dryRun=true", export)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.True(t, report.DryRun)
+		assert.Equal(t, 1, report.Created)
+		assert.Equal(t, 1, report.Invalid)
+
+		credentials, err := credsApi.store.List(context.Background(), userIdFromClaims)
+		assert.NoError(t, err)
+		assert.Empty(t, credentials)
+	})
+
+	t.Run("test import", func(t *testing.T) {
+		w, report := upload("/users/import?format=chrome", export)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, 1, report.Created)
+		assert.Equal(t, importer.StatusInvalid, report.Results[1].Status)
+
+		m, err := credsApi.manifest.Get(context.Background(), userIdFromClaims)
+		assert.NoError(t, err)
+		assert.Len(t, m.Credentials, 1)
+	})
+
+	t.Run("test duplicates are skipped", func(t *testing.T) {
+		w, report := upload("/users/import", export)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, 0, report.Created)
+		assert.Equal(t, 1, report.Duplicates)
+	})
+
+	t.Run("test invalid imports", func(t *testing.T) {
+		w, _ := upload("/users/import?format=keepass", export)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, _ = upload("/users/import?dryRun=maybe", export)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, _ = upload("/users/import", "name,url\n")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestExportCredentials(t *testing.T) {
+	userIdFromClaims := gofakeit.Username()
+	app := intake.New(log)
+	credsApi := newTestCredentials()
+	app.AddEndpoints(GetCredentialEndpoints(credsApi, FakeAuth))
+
+	credential := models.Credential{
+		Uid:      uuid.Must(uuid.NewV4()),
+		Service:  "GitHub",
+		Username: "octocat",
+		Password: "secret",
+		Metadata: map[string]string{"folder": "Work", "secret:pin": "1234"},
+	}
+	assert.NoError(t, credsApi.store.Create(context.Background(), userIdFromClaims, credential))
+
+	request := func(method, path, userId string, body []byte, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		for key := range header {
+			r.Header.Set(key, header.Get(key))
+		}
+		ctx := context.WithValue(r.Context(), "userId", userId)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, r.WithContext(ctx))
+		return w
+	}
+
+	t.Run("test password required", func(t *testing.T) {
+		w := request(http.MethodGet, "/users/export?format=kdbx", userIdFromClaims, nil, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = request(http.MethodGet, "/users/export?format=pdf", userIdFromClaims, nil, http.Header{"X-Export-Password": {"s3cret"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("test export and import", func(t *testing.T) {
+		w := request(http.MethodGet, "/users/export?format=kdbx", userIdFromClaims, nil, http.Header{"X-Export-Password": {"s3cret"}})
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, `attachment; filename="jackstand.kdbx"`, w.Header().Get("Content-Disposition"))
+		export := w.Body.Bytes()
+
+		db, err := kdbx.Read(export, "s3cret")
+		assert.NoError(t, err)
+		assert.Equal(t, "Work", db.Root.Groups[0].Name)
+		assert.Equal(t, "1234", db.Root.Groups[0].Entries[0].Get("pin"))
+
+		other := gofakeit.Username()
+		w = request(http.MethodPost, "/users/import", other, export, http.Header{"X-Import-Password": {"wrong"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = request(http.MethodPost, "/users/import", other, export, http.Header{"X-Import-Password": {"s3cret"}})
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		credentials, err := credsApi.store.List(context.Background(), other)
+		assert.NoError(t, err)
+		if assert.Len(t, credentials, 1) {
+			assert.Equal(t, "octocat", credentials[0].Username)
+			assert.Equal(t, credential.Metadata, credentials[0].Metadata)
+		}
+	})
+	t.Run("test archive restores", func(t *testing.T) {
+		w := request(http.MethodGet, "/users/export", userIdFromClaims, nil, http.Header{"X-Export-Password": {"s3cret"}})
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, `attachment; filename="jackstand.jsarchive"`, w.Header().Get("Content-Disposition"))
+		export := w.Body.Bytes()
+
+		doc, err := archive.Read(bytes.NewReader(export), "s3cret")
+		assert.NoError(t, err)
+		assert.Equal(t, archive.Version, doc.Version)
+		assert.Len(t, doc.Credentials, 1)
+
+		// Restoring into the same account skips what it still has.
+		w = request(http.MethodPost, "/users/import?format=archive", userIdFromClaims, export, http.Header{"X-Import-Password": {"s3cret"}})
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var report importer.Report
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		assert.Equal(t, 1, report.Duplicates)
+
+		other := gofakeit.Username()
+		w = request(http.MethodPost, "/users/import", other, export, http.Header{"X-Import-Password": {"s3cret"}})
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		credentials, err := credsApi.store.List(context.Background(), other)
+		assert.NoError(t, err)
+		if assert.Len(t, credentials, 1) {
+			assert.Equal(t, "secret", credentials[0].Password)
+			assert.Equal(t, credential.Metadata, credentials[0].Metadata)
+		}
+	})
+	t.Run("test plaintext exports need a fresh sign-in", func(t *testing.T) {
+		export := func(format string, issuedAt time.Time) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/users/export?format="+format, nil)
+			ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+			if !issuedAt.IsZero() {
+				ctx = context.WithValue(ctx, "issuedAt", issuedAt)
+			}
+			w := httptest.NewRecorder()
+			app.Router.ServeHTTP(w, r.WithContext(ctx))
+			return w
+		}
+
+		w := export("csv", time.Time{})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = export("csv", time.Now().Add(-10*time.Minute))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w = export("csv", time.Now().Add(-time.Minute))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+		rows, err := csv.NewReader(w.Body).ReadAll()
+		assert.NoError(t, err)
+		if assert.Len(t, rows, 2) {
+			assert.Equal(t, []string{"uid", "service", "url", "username", "password", "totp", "description", "tags", "folder", "createdAt", "updatedAt"}, rows[0])
+			assert.Equal(t, []string{credential.Uid.String(), "GitHub", "", "octocat", "secret", "", "", "", "Work"}, rows[1][:9])
+		}
+
+		w = export("json", time.Now())
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var doc archive.Document
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+		assert.Equal(t, archive.Version, doc.Version)
+		if assert.Len(t, doc.Credentials, 1) {
+			assert.Equal(t, "1234", doc.Credentials[0].Metadata["secret:pin"])
+		}
+	})
+
+	t.Run("test exports are audited", func(t *testing.T) {
+		w := request(http.MethodGet, "/users/audit", userIdFromClaims, nil, nil)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var events []audit.Event
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &events))
+
+		// Only the exports that were made are recorded.
+		var formats []string
+		for _, e := range events {
+			assert.Equal(t, audit.ActionExport, e.Action)
+			assert.Equal(t, 1, e.Credentials)
+			formats = append(formats, e.Format)
+		}
+		assert.ElementsMatch(t, []string{"kdbx", "archive", "csv", "json"}, formats)
+	})
+
+	t.Run("test failed reads are not sent as exports", func(t *testing.T) {
+		store := credsApi.store.(*memory.Store)
+		defer store.SetFaults(memory.Faults{})
+		failing := func(failing string) {
+			store.SetFaults(memory.Faults{Err: func(op string) error {
+				if op == failing {
+					return errors.New("read failed")
+				}
+				return nil
+			}})
+		}
+
+		// Settings and the manifest are read before the response starts.
+		failing("GetMetadata")
+		for _, format := range []string{"archive", "kdbx", "csv", "json"} {
+			r := httptest.NewRequest(http.MethodGet, "/users/export?format="+format, nil)
+			r.Header.Set("X-Export-Password", "s3cret")
+			ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+			ctx = context.WithValue(ctx, "issuedAt", time.Now())
+			w := httptest.NewRecorder()
+			app.Router.ServeHTTP(w, r.WithContext(ctx))
+			assert.Equal(t, http.StatusInternalServerError, w.Code, format)
+			assert.Empty(t, w.Header().Get("Content-Disposition"), format)
+		}
+
+		// So are the credentials of a KeePass database.
+		failing("Get")
+		w := request(http.MethodGet, "/users/export?format=kdbx", userIdFromClaims, nil, http.Header{"X-Export-Password": {"s3cret"}})
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Empty(t, w.Header().Get("Content-Disposition"))
+
+		// The other formats are streamed, and cut off when a credential
+		// cannot be read.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "userId", userIdFromClaims)
+			ctx = context.WithValue(ctx, "issuedAt", time.Now())
+			app.Router.ServeHTTP(w, r.WithContext(ctx))
+		}))
+		defer server.Close()
+
+		for _, format := range []string{"archive", "csv", "json"} {
+			r, err := http.NewRequest(http.MethodGet, server.URL+"/users/export?format="+format, nil)
+			assert.NoError(t, err)
+			r.Header.Set("X-Export-Password", "s3cret")
+			resp, err := server.Client().Do(r)
+			if err == nil {
+				_, err = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			assert.Error(t, err, format)
+		}
+	})
+}
+
+func TestMigrateUser(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	source, destination := memory.NewStore(), memory.NewStore()
+
+	hist := history.New(source, 3)
+	bin := trash.New(log, source, hist)
+	kept, trashed := randomCredential(), randomCredential()
+	assert.NoError(t, source.Create(ctx, userId, kept))
+	assert.NoError(t, hist.Record(ctx, userId, kept))
+	assert.NoError(t, bin.Put(ctx, userId, trashed))
+	assert.NoError(t, settings.Put(ctx, source, userId, settings.Settings{Mode: settings.ModeVault}))
+	_, err := audit.New(source).Record(ctx, userId, audit.Event{Action: "export", Credentials: 1})
+	assert.NoError(t, err)
+	_, _, err = manifest.New(log, source).Rebuild(ctx, userId)
+	assert.NoError(t, err)
+
+	names, err := source.ListMetadata(ctx, userId, "")
+	assert.NoError(t, err)
+
+	credentials, documents, err := migrateUser(ctx, source, destination, userId)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, credentials)
+	assert.Equal(t, len(names), documents)
+
+	got, err := destination.Get(ctx, userId, kept.Uid)
+	assert.NoError(t, err)
+	assert.Equal(t, kept.Password, got.Password)
+
+	copied, err := destination.ListMetadata(ctx, userId, "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, names, copied)
+	for _, name := range names {
+		var want, have json.RawMessage
+		assert.NoError(t, source.GetMetadata(ctx, userId, name, &want))
+		assert.NoError(t, destination.GetMetadata(ctx, userId, name, &have))
+		assert.JSONEq(t, string(want), string(have), name)
+	}
+
+	s, err := settings.Get(ctx, destination, userId)
+	assert.NoError(t, err)
+	assert.Equal(t, settings.ModeVault, s.Mode)
+
+	items, err := trash.New(log, destination, history.New(destination, 3)).List(ctx, userId)
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, trashed.Uid, items[0].Credential.Uid)
+
+	events, err := audit.New(destination).List(ctx, userId)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+
+	// Running it again replaces what was copied.
+	_, _, err = migrateUser(ctx, source, destination, userId)
+	assert.NoError(t, err)
+}
+
+func TestUserLocks(t *testing.T) {
+	locks := newUserLocks()
+	var wg sync.WaitGroup
+	var held int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.lock("user1")
+			assert.Equal(t, int32(1), atomic.AddInt32(&held, 1))
+			atomic.AddInt32(&held, -1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Users are only kept while their lock is held or waited for.
+	assert.Empty(t, locks.locks)
 }
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"flag"
+
+	"github.com/dbubel/jackstand-api/config"
+	"github.com/dbubel/jackstand-api/envelope"
+	"github.com/sirupsen/logrus"
+)
+
+type EncryptCommand struct {
+	Cfg config.Config
+	Log *logrus.Logger
+}
+
+func (c *EncryptCommand) Help() string {
+	return `Usage: jackstand encrypt [options]
+
+  Encrypts every credential and metadata document that was stored before
+  encryption was enabled, and converts those stored with the other kind of
+  ENCRYPTION. Servers read both while this runs, and what is already
+  encrypted is skipped, so an interrupted run can simply be run again.
+
+Options:
+
+  -encryption=full  What to encrypt: full encrypts whole credentials, fields
+                    only the password and secret: metadata values.
+                    Defaults to ENCRYPTION.
+  -storage=s3       Credential storage backend: s3, fs or bolt.
+                    Defaults to STORAGE.
+  -bucket=name      S3 bucket. Defaults to S3_BUCKET.
+  -endpoint=url     S3 endpoint, e.g. localstack. Defaults to S3_ENDPOINT.
+  -root=path        Root directory for the fs backend. Defaults to STORAGE_ROOT.
+  -db=path          Database file for the bolt backend. Defaults to BOLT_PATH.
+`
+}
+
+func (c *EncryptCommand) Synopsis() string {
+	return "Encrypts credentials stored in plaintext"
+}
+
+func (c *EncryptCommand) Run(args []string) int {
+	flags := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	flags.StringVar(&c.Cfg.Encryption, "encryption", c.Cfg.Encryption, "full or fields")
+	flags.StringVar(&c.Cfg.Storage, "storage", c.Cfg.Storage, "credential storage backend")
+	flags.StringVar(&c.Cfg.S3Bucket, "bucket", c.Cfg.S3Bucket, "s3 bucket")
+	flags.StringVar(&c.Cfg.S3Endpoint, "endpoint", c.Cfg.S3Endpoint, "s3 endpoint")
+	flags.StringVar(&c.Cfg.StorageRoot, "root", c.Cfg.StorageRoot, "root directory for the fs backend")
+	flags.StringVar(&c.Cfg.BoltPath, "db", c.Cfg.BoltPath, "database file for the bolt backend")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	store, closer, err := openStore(c.Cfg, c.Log, c.Cfg.Storage)
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	if err != nil {
+		c.Log.WithError(err).Error("error opening storage")
+		return 1
+	}
+
+	encrypter, ok := store.(*envelope.Store)
+	if !ok {
+		c.Log.Error("MASTER_KEY is not set")
+		return 1
+	}
+
+	ctx := context.Background()
+	users, err := store.Users(ctx)
+	if err != nil {
+		c.Log.WithError(err).Error("error listing users")
+		return 1
+	}
+
+	var encrypted, failed int
+	for i := range users {
+		n, err := encrypter.Encrypt(ctx, users[i])
+		encrypted += n
+		if err != nil {
+			failed++
+			c.Log.WithError(err).WithFields(logrus.Fields{"userId": users[i]}).Error("error encrypting user")
+			continue
+		}
+
+		c.Log.WithFields(logrus.Fields{
+			"userId":    users[i],
+			"encrypted": n,
+			"user":      i + 1,
+			"users":     len(users),
+		}).Info("encrypted user")
+	}
+
+	c.Log.WithFields(logrus.Fields{"users": len(users), "encrypted": encrypted, "failed": failed}).Info("encryption complete")
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -11,10 +11,24 @@ func GetCredentialEndpoints(c Credentials, auth intake.MiddleWare) intake.Endpoi
 		intake.NewEndpoint(http.MethodPost, "/users/credentials", c.createCredential, auth),
 		intake.NewEndpoint(http.MethodGet, "/users/credentials", c.getCredentials, auth),
 		intake.NewEndpoint(http.MethodGet, "/users/credentials/:credentialUid", c.getCredential, auth),
+		intake.NewEndpoint(http.MethodPut, "/users/credentials/:credentialUid", c.replaceCredential, auth),
+		intake.NewEndpoint(http.MethodPatch, "/users/credentials/:credentialUid", c.patchCredential, auth),
 		intake.NewEndpoint(http.MethodPut, "/users/credentials/:credentialUid/username", c.updateUsername, auth),
 		intake.NewEndpoint(http.MethodPut, "/users/credentials/:credentialUid/password", c.updatePassword, auth),
 		intake.NewEndpoint(http.MethodPut, "/users/credentials/:credentialUid/service", c.updateServiceName, auth),
 		intake.NewEndpoint(http.MethodDelete, "/users/credentials/:credentialUid", c.deleteCredential, auth),
+		intake.NewEndpoint(http.MethodGet, "/users/credentials/:credentialUid/history", c.getHistory, auth),
+		intake.NewEndpoint(http.MethodPost, "/users/credentials/:credentialUid/history/:version/restore", c.restoreVersion, auth),
+		intake.NewEndpoint(http.MethodPost, batchRoute, c.batchCredentials, auth),
+		intake.NewEndpoint(http.MethodPost, "/users/import", c.importCredentials, auth),
+		intake.NewEndpoint(http.MethodGet, "/users/export", c.exportCredentials, auth),
+		intake.NewEndpoint(http.MethodGet, "/users/audit", c.getAudit, auth),
+		intake.NewEndpoint(http.MethodGet, "/users/search", c.searchCredentials, auth),
+		intake.NewEndpoint(http.MethodGet, "/users/trash", c.getTrash, auth),
+		intake.NewEndpoint(http.MethodPost, "/users/trash/:credentialUid/restore", c.restoreTrash, auth),
+		intake.NewEndpoint(http.MethodDelete, "/users/trash/:credentialUid", c.purgeTrash, auth),
+		intake.NewEndpoint(http.MethodGet, "/users/settings", c.getSettings, auth),
+		intake.NewEndpoint(http.MethodPut, "/users/settings", c.updateSettings, auth),
 		intake.NewEndpoint(http.MethodGet, "/status", c.status),
 	}
 }
@@ -0,0 +1,438 @@
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dbubel/intake"
+	"github.com/dbubel/jackstand-api/archive"
+	"github.com/dbubel/jackstand-api/audit"
+	"github.com/dbubel/jackstand-api/config"
+	"github.com/dbubel/jackstand-api/kdbx"
+	"github.com/dbubel/jackstand-api/manifest"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/settings"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/dbubel/jackstand-api/subendpoints"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// Formats of exports.
+const (
+	exportArchive = "archive"
+	exportKeePass = "kdbx"
+	exportCSV     = "csv"
+	exportJSON    = "json"
+)
+
+const (
+	// exportPasswordHeader carries the password to encrypt an export with.
+	exportPasswordHeader = "X-Export-Password"
+
+	// exportName names exported files and KeePass databases.
+	exportName = "jackstand"
+)
+
+var errVaultExport = errors.New("credentials cannot be exported in vault mode")
+
+type exportFormat struct {
+	extension   string
+	contentType string
+	// plaintext exports are not encrypted with a password, so they need a
+	// recent sign-in instead.
+	plaintext bool
+}
+
+var exportFormats = map[string]exportFormat{
+	exportArchive: {extension: ".jsarchive", contentType: "application/octet-stream"},
+	exportKeePass: {extension: ".kdbx", contentType: "application/octet-stream"},
+	exportCSV:     {extension: ".csv", contentType: "text/csv; charset=utf-8", plaintext: true},
+	exportJSON:    {extension: ".json", contentType: "application/json", plaintext: true},
+}
+
+// exportCredentials responds with all of the user's credentials: an archive
+// by default or a KeePass database with format=kdbx, both encrypted with the
+// password in the X-Export-Password header, or in plaintext with format=csv
+// or format=json, which needs a token issued within exportMaxTokenAge.
+func (c *Credentials) exportCredentials(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = exportArchive
+		}
+
+		f, ok := exportFormats[format]
+		if !ok {
+			intake.RespondError(w, r, fmt.Errorf("unknown export format %q", format), http.StatusBadRequest)
+			return
+		}
+
+		if f.plaintext {
+			subendpoints.IssuedAtFromClaims(w, r, func(issuedAt time.Time) {
+				if time.Since(issuedAt) > c.exportMaxTokenAge {
+					intake.RespondError(w, r, fmt.Errorf("plaintext exports need a sign-in within the last %s", c.exportMaxTokenAge), http.StatusUnauthorized)
+					return
+				}
+				c.export(w, r, userId, format, "")
+			})
+			return
+		}
+
+		password := r.Header.Get(exportPasswordHeader)
+		if password == "" {
+			intake.RespondError(w, r, fmt.Errorf("the %s header is required", exportPasswordHeader), http.StatusBadRequest)
+			return
+		}
+		c.export(w, r, userId, format, password)
+	})
+}
+
+// export records the export in the user's audit trail and streams the
+// credentials of their manifest, reading one at a time. Everything that can
+// be checked is checked before the response starts; a credential that cannot
+// be read later on closes the connection, so the client sees a broken
+// download rather than an export that looks complete. KeePass databases are
+// encrypted as a whole, so their credentials are read before the response
+// starts.
+func (c *Credentials) export(w http.ResponseWriter, r *http.Request, userId, format, password string) {
+	m, err := exportManifest(r.Context(), c.store, c.manifest, userId)
+	if errors.Is(err, errVaultExport) {
+		intake.RespondError(w, r, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		intake.RespondError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Exports are only made once they are on record.
+	if _, err := c.audit.Record(r.Context(), userId, audit.Event{
+		Action:      audit.ActionExport,
+		Format:      format,
+		Credentials: len(m.Credentials),
+		RemoteAddr:  r.RemoteAddr,
+		UserAgent:   r.UserAgent(),
+	}); err != nil {
+		intake.RespondError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	var credentials []models.Credential
+	if format == exportKeePass {
+		if credentials, err = readExport(r.Context(), c.store, userId, m); err != nil {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	f := exportFormats[format]
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportName+f.extension))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	if format == exportKeePass {
+		err = kdbx.Write(w, kdbx.FromCredentials(exportName, credentials), password, kdbx.DefaultOptions)
+	} else {
+		err = writeExport(r.Context(), c.store, userId, m, w, format, password)
+	}
+
+	if err != nil {
+		c.log.WithError(err).WithFields(logrus.Fields{"userId": userId, "format": format}).Warn("error writing export")
+		abort(w)
+	}
+}
+
+// abort closes the connection of a response that failed after it started,
+// before the end of its body is sent.
+func abort(w http.ResponseWriter) {
+	if hj, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hj.Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+}
+
+// getAudit lists the user's audit trail, most recent first.
+func (c *Credentials) getAudit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		events, err := c.audit.List(r.Context(), userId)
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		intake.RespondJSON(w, r, http.StatusOK, events)
+	})
+}
+
+// exportManifest returns the manifest listing the credentials to export.
+func exportManifest(ctx context.Context, store storage.CredentialStore, index *manifest.Index, userId string) (manifest.Manifest, error) {
+	s, err := settings.Get(ctx, store, userId)
+	if err != nil {
+		return manifest.Manifest{}, err
+	}
+
+	// Vault credentials are encrypted by the client, which has to export
+	// them itself.
+	if s.Mode == settings.ModeVault {
+		return manifest.Manifest{}, errVaultExport
+	}
+	return index.Get(ctx, userId)
+}
+
+// eachExport calls fn with the credentials of the manifest, reading them one
+// at a time. Credentials deleted since the manifest was read are skipped.
+func eachExport(ctx context.Context, store storage.CredentialStore, userId string, m manifest.Manifest, fn func(models.Credential) error) error {
+	for i := range m.Credentials {
+		credential, err := store.Get(ctx, userId, m.Credentials[i].Uid)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(credential); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readExport returns the credentials of the manifest.
+func readExport(ctx context.Context, store storage.CredentialStore, userId string, m manifest.Manifest) ([]models.Credential, error) {
+	credentials := make([]models.Credential, 0, len(m.Credentials))
+	err := eachExport(ctx, store, userId, m, func(c models.Credential) error {
+		credentials = append(credentials, c)
+		return nil
+	})
+	return credentials, err
+}
+
+// writeExport reads the credentials of the manifest one at a time and writes
+// them to w in the format.
+func writeExport(ctx context.Context, store storage.CredentialStore, userId string, m manifest.Manifest, w io.Writer, format, password string) error {
+	e, err := newExportEncoder(w, format, password)
+	if err != nil {
+		return err
+	}
+
+	if err := eachExport(ctx, store, userId, m, e.Encode); err != nil {
+		return err
+	}
+	return e.Close()
+}
+
+// exportEncoder writes credentials in an export format.
+type exportEncoder interface {
+	Encode(c models.Credential) error
+	Close() error
+}
+
+func newExportEncoder(w io.Writer, format, password string) (exportEncoder, error) {
+	switch format {
+	case exportKeePass:
+		return &kdbxEncoder{w: w, password: password}, nil
+	case exportCSV:
+		return newCSVEncoder(w)
+	case exportJSON:
+		e, err := archive.NewEncoder(w)
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	default:
+		aw, err := archive.NewWriter(w, password, archive.DefaultParams)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := archive.NewEncoder(aw)
+		if err != nil {
+			return nil, err
+		}
+		return archiveEncoder{Encoder: e, w: aw}, nil
+	}
+}
+
+// archiveEncoder encodes a document into an encrypted archive.
+type archiveEncoder struct {
+	*archive.Encoder
+	w io.WriteCloser
+}
+
+func (e archiveEncoder) Close() error {
+	if err := e.Encoder.Close(); err != nil {
+		return err
+	}
+	return e.w.Close()
+}
+
+// kdbxEncoder collects the credentials of a KeePass database, which is
+// encrypted as a whole.
+type kdbxEncoder struct {
+	w           io.Writer
+	password    string
+	credentials []models.Credential
+}
+
+func (e *kdbxEncoder) Encode(c models.Credential) error {
+	e.credentials = append(e.credentials, c)
+	return nil
+}
+
+func (e *kdbxEncoder) Close() error {
+	return kdbx.Write(e.w, kdbx.FromCredentials(exportName, e.credentials), e.password, kdbx.DefaultOptions)
+}
+
+// csvColumns are the columns of CSV exports. Metadata other than the URL,
+// folder and one time password secret is only exported in JSON.
+var csvColumns = []string{"uid", "service", "url", "username", "password", "totp", "description", "tags", "folder", "createdAt", "updatedAt"}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func newCSVEncoder(w io.Writer) (*csvEncoder, error) {
+	e := &csvEncoder{w: csv.NewWriter(w)}
+	return e, e.w.Write(csvColumns)
+}
+
+func (e *csvEncoder) Encode(c models.Credential) error {
+	return e.w.Write([]string{
+		c.Uid.String(),
+		c.Service,
+		c.Metadata[storage.URLMetadataKey],
+		c.Username,
+		c.Password,
+		c.Metadata[models.SecretMetadataPrefix+"totp"],
+		c.Description,
+		strings.Join(c.Tags, ","),
+		c.Metadata[models.FolderMetadataKey],
+		time.Time(c.CreatedAt).UTC().Format(time.RFC3339),
+		time.Time(c.UpdatedAt).UTC().Format(time.RFC3339),
+	})
+}
+
+func (e *csvEncoder) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ExportCommand struct {
+	Cfg config.Config
+	Log *logrus.Logger
+}
+
+func (c *ExportCommand) Help() string {
+	return `Usage: jackstand export [options] -user=id -password-file=path file
+
+  Exports the credentials of a user to an encrypted archive or a KeePass
+  database, like GET /users/export.
+
+Options:
+
+  -user=id          User to export. Required.
+  -format=archive   Format of the file: archive or kdbx.
+  -password-file=path
+                    File holding the password to encrypt the file with.
+                    Required.
+  -storage=s3       Credential storage backend: s3, fs or bolt.
+                    Defaults to STORAGE.
+  -bucket=name      S3 bucket. Defaults to S3_BUCKET.
+  -endpoint=url     S3 endpoint, e.g. localstack. Defaults to S3_ENDPOINT.
+  -root=path        Root directory for the fs backend. Defaults to STORAGE_ROOT.
+  -db=path          Database file for the bolt backend. Defaults to BOLT_PATH.
+`
+}
+
+func (c *ExportCommand) Synopsis() string {
+	return "Exports credentials to an encrypted archive or KeePass database"
+}
+
+func (c *ExportCommand) Run(args []string) int {
+	var userId, format, passwordFile string
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.StringVar(&userId, "user", "", "user to export")
+	flags.StringVar(&format, "format", exportArchive, "format of the file")
+	flags.StringVar(&passwordFile, "password-file", "", "file holding the password to encrypt the file with")
+	flags.StringVar(&c.Cfg.Storage, "storage", c.Cfg.Storage, "credential storage backend")
+	flags.StringVar(&c.Cfg.S3Bucket, "bucket", c.Cfg.S3Bucket, "s3 bucket")
+	flags.StringVar(&c.Cfg.S3Endpoint, "endpoint", c.Cfg.S3Endpoint, "s3 endpoint")
+	flags.StringVar(&c.Cfg.StorageRoot, "root", c.Cfg.StorageRoot, "root directory for the fs backend")
+	flags.StringVar(&c.Cfg.BoltPath, "db", c.Cfg.BoltPath, "database file for the bolt backend")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	if userId == "" || passwordFile == "" || flags.NArg() != 1 {
+		c.Log.Error("a user, a password file and a file are required")
+		return 1
+	}
+
+	// Plaintext exports are only made through the API, after a recent sign-in.
+	if f, ok := exportFormats[format]; !ok || f.plaintext {
+		c.Log.WithFields(logrus.Fields{"format": format}).Error("unknown export format")
+		return 1
+	}
+
+	password, err := readPasswordFile(passwordFile)
+	if err != nil || password == "" {
+		c.Log.WithError(err).Error("error reading password file")
+		return 1
+	}
+
+	store, closer, err := openStore(c.Cfg, c.Log, c.Cfg.Storage)
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	if err != nil {
+		c.Log.WithError(err).Error("error opening storage")
+		return 1
+	}
+
+	ctx := context.Background()
+	m, err := exportManifest(ctx, store, manifest.New(c.Log, store), userId)
+	if err != nil {
+		c.Log.WithError(err).WithFields(logrus.Fields{"userId": userId}).Error("error reading credentials")
+		return 1
+	}
+
+	if _, err := audit.New(store).Record(ctx, userId, audit.Event{
+		Action:      audit.ActionExport,
+		Format:      format,
+		Credentials: len(m.Credentials),
+		UserAgent:   "jackstand export",
+	}); err != nil {
+		c.Log.WithError(err).WithFields(logrus.Fields{"userId": userId}).Error("error recording export")
+		return 1
+	}
+
+	f, err := os.OpenFile(flags.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		c.Log.WithError(err).Error("error creating file")
+		return 1
+	}
+
+	err = writeExport(ctx, store, userId, m, f, format, password)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		c.Log.WithError(err).Error("error writing file")
+		os.Remove(flags.Arg(0))
+		return 1
+	}
+
+	c.Log.WithFields(logrus.Fields{"userId": userId, "file": flags.Arg(0), "credentials": len(m.Credentials)}).Info("export complete")
+	return 0
+}
@@ -0,0 +1,262 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dbubel/intake"
+	"github.com/dbubel/jackstand-api/config"
+	"github.com/dbubel/jackstand-api/importer"
+	"github.com/dbubel/jackstand-api/manifest"
+	"github.com/dbubel/jackstand-api/settings"
+	"github.com/dbubel/jackstand-api/subendpoints"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// maxImportSize bounds the size of an uploaded export.
+const maxImportSize = 10 << 20
+
+// rebuildTimeout bounds rebuilding the manifest after an import, which runs
+// even when the import used up the request's time.
+const rebuildTimeout = 10 * time.Second
+
+// importPasswordHeader carries the password of an imported KeePass database
+// or archive.
+const importPasswordHeader = "X-Import-Password"
+
+// importCredentials creates credentials from the export of a browser or
+// another password manager sent as the body. The format query parameter
+// names the format, otherwise it is detected. KeePass databases and archives
+// are opened with the password in the X-Import-Password header. With dryRun=true nothing
+// is created and the report shows what would be.
+func (c *Credentials) importCredentials(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		var dryRun bool
+		if v := r.URL.Query().Get("dryRun"); v != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(v); err != nil {
+				intake.RespondError(w, r, fmt.Errorf("invalid dryRun %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxImportSize+1))
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		if len(data) > maxImportSize {
+			intake.RespondError(w, r, fmt.Errorf("imports are at most %d bytes", maxImportSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		rows, err := importer.Parse(r.URL.Query().Get("format"), data, r.Header.Get(importPasswordHeader))
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		s, err := settings.Get(r.Context(), c.store, userId)
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		// Vault credentials are encrypted by the client, which has to import
+		// them itself.
+		if s.Mode == settings.ModeVault {
+			intake.RespondError(w, r, errors.New("credentials cannot be imported in vault mode"), http.StatusConflict)
+			return
+		}
+
+		unlock := c.locks.lock(userId)
+		defer unlock()
+
+		report, err := importer.Import(r.Context(), c.store, userId, rows, dryRun)
+		if err != nil {
+			intake.RespondError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		if report.Created > 0 && !dryRun {
+			// The request's context is done when the import was cut short,
+			// and the manifest has to catch up with what was created anyway.
+			ctx, cancel := context.WithTimeout(context.Background(), rebuildTimeout)
+			defer cancel()
+			if _, _, err := c.manifest.Rebuild(ctx, userId); err != nil {
+				c.log.WithError(err).WithFields(logrus.Fields{"userId": userId}).Warn("error rebuilding manifest")
+			}
+		}
+
+		// An import cut short still reports which rows were created.
+		status := http.StatusOK
+		if report.Cancelled > 0 {
+			status = http.StatusGatewayTimeout
+		}
+		intake.RespondJSON(w, r, status, report)
+	})
+}
+
+type ImportCommand struct {
+	Cfg config.Config
+	Log *logrus.Logger
+}
+
+func (c *ImportCommand) Help() string {
+	return `Usage: jackstand import [options] -user=id file
+
+  Imports the credentials in the export of a browser or another password
+  manager for a user, like POST /users/import. Rows that are invalid or
+  duplicate an existing credential are reported and skipped.
+
+Options:
+
+  -user=id          User to import for. Required.
+  -format=chrome    Format of the file: chrome, firefox, lastpass, bitwarden,
+                    1password, kdbx or archive. Detected from the file by
+                    default.
+  -password-file=path
+                    File holding the password of a KeePass database or an
+                    archive.
+  -dry-run          Report what would be imported without importing anything.
+  -storage=s3       Credential storage backend: s3, fs or bolt.
+                    Defaults to STORAGE.
+  -bucket=name      S3 bucket. Defaults to S3_BUCKET.
+  -endpoint=url     S3 endpoint, e.g. localstack. Defaults to S3_ENDPOINT.
+  -root=path        Root directory for the fs backend. Defaults to STORAGE_ROOT.
+  -db=path          Database file for the bolt backend. Defaults to BOLT_PATH.
+`
+}
+
+func (c *ImportCommand) Synopsis() string {
+	return "Imports credentials from browsers and password managers"
+}
+
+func (c *ImportCommand) Run(args []string) int {
+	var userId, format, passwordFile string
+	var dryRun bool
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.StringVar(&userId, "user", "", "user to import for")
+	flags.StringVar(&format, "format", "", "format of the file")
+	flags.StringVar(&passwordFile, "password-file", "", "file holding the password of a KeePass database or an archive")
+	flags.BoolVar(&dryRun, "dry-run", false, "report without importing")
+	flags.StringVar(&c.Cfg.Storage, "storage", c.Cfg.Storage, "credential storage backend")
+	flags.StringVar(&c.Cfg.S3Bucket, "bucket", c.Cfg.S3Bucket, "s3 bucket")
+	flags.StringVar(&c.Cfg.S3Endpoint, "endpoint", c.Cfg.S3Endpoint, "s3 endpoint")
+	flags.StringVar(&c.Cfg.StorageRoot, "root", c.Cfg.StorageRoot, "root directory for the fs backend")
+	flags.StringVar(&c.Cfg.BoltPath, "db", c.Cfg.BoltPath, "database file for the bolt backend")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	if userId == "" || flags.NArg() != 1 {
+		c.Log.Error("a user and a file are required")
+		return 1
+	}
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		c.Log.WithError(err).Error("error reading file")
+		return 1
+	}
+
+	password, err := readPasswordFile(passwordFile)
+	if err != nil {
+		c.Log.WithError(err).Error("error reading password file")
+		return 1
+	}
+
+	rows, err := importer.Parse(format, data, password)
+	if err != nil {
+		c.Log.WithError(err).Error("error parsing file")
+		return 1
+	}
+
+	store, closer, err := openStore(c.Cfg, c.Log, c.Cfg.Storage)
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	if err != nil {
+		c.Log.WithError(err).Error("error opening storage")
+		return 1
+	}
+
+	ctx := context.Background()
+	s, err := settings.Get(ctx, store, userId)
+	if err != nil {
+		c.Log.WithError(err).Error("error reading settings")
+		return 1
+	}
+
+	if s.Mode == settings.ModeVault {
+		c.Log.WithFields(logrus.Fields{"userId": userId}).Error("credentials cannot be imported in vault mode")
+		return 1
+	}
+
+	report, err := importer.Import(ctx, store, userId, rows, dryRun)
+	if err != nil {
+		c.Log.WithError(err).WithFields(logrus.Fields{"userId": userId}).Error("error importing credentials")
+		return 1
+	}
+
+	for _, result := range report.Results {
+		fields := logrus.Fields{"row": result.Row, "status": result.Status, "service": result.Service, "username": result.Username}
+		if result.Uid != nil {
+			fields["credentialUid"] = *result.Uid
+		}
+
+		if result.DuplicateOf != 0 {
+			fields["duplicateOf"] = result.DuplicateOf
+		}
+
+		if result.Error != "" {
+			fields["error"] = result.Error
+		}
+		c.Log.WithFields(fields).Info("imported row")
+	}
+
+	if report.Created > 0 && !dryRun {
+		if _, _, err := manifest.New(c.Log, store).Rebuild(ctx, userId); err != nil {
+			c.Log.WithError(err).WithFields(logrus.Fields{"userId": userId}).Warn("error rebuilding manifest")
+		}
+	}
+
+	c.Log.WithFields(logrus.Fields{
+		"userId":     userId,
+		"dryRun":     dryRun,
+		"created":    report.Created,
+		"duplicates": report.Duplicates,
+		"invalid":    report.Invalid,
+		"failed":     report.Failed,
+		"cancelled":  report.Cancelled,
+	}).Info("import complete")
+	if report.Failed > 0 || report.Cancelled > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readPasswordFile returns the password in the file, without the trailing
+// newline, or an empty password without a file.
+func readPasswordFile(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
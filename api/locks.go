@@ -0,0 +1,45 @@
+package api
+
+import "sync"
+
+// userLocks serialises read-modify-write cycles on a user's credentials
+// within the process so a precondition check and the write it guards cannot
+// interleave with another request.
+type userLocks struct {
+	mu    sync.Mutex
+	locks map[string]*userLock
+}
+
+// userLock is a user's lock and the number of requests holding or waiting
+// for it, so it can be dropped when there are none.
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newUserLocks() *userLocks {
+	return &userLocks{locks: make(map[string]*userLock)}
+}
+
+// lock locks the user and returns the function that unlocks them.
+func (u *userLocks) lock(userId string) func() {
+	u.mu.Lock()
+	l, ok := u.locks[userId]
+	if !ok {
+		l = &userLock{}
+		u.locks[userId] = l
+	}
+	l.refs++
+	u.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(u.locks, userId)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/dbubel/jackstand-api/config"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/sirupsen/logrus"
+)
+
+type MigrateCommand struct {
+	Cfg config.Config
+	Log *logrus.Logger
+}
+
+func (c *MigrateCommand) Help() string {
+	return `Usage: jackstand migrate [options]
+
+  Copies every user's credentials and metadata documents, such as settings,
+  history, trash and the audit trail, from one storage backend into another.
+  A credential or document that already exists in the destination is
+  replaced, so an interrupted migration can simply be run again. With a master key configured
+  credentials are decrypted from the source and encrypted into the destination.
+
+Options:
+
+  -from=s3       Backend to copy from: s3, fs or bolt.
+  -to=bolt       Backend to copy into: s3, fs or bolt.
+  -bucket=name   S3 bucket. Defaults to S3_BUCKET.
+  -endpoint=url  S3 endpoint, e.g. localstack. Defaults to S3_ENDPOINT.
+  -root=path     Root directory for the fs backend. Defaults to STORAGE_ROOT.
+  -db=path       Database file for the bolt backend. Defaults to BOLT_PATH.
+`
+}
+
+func (c *MigrateCommand) Synopsis() string {
+	return "Copies credentials and their metadata between storage backends"
+}
+
+func (c *MigrateCommand) Run(args []string) int {
+	var from, to string
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.StringVar(&from, "from", "s3", "backend to copy from")
+	flags.StringVar(&to, "to", "bolt", "backend to copy into")
+	flags.StringVar(&c.Cfg.S3Bucket, "bucket", c.Cfg.S3Bucket, "s3 bucket")
+	flags.StringVar(&c.Cfg.S3Endpoint, "endpoint", c.Cfg.S3Endpoint, "s3 endpoint")
+	flags.StringVar(&c.Cfg.StorageRoot, "root", c.Cfg.StorageRoot, "root directory for the fs backend")
+	flags.StringVar(&c.Cfg.BoltPath, "db", c.Cfg.BoltPath, "database file for the bolt backend")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	if from == to {
+		c.Log.WithFields(logrus.Fields{"from": from, "to": to}).Error("source and destination are the same backend")
+		return 1
+	}
+
+	source, closer, err := openStore(c.Cfg, c.Log, from)
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	if err != nil {
+		c.Log.WithError(err).Error("error opening source storage")
+		return 1
+	}
+
+	destination, closer, err := openStore(c.Cfg, c.Log, to)
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	if err != nil {
+		c.Log.WithError(err).Error("error opening destination storage")
+		return 1
+	}
+
+	ctx := context.Background()
+	users, err := source.Users(ctx)
+	if err != nil {
+		c.Log.WithError(err).Error("error listing users")
+		return 1
+	}
+
+	var copied, copiedDocuments int
+	for i := range users {
+		credentials, documents, err := migrateUser(ctx, source, destination, users[i])
+		if err != nil {
+			c.Log.WithError(err).WithFields(logrus.Fields{"userId": users[i]}).Error("error migrating user")
+			return 1
+		}
+
+		copied += credentials
+		copiedDocuments += documents
+		c.Log.WithFields(logrus.Fields{
+			"userId":      users[i],
+			"credentials": credentials,
+			"documents":   documents,
+			"user":        i + 1,
+			"users":       len(users),
+		}).Info("migrated user")
+	}
+
+	c.Log.WithFields(logrus.Fields{"users": len(users), "credentials": copied, "documents": copiedDocuments}).Info("migration complete")
+	return 0
+}
+
+// migrateUser copies the user's credentials and every metadata document into
+// the destination, reporting how many of each it copied. Documents are copied
+// as they read, so they are decrypted from the source and encrypted into the
+// destination like credentials.
+func migrateUser(ctx context.Context, source, destination storage.CredentialStore, userId string) (int, int, error) {
+	credentials, err := source.List(ctx, userId)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error listing credentials %w", err)
+	}
+
+	for i := range credentials {
+		if err := destination.Create(ctx, userId, credentials[i]); err != nil {
+			return i, 0, fmt.Errorf("error copying credential %s %w", credentials[i].Uid, err)
+		}
+	}
+
+	names, err := source.ListMetadata(ctx, userId, "")
+	if err != nil {
+		return len(credentials), 0, fmt.Errorf("error listing metadata %w", err)
+	}
+
+	for i := range names {
+		var doc json.RawMessage
+		if err := source.GetMetadata(ctx, userId, names[i], &doc); err != nil {
+			return len(credentials), i, fmt.Errorf("error reading metadata %s %w", names[i], err)
+		}
+
+		if err := destination.PutMetadata(ctx, userId, names[i], doc); err != nil {
+			return len(credentials), i, fmt.Errorf("error copying metadata %s %w", names[i], err)
+		}
+	}
+	return len(credentials), len(names), nil
+}
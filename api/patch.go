@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/dbubel/intake"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/patch"
+	"github.com/dbubel/jackstand-api/subendpoints"
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Media types of the patches patchCredential accepts.
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// patchCredential edits any fields of a credential with a JSON Merge Patch,
+// or a JSON Patch when sent as application/json-patch+json. The patched
+// credential is validated like a new one.
+func (c *Credentials) patchCredential(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	subendpoints.UserIdFromClaims(w, r, func(userId string) {
+		subendpoints.CredentialIdFromParams(w, r, params, func(credentialUid uuid.UUID) {
+			mediaType := mergePatchType
+			if header := r.Header.Get("Content-Type"); header != "" {
+				var err error
+				if mediaType, _, err = mime.ParseMediaType(header); err != nil {
+					intake.RespondError(w, r, err, http.StatusUnsupportedMediaType)
+					return
+				}
+			}
+
+			switch mediaType {
+			case "application/json":
+				mediaType = mergePatchType
+			case mergePatchType, jsonPatchType:
+			default:
+				intake.RespondError(w, r, fmt.Errorf("unsupported patch type %s", mediaType), http.StatusUnsupportedMediaType)
+				return
+			}
+
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				intake.RespondError(w, r, err, http.StatusBadRequest)
+				return
+			}
+
+			c.applyPatch(w, r, userId, credentialUid, mediaType, body)
+		})
+	})
+}
+
+// patchFields sets fields of a credential, as the field update endpoints do.
+func (c *Credentials) patchFields(w http.ResponseWriter, r *http.Request, userId string, credentialUid uuid.UUID, fields map[string]string) {
+	body, err := json.Marshal(fields)
+	if err != nil {
+		intake.RespondError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	c.applyPatch(w, r, userId, credentialUid, mergePatchType, body)
+}
+
+func (c *Credentials) applyPatch(w http.ResponseWriter, r *http.Request, userId string, credentialUid uuid.UUID, mediaType string, body []byte) {
+	if !c.checkStandardMode(w, r, userId) {
+		return
+	}
+
+	body, err := canonicalPatch(mediaType, body)
+	if err != nil {
+		intake.RespondError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	c.modifyCredential(w, r, userId, credentialUid, func(credential *models.Credential) error {
+		doc, err := json.Marshal(credential)
+		if err != nil {
+			return err
+		}
+
+		if mediaType == jsonPatchType {
+			doc, err = patch.Apply(doc, body)
+		} else {
+			doc, err = patch.Merge(doc, body)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Reject misspelt fields rather than silently dropping them.
+		var patched models.Credential
+		decoder := json.NewDecoder(bytes.NewReader(doc))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&patched); err != nil {
+			return err
+		}
+
+		if err := intake.UnmarshalJSON(bytes.NewReader(doc), &patched); err != nil {
+			return err
+		}
+
+		patched.Uid = credential.Uid
+		patched.CreatedAt = credential.CreatedAt
+		patched.Blob = nil
+		patched.BlindIndex = nil
+		patched.Envelope = nil
+		*credential = patched
+		return nil
+	})
+}
+
+// canonicalPatch rewrites the top level field names a patch refers to into
+// the case credentials are marshalled in, so {"description": "..."} patches
+// the credential's Description rather than adding a second member that
+// differs only in case.
+func canonicalPatch(mediaType string, body []byte) ([]byte, error) {
+	if mediaType == jsonPatchType {
+		var ops []patch.Operation
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return nil, fmt.Errorf("%w %v", patch.ErrInvalidPatch, err)
+		}
+
+		for i := range ops {
+			ops[i].Path = canonicalPointer(ops[i].Path)
+			ops[i].From = canonicalPointer(ops[i].From)
+		}
+		return json.Marshal(ops)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, fmt.Errorf("%w a merge patch must be an object", patch.ErrInvalidPatch)
+	}
+
+	canonical := make(map[string]json.RawMessage, len(fields))
+	for name, value := range fields {
+		canonical[canonicalField(name)] = value
+	}
+
+	if len(canonical) != len(fields) {
+		return nil, errors.New("patch sets a field more than once")
+	}
+	return json.Marshal(canonical)
+}
+
+func canonicalPointer(pointer string) string {
+	if !strings.HasPrefix(pointer, "/") {
+		return pointer
+	}
+
+	parts := strings.SplitN(pointer[1:], "/", 2)
+	parts[0] = canonicalField(parts[0])
+	return "/" + strings.Join(parts, "/")
+}
+
+func canonicalField(name string) string {
+	if field, ok := projectable[strings.ToLower(name)]; ok {
+		return field
+	}
+	return name
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"flag"
+
+	"github.com/dbubel/jackstand-api/config"
+	"github.com/dbubel/jackstand-api/envelope"
+	"github.com/sirupsen/logrus"
+)
+
+type RotateKeysCommand struct {
+	Cfg config.Config
+	Log *logrus.Logger
+}
+
+func (c *RotateKeysCommand) Help() string {
+	return `Usage: jackstand rotate-keys [options]
+
+  Rewraps every user's data keys that are wrapped with one of the
+  PREVIOUS_MASTER_KEYS with MASTER_KEY. Credentials are not rewritten, since
+  the data keys they are encrypted with do not change. Users that are already
+  rewrapped are skipped, so an interrupted rotation can simply be run again.
+
+  To rotate without downtime:
+
+    1. Add the new key to PREVIOUS_MASTER_KEYS and restart the servers, so
+       they accept it before anything is wrapped with it.
+    2. Swap the keys: MASTER_KEY is the new key, PREVIOUS_MASTER_KEYS the old
+       one, and restart the servers.
+    3. Run jackstand rotate-keys.
+    4. Remove the old key from PREVIOUS_MASTER_KEYS and restart the servers.
+
+  Servers only write a user's keys when the user has none yet, and users
+  without keys are skipped, so the servers can keep running meanwhile.
+
+Options:
+
+  -storage=s3    Credential storage backend: s3, fs or bolt.
+                 Defaults to STORAGE.
+  -bucket=name   S3 bucket. Defaults to S3_BUCKET.
+  -endpoint=url  S3 endpoint, e.g. localstack. Defaults to S3_ENDPOINT.
+  -root=path     Root directory for the fs backend. Defaults to STORAGE_ROOT.
+  -db=path       Database file for the bolt backend. Defaults to BOLT_PATH.
+`
+}
+
+func (c *RotateKeysCommand) Synopsis() string {
+	return "Rewraps data keys with the current master key"
+}
+
+func (c *RotateKeysCommand) Run(args []string) int {
+	flags := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	flags.StringVar(&c.Cfg.Storage, "storage", c.Cfg.Storage, "credential storage backend")
+	flags.StringVar(&c.Cfg.S3Bucket, "bucket", c.Cfg.S3Bucket, "s3 bucket")
+	flags.StringVar(&c.Cfg.S3Endpoint, "endpoint", c.Cfg.S3Endpoint, "s3 endpoint")
+	flags.StringVar(&c.Cfg.StorageRoot, "root", c.Cfg.StorageRoot, "root directory for the fs backend")
+	flags.StringVar(&c.Cfg.BoltPath, "db", c.Cfg.BoltPath, "database file for the bolt backend")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	store, closer, err := openStore(c.Cfg, c.Log, c.Cfg.Storage)
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	if err != nil {
+		c.Log.WithError(err).Error("error opening storage")
+		return 1
+	}
+
+	keys, ok := store.(*envelope.Store)
+	if !ok {
+		c.Log.Error("MASTER_KEY is not set")
+		return 1
+	}
+
+	ctx := context.Background()
+	users, err := store.Users(ctx)
+	if err != nil {
+		c.Log.WithError(err).Error("error listing users")
+		return 1
+	}
+
+	var rewrapped, failed int
+	for i := range users {
+		n, err := keys.Rewrap(ctx, users[i])
+		if err != nil {
+			failed++
+			c.Log.WithError(err).WithFields(logrus.Fields{"userId": users[i]}).Error("error rewrapping data keys")
+			continue
+		}
+
+		rewrapped += n
+		c.Log.WithFields(logrus.Fields{
+			"userId":    users[i],
+			"rewrapped": n,
+			"user":      i + 1,
+			"users":     len(users),
+		}).Info("rotated user")
+	}
+
+	c.Log.WithFields(logrus.Fields{"users": len(users), "rewrapped": rewrapped, "failed": failed}).Info("rotation complete")
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/dbubel/intake"
+	"github.com/dbubel/jackstand-api/cacher"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -19,14 +20,26 @@ func (c *Credentials) status(w http.ResponseWriter, r *http.Request, _ httproute
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 
+	var cache cacher.Stats
+	if c.cache != nil {
+		cache = c.cache.Stats()
+	}
+
 	intake.RespondJSON(w, r, http.StatusOK, struct {
-		Alloc      uint64
-		TotalAlloc uint64
-		CacheItems int
-		BuildTime  string
+		Alloc          uint64
+		TotalAlloc     uint64
+		CacheItems     int
+		CacheHits      uint64
+		CacheMisses    uint64
+		CacheEvictions uint64
+		BuildTime      string
 	}{
-		Alloc:      bToMb(m.Alloc),
-		TotalAlloc: bToMb(m.TotalAlloc),
-		BuildTime:  BuildTime,
+		Alloc:          bToMb(m.Alloc),
+		TotalAlloc:     bToMb(m.TotalAlloc),
+		CacheItems:     cache.Items,
+		CacheHits:      cache.Hits,
+		CacheMisses:    cache.Misses,
+		CacheEvictions: cache.Evictions,
+		BuildTime:      BuildTime,
 	})
 }
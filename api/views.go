@@ -0,0 +1,208 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dbubel/intake"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/trash"
+)
+
+// secretsField selects the secret: metadata values in a projection, which
+// "metadata" alone leaves out.
+const secretsField = "secrets"
+
+// projectable maps the lower case name of every field a projection can select
+// to its name in a credential's JSON.
+var projectable = map[string]string{
+	"uid":         "Uid",
+	"service":     "service",
+	"username":    "username",
+	"password":    "password",
+	"description": "Description",
+	"metadata":    "Metadata",
+	"tags":        "tags",
+	"createdat":   "CreatedAt",
+	"updatedat":   "UpdatedAt",
+	"blob":        "blob",
+}
+
+// summaryFields are the fields the user's manifest holds.
+var summaryFields = map[string]bool{
+	"uid":       true,
+	"service":   true,
+	"username":  true,
+	"tags":      true,
+	"createdat": true,
+	"updatedat": true,
+}
+
+// listView is how the credentials of a listing are rendered: as summaries,
+// which is the default, in full, or projected onto the requested fields.
+// Passwords and secret metadata are only listed when asked for by name or
+// with view=full.
+type listView struct {
+	full   bool
+	fields map[string]bool
+}
+
+func parseListView(r *http.Request) (listView, error) {
+	values := r.URL.Query()
+	var v listView
+	switch view := values.Get("view"); view {
+	case "", "summary":
+	case "full":
+		v.full = true
+	default:
+		return v, fmt.Errorf("unknown view %q", view)
+	}
+
+	fields := values.Get("fields")
+	if fields == "" {
+		return v, nil
+	}
+
+	if values.Get("view") != "" {
+		return v, fmt.Errorf("fields cannot be combined with view")
+	}
+
+	v.fields = map[string]bool{"uid": true}
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if _, ok := projectable[field]; !ok && field != secretsField {
+			return v, fmt.Errorf("unknown field %q", field)
+		}
+		v.fields[field] = true
+	}
+
+	if v.fields[secretsField] {
+		v.fields["metadata"] = true
+	}
+	return v, nil
+}
+
+// summary reports whether the view only needs what the manifest holds.
+func (v listView) summary() bool {
+	if v.full {
+		return false
+	}
+
+	for field := range v.fields {
+		if !summaryFields[field] {
+			return false
+		}
+	}
+	return true
+}
+
+// render returns the credentials as the view shows them.
+func (v listView) render(credentials []models.Credential) (interface{}, error) {
+	if v.full {
+		return credentials, nil
+	}
+
+	if v.fields == nil {
+		summaries := make([]models.CredentialSummary, 0, len(credentials))
+		for i := range credentials {
+			summaries = append(summaries, credentials[i].Summary())
+		}
+		return summaries, nil
+	}
+
+	projected := make([]map[string]json.RawMessage, 0, len(credentials))
+	for i := range credentials {
+		credential := credentials[i]
+		if !v.fields[secretsField] {
+			credential.Metadata = publicMetadata(credential.Metadata)
+		}
+
+		buf, err := json.Marshal(credential)
+		if err != nil {
+			return nil, err
+		}
+
+		var all map[string]json.RawMessage
+		if err := json.Unmarshal(buf, &all); err != nil {
+			return nil, err
+		}
+
+		selected := make(map[string]json.RawMessage, len(v.fields))
+		for field := range v.fields {
+			if value, ok := all[projectable[field]]; ok {
+				selected[projectable[field]] = value
+			}
+		}
+		projected = append(projected, selected)
+	}
+	return projected, nil
+}
+
+// trashedCredential is a trashed credential as the view shows it.
+type trashedCredential struct {
+	DeletedAt  models.CustomTime `json:"deletedAt"`
+	Credential json.RawMessage   `json:"credential"`
+}
+
+// renderTrash returns the trashed credentials as the view shows them, along
+// with when each was deleted.
+func (v listView) renderTrash(items []trash.Item) ([]trashedCredential, error) {
+	credentials := make([]models.Credential, 0, len(items))
+	for i := range items {
+		credentials = append(credentials, items[i].Credential)
+	}
+
+	rendered, err := v.render(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := json.Marshal(rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	var each []json.RawMessage
+	if err := json.Unmarshal(buf, &each); err != nil {
+		return nil, err
+	}
+
+	trashed := make([]trashedCredential, 0, len(items))
+	for i := range items {
+		trashed = append(trashed, trashedCredential{DeletedAt: items[i].DeletedAt, Credential: each[i]})
+	}
+	return trashed, nil
+}
+
+// respondList renders a listing in the view, with 204 No Content when it is
+// empty.
+func respondList(w http.ResponseWriter, r *http.Request, v listView, credentials []models.Credential) {
+	if len(credentials) == 0 {
+		intake.Respond(w, r, http.StatusNoContent, nil)
+		return
+	}
+
+	body, err := v.render(credentials)
+	if err != nil {
+		intake.RespondError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	intake.RespondJSON(w, r, http.StatusOK, body)
+}
+
+// publicMetadata returns the metadata without its secret values.
+func publicMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+
+	public := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		if !models.IsSecretMetadata(key) {
+			public[key] = value
+		}
+	}
+	return public
+}
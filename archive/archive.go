@@ -0,0 +1,159 @@
+// Package archive reads and writes passphrase encrypted archives of a user's
+// credentials, which can be restored into the same or another account.
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/gofrs/uuid"
+)
+
+// Version is the version of the JSON schema of the document archives hold.
+// Readers accept documents up to their own version.
+const Version = 1
+
+// Document is the content of an archive.
+type Document struct {
+	Version     int          `json:"version"`
+	ExportedAt  time.Time    `json:"exportedAt"`
+	Credentials []Credential `json:"credentials"`
+}
+
+// Credential is a credential as archives hold it. It is kept apart from
+// models.Credential so that archives do not change with the storage model.
+type Credential struct {
+	Uid         uuid.UUID         `json:"uid"`
+	Service     string            `json:"service"`
+	Username    string            `json:"username"`
+	Password    string            `json:"password"`
+	Description string            `json:"description,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+}
+
+// FromModel returns the credential as archives hold it.
+func FromModel(c models.Credential) Credential {
+	return Credential{
+		Uid:         c.Uid,
+		Service:     c.Service,
+		Username:    c.Username,
+		Password:    c.Password,
+		Description: c.Description,
+		Metadata:    c.Metadata,
+		Tags:        c.Tags,
+		CreatedAt:   time.Time(c.CreatedAt),
+		UpdatedAt:   time.Time(c.UpdatedAt),
+	}
+}
+
+// Model returns the archived credential as a models.Credential.
+func (c Credential) Model() models.Credential {
+	return models.Credential{
+		Uid:         c.Uid,
+		Service:     c.Service,
+		Username:    c.Username,
+		Password:    c.Password,
+		Description: c.Description,
+		Metadata:    c.Metadata,
+		Tags:        c.Tags,
+		CreatedAt:   models.CustomTime(c.CreatedAt),
+		UpdatedAt:   models.CustomTime(c.UpdatedAt),
+	}
+}
+
+// Encoder writes a document one credential at a time, so only the
+// credential being written is held at once.
+type Encoder struct {
+	w io.Writer
+	n int
+}
+
+// NewEncoder starts a document in w. Close must be called to end it.
+func NewEncoder(w io.Writer) (*Encoder, error) {
+	exportedAt, err := json.Marshal(time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fmt.Fprintf(w, `{"version":%d,"exportedAt":%s,"credentials":[`, Version, exportedAt); err != nil {
+		return nil, err
+	}
+	return &Encoder{w: w}, nil
+}
+
+// Encode adds the credential to the document.
+func (e *Encoder) Encode(c models.Credential) error {
+	b, err := json.Marshal(FromModel(c))
+	if err != nil {
+		return err
+	}
+
+	if e.n > 0 {
+		b = append([]byte(","), b...)
+	}
+
+	e.n++
+	_, err = e.w.Write(b)
+	return err
+}
+
+// Close ends the document.
+func (e *Encoder) Close() error {
+	_, err := io.WriteString(e.w, "]}")
+	return err
+}
+
+// Write writes the credentials to w as an archive encrypted with the
+// passphrase.
+func Write(w io.Writer, passphrase string, params Params, credentials []models.Credential) error {
+	aw, err := NewWriter(w, passphrase, params)
+	if err != nil {
+		return err
+	}
+
+	e, err := NewEncoder(aw)
+	if err != nil {
+		return err
+	}
+
+	for i := range credentials {
+		if err := e.Encode(credentials[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := e.Close(); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// Read decrypts the archive r with the passphrase and decodes its document.
+func Read(r io.Reader, passphrase string) (*Document, error) {
+	ar, err := NewReader(r, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc Document
+	if err := json.NewDecoder(ar).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w %v", ErrInvalidFile, err)
+	}
+
+	// Reading to the end authenticates the last chunk.
+	if _, err := io.Copy(ioutil.Discard, ar); err != nil {
+		return nil, err
+	}
+
+	if doc.Version < 1 || doc.Version > Version {
+		return nil, fmt.Errorf("%w schema version %d", ErrUnsupported, doc.Version)
+	}
+	return &doc, nil
+}
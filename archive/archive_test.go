@@ -0,0 +1,120 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// testParams keep the key derivation cheap.
+var testParams = Params{Time: 1, Memory: 64, Threads: 1}
+
+func TestStream(t *testing.T) {
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, 3*chunkSize + 7} {
+		plaintext := bytes.Repeat([]byte("x"), size)
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, "s3cret", testParams)
+		assert.NoError(t, err)
+		_, err = w.Write(plaintext)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+
+		r, err := NewReader(bytes.NewReader(buf.Bytes()), "s3cret")
+		if !assert.NoError(t, err, size) {
+			continue
+		}
+
+		read, err := ioutil.ReadAll(r)
+		assert.NoError(t, err, size)
+		assert.Equal(t, plaintext, read, size)
+
+		// Dropping the last chunk is noticed even at a chunk boundary.
+		if size >= chunkSize {
+			r, err := NewReader(bytes.NewReader(buf.Bytes()[:headerSize+chunkSize+16]), "s3cret")
+			assert.NoError(t, err)
+			_, err = ioutil.ReadAll(r)
+			assert.ErrorIs(t, err, ErrInvalidFile, size)
+		}
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	created := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	credentials := []models.Credential{
+		{
+			Uid:         uuid.Must(uuid.NewV4()),
+			Service:     "GitHub",
+			Username:    "octocat",
+			Password:    strings.Repeat("p", chunkSize),
+			Description: "work",
+			Metadata:    map[string]string{"folder": "Work", "secret:pin": "1234"},
+			Tags:        []string{"dev"},
+			CreatedAt:   models.CustomTime(created),
+			UpdatedAt:   models.CustomTime(created.Add(time.Hour)),
+		},
+		{
+			Uid:       uuid.Must(uuid.NewV4()),
+			Service:   "Bank",
+			Username:  "carol",
+			Password:  "pw",
+			CreatedAt: models.CustomTime(created),
+			UpdatedAt: models.CustomTime(created),
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, Write(&buf, "s3cret", testParams, credentials))
+	assert.True(t, IsArchive(buf.Bytes()))
+
+	doc, err := Read(bytes.NewReader(buf.Bytes()), "s3cret")
+	assert.NoError(t, err)
+	assert.Equal(t, Version, doc.Version)
+	assert.WithinDuration(t, time.Now(), doc.ExportedAt, time.Minute)
+	if assert.Len(t, doc.Credentials, 2) {
+		for i := range credentials {
+			assert.Equal(t, credentials[i], doc.Credentials[i].Model())
+		}
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, Write(&buf, "s3cret", testParams, nil))
+	data := buf.Bytes()
+
+	_, err := Read(bytes.NewReader(data), "wrong")
+	assert.ErrorIs(t, err, ErrInvalidPassword)
+
+	_, err = Read(strings.NewReader("not an archive"), "s3cret")
+	assert.ErrorIs(t, err, ErrInvalidFile)
+
+	// The header is authenticated with every chunk.
+	tampered := append([]byte{}, data...)
+	tampered[headerSize-1] ^= 1
+	_, err = Read(bytes.NewReader(tampered), "s3cret")
+	assert.Error(t, err)
+
+	future := append([]byte{}, data...)
+	future[len(magic)] = formatVersion + 1
+	_, err = Read(bytes.NewReader(future), "s3cret")
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	// Documents of a later schema version are not read.
+	buf.Reset()
+	w, err := NewWriter(&buf, "s3cret", testParams)
+	assert.NoError(t, err)
+	io.WriteString(w, `{"version":2,"credentials":[]}`)
+	assert.NoError(t, w.Close())
+	_, err = Read(bytes.NewReader(buf.Bytes()), "s3cret")
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	_, err = NewWriter(&buf, "s3cret", Params{Time: 1, Memory: maxMemory + 1, Threads: 1})
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
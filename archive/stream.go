@@ -0,0 +1,223 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// An archive starts with a header holding the magic, the format version and
+// the key derivation parameters, followed by the plaintext in chunks sealed
+// with AES-256-GCM under a key derived from the passphrase with Argon2id.
+// Every chunk but the last holds chunkSize bytes of plaintext; the nonce of
+// a chunk is its index and whether it is the last, so chunks cannot be
+// reordered, dropped or the archive truncated without the reader noticing.
+// The header is the additional data of every chunk.
+const (
+	magic         = "JSARCHIV"
+	formatVersion = 1
+	saltSize      = 16
+	headerSize    = len(magic) + 1 + 4 + 4 + 1 + saltSize
+	chunkSize     = 64 << 10
+)
+
+// Limits on the key derivation parameters of an archive, since opening one
+// takes that much time and memory.
+const (
+	maxTime    = 100
+	maxMemory  = 1 << 20
+	maxThreads = 64
+)
+
+var (
+	ErrInvalidFile     = errors.New("invalid archive")
+	ErrInvalidPassword = errors.New("invalid passphrase")
+	ErrUnsupported     = errors.New("unsupported archive")
+)
+
+// Params are the Argon2id parameters the key of an archive is derived with.
+// Memory is in KiB.
+type Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// DefaultParams are the second recommended parameters of RFC 9106.
+var DefaultParams = Params{Time: 3, Memory: 64 << 10, Threads: 4}
+
+// IsArchive reports whether the data starts like an archive.
+func IsArchive(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(magic))
+}
+
+type writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	index  uint32
+	err    error
+}
+
+// NewWriter returns a writer encrypting what is written to it into w with
+// the passphrase. Close writes the last chunk and must be called for the
+// archive to be complete.
+func NewWriter(w io.Writer, passphrase string, params Params) (io.WriteCloser, error) {
+	if params.Time == 0 || params.Threads == 0 || params.Time > maxTime || params.Memory > maxMemory || params.Threads > maxThreads {
+		return nil, fmt.Errorf("%w key derivation parameters %+v", ErrUnsupported, params)
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	b := header[len(magic):]
+	b[0] = formatVersion
+	binary.BigEndian.PutUint32(b[1:], params.Time)
+	binary.BigEndian.PutUint32(b[5:], params.Memory)
+	b[9] = params.Threads
+
+	salt := b[10:]
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	aead := newAEAD(passphrase, salt, params)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &writer{w: w, aead: aead, header: header, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n := 0
+	for w.err == nil && len(p) > 0 {
+		m := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf, p, n = w.buf[:len(w.buf)+m], p[m:], n+m
+
+		// A full chunk is never the last, which leaves the last shorter
+		// than the others for the reader to recognise.
+		if len(w.buf) == chunkSize {
+			w.seal(false)
+		}
+	}
+	return n, w.err
+}
+
+func (w *writer) Close() error {
+	if w.err == nil {
+		w.seal(true)
+	}
+	return w.err
+}
+
+func (w *writer) seal(last bool) {
+	chunk := w.aead.Seal(nil, nonce(w.index, last), w.buf, w.header)
+	if _, err := w.w.Write(chunk); err != nil {
+		w.err = err
+	}
+	w.buf = w.buf[:0]
+	w.index++
+}
+
+type reader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	chunk  []byte
+	buf    []byte
+	index  uint32
+	done   bool
+}
+
+// NewReader returns a reader decrypting the archive r. Reads fail with
+// ErrInvalidFile once a chunk has been tampered with or the archive ends
+// early.
+func NewReader(r io.Reader, passphrase string) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil || !IsArchive(header) {
+		return nil, fmt.Errorf("%w missing header", ErrInvalidFile)
+	}
+
+	if header[len(magic)] != formatVersion {
+		return nil, fmt.Errorf("%w format version %d", ErrUnsupported, header[len(magic)])
+	}
+
+	b := header[len(magic):]
+	params := Params{Time: binary.BigEndian.Uint32(b[1:]), Memory: binary.BigEndian.Uint32(b[5:]), Threads: b[9]}
+	if params.Time == 0 || params.Threads == 0 {
+		return nil, fmt.Errorf("%w invalid key derivation parameters", ErrInvalidFile)
+	}
+
+	if params.Time > maxTime || params.Memory > maxMemory || params.Threads > maxThreads {
+		return nil, fmt.Errorf("%w key derivation parameters above the limits of %d MiB, %d iterations and %d threads",
+			ErrUnsupported, maxMemory>>10, maxTime, maxThreads)
+	}
+
+	rd := &reader{r: r, aead: newAEAD(passphrase, b[10:], params), header: header}
+	rd.chunk = make([]byte, chunkSize+rd.aead.Overhead())
+
+	// The first chunk tells a wrong passphrase from a valid archive.
+	if err := rd.open(); errors.Is(err, ErrInvalidFile) {
+		return nil, ErrInvalidPassword
+	} else if err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *reader) open() error {
+	n, err := io.ReadFull(r.r, r.chunk)
+	last := err == io.ErrUnexpectedEOF || err == io.EOF
+	if err != nil && !last {
+		return err
+	}
+
+	plaintext, err := r.aead.Open(r.chunk[:0], nonce(r.index, last), r.chunk[:n], r.header)
+	if err != nil {
+		return fmt.Errorf("%w corrupt or truncated chunk %d", ErrInvalidFile, r.index)
+	}
+
+	r.buf, r.done = plaintext, last
+	r.index++
+	return nil
+}
+
+func newAEAD(passphrase string, salt []byte, params Params) cipher.AEAD {
+	key := argon2.IDKey([]byte(passphrase), salt, params.Time, params.Memory, params.Threads, 32)
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// nonce is the big endian index of a chunk followed by 1 for the last one.
+func nonce(index uint32, last bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint32(n[7:], index)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
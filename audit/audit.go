@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+)
+
+// prefix starts the names of the metadata documents holding audit events,
+// one document per event.
+const prefix = "audit/"
+
+// Actions that are recorded.
+const (
+	ActionExport = "export"
+)
+
+// Event is something done with a user's credentials that they may want to
+// review later, like exporting them.
+type Event struct {
+	Uid    uuid.UUID         `json:"uid"`
+	At     models.CustomTime `json:"at"`
+	Action string            `json:"action"`
+	// Format is the format credentials were exported in.
+	Format string `json:"format,omitempty"`
+	// Credentials is how many credentials the action covered.
+	Credentials int    `json:"credentials"`
+	RemoteAddr  string `json:"remoteAddr,omitempty"`
+	UserAgent   string `json:"userAgent,omitempty"`
+}
+
+// Trail keeps each user's audit events. Events are only ever added.
+type Trail struct {
+	store storage.MetadataStore
+}
+
+func New(store storage.MetadataStore) *Trail {
+	return &Trail{store: store}
+}
+
+// Record adds an event to the user's trail, setting its uid and time.
+func (t *Trail) Record(ctx context.Context, userId string, e Event) (Event, error) {
+	e.Uid = uuid.Must(uuid.NewV4())
+	e.At = models.CustomTime(time.Now())
+	return e, t.store.PutMetadata(ctx, userId, name(e), e)
+}
+
+// List returns the user's events, most recent first.
+func (t *Trail) List(ctx context.Context, userId string) ([]Event, error) {
+	names, err := t.store.ListMetadata(ctx, userId, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Names sort by time, oldest first.
+	events := make([]Event, 0, len(names))
+	for i := len(names) - 1; i >= 0; i-- {
+		var e Event
+		err := t.store.GetMetadata(ctx, userId, names[i], &e)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// name orders events by time, with the uid keeping events recorded at the
+// same time apart.
+func name(e Event) string {
+	return fmt.Sprintf("%s%020d-%s", prefix, time.Time(e.At).UnixNano(), e.Uid)
+}
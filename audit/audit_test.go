@@ -0,0 +1,38 @@
+package audit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/brianvoe/gofakeit"
+	"github.com/dbubel/jackstand-api/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrail(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	trail := New(memory.NewStore())
+
+	first, err := trail.Record(ctx, userId, Event{Action: ActionExport, Format: "csv", Credentials: 3})
+	assert.NoError(t, err)
+	second, err := trail.Record(ctx, userId, Event{Action: ActionExport, Format: "json"})
+	assert.NoError(t, err)
+
+	t.Run("test list is most recent first", func(t *testing.T) {
+		events, err := trail.List(ctx, userId)
+		assert.NoError(t, err)
+		if assert.Len(t, events, 2) {
+			assert.Equal(t, second.Uid, events[0].Uid)
+			assert.Equal(t, first.Uid, events[1].Uid)
+			assert.Equal(t, "csv", events[1].Format)
+			assert.Equal(t, 3, events[1].Credentials)
+		}
+	})
+
+	t.Run("test trails are per user", func(t *testing.T) {
+		events, err := trail.List(ctx, gofakeit.Username())
+		assert.NoError(t, err)
+		assert.Empty(t, events)
+	})
+}
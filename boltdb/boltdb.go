@@ -0,0 +1,511 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket layout, one nested bucket per user:
+//
+//	users/<userId>/credentials   uid -> credential JSON
+//	users/<userId>/service       lower(service) 0x00 uid -> nil
+//	users/<userId>/username      lower(username) 0x00 uid -> nil
+//	users/<userId>/updated       updatedAt 0x00 uid -> nil
+//	users/<userId>/metadata      name -> document JSON
+var (
+	usersBucket       = []byte("users")
+	credentialsBucket = []byte("credentials")
+	serviceIndex      = []byte("service")
+	usernameIndex     = []byte("username")
+	updatedIndex      = []byte("updated")
+	metadataBucket    = []byte("metadata")
+)
+
+// Store is a storage.CredentialStore backed by an embedded bbolt database. It
+// keeps secondary indexes on service, username and update time so filtered
+// and sorted listings are answered with a single index scan.
+type Store struct {
+	log *logrus.Logger
+	db  *bolt.DB
+}
+
+func NewStore(log *logrus.Logger, path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening bolt database %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{
+		log: log,
+		db:  db,
+	}, nil
+}
+
+// Close releases the database file lock.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Create stores the credential, replacing it and its index entries if a
+// credential with the same uid already exists.
+func (s *Store) Create(ctx context.Context, userId string, credential models.Credential) error {
+	s.log.WithFields(logrus.Fields{"userId": userId, "credentialUid": credential.Uid}).Debug("bolt create")
+	return s.db.Update(func(tx *bolt.Tx) error {
+		user, err := userBucket(tx, userId, true)
+		if err != nil {
+			return err
+		}
+		return put(user, credential)
+	})
+}
+
+func (s *Store) Get(ctx context.Context, userId string, credentialUid uuid.UUID) (models.Credential, error) {
+	s.log.WithFields(logrus.Fields{"userId": userId, "credentialUid": credentialUid}).Debug("bolt get")
+	var credential models.Credential
+	err := s.db.View(func(tx *bolt.Tx) error {
+		user, err := userBucket(tx, userId, false)
+		if err != nil {
+			return err
+		}
+
+		credential, err = get(user, []byte(credentialUid.String()))
+		return err
+	})
+
+	return credential, err
+}
+
+func (s *Store) List(ctx context.Context, userId string) ([]models.Credential, error) {
+	page, err := s.Query(ctx, userId, storage.Query{})
+	return page.Credentials, err
+}
+
+// Query answers q from the index matching its sort order, or the service and
+// username indexes when only filtering, without loading credentials that do
+// not match. There is no index on creation time, so queries sorted by it
+// fall back to storage.Filter.
+func (s *Store) Query(ctx context.Context, userId string, q storage.Query) (storage.Page, error) {
+	s.log.WithFields(logrus.Fields{"userId": userId, "query": q}).Debug("bolt query")
+	if q.SortBy == storage.SortByCreatedAt {
+		return storage.Filter(ctx, s, userId, q)
+	}
+
+	page := storage.Page{Credentials: []models.Credential{}}
+	after, err := q.After()
+	if err != nil {
+		return page, err
+	}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		user, err := userBucket(tx, userId, false)
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		page, err = scan(ctx, user, q, after)
+		return err
+	})
+
+	return page, err
+}
+
+func (s *Store) Update(ctx context.Context, userId string, credential models.Credential) error {
+	s.log.WithFields(logrus.Fields{"userId": userId, "credentialUid": credential.Uid}).Debug("bolt update")
+	return s.db.Update(func(tx *bolt.Tx) error {
+		user, err := userBucket(tx, userId, false)
+		if err != nil {
+			return err
+		}
+
+		if user.Bucket(credentialsBucket).Get([]byte(credential.Uid.String())) == nil {
+			return storage.ErrNotFound
+		}
+		return put(user, credential)
+	})
+}
+
+func (s *Store) Delete(ctx context.Context, userId string, credentialUid uuid.UUID) error {
+	s.log.WithFields(logrus.Fields{"userId": userId, "credentialUid": credentialUid}).Debug("bolt delete")
+	return s.db.Update(func(tx *bolt.Tx) error {
+		user, err := userBucket(tx, userId, false)
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return remove(user, []byte(credentialUid.String()))
+	})
+}
+
+func (s *Store) DeleteAll(ctx context.Context, userId string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		user, err := userBucket(tx, userId, false)
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, name := range [][]byte{credentialsBucket, serviceIndex, usernameIndex, updatedIndex} {
+			if err := user.DeleteBucket(name); err != nil {
+				return err
+			}
+
+			if _, err := user.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) Users(ctx context.Context) ([]string, error) {
+	var users []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			if v == nil {
+				users = append(users, string(k))
+			}
+			return nil
+		})
+	})
+
+	return users, err
+}
+
+func (s *Store) GetMetadata(ctx context.Context, userId, name string, v interface{}) error {
+	var buf []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		user, err := userBucket(tx, userId, false)
+		if err != nil {
+			return err
+		}
+
+		if metadata := user.Bucket(metadataBucket); metadata != nil {
+			buf = append(buf, metadata.Get([]byte(name))...)
+		}
+
+		if buf == nil {
+			return storage.ErrNotFound
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func (s *Store) PutMetadata(ctx context.Context, userId, name string, v interface{}) error {
+	if err := storage.CheckMetadataName(name); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		user, err := userBucket(tx, userId, true)
+		if err != nil {
+			return err
+		}
+		return user.Bucket(metadataBucket).Put([]byte(name), buf)
+	})
+}
+
+func (s *Store) DeleteMetadata(ctx context.Context, userId, name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		user, err := userBucket(tx, userId, false)
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if metadata := user.Bucket(metadataBucket); metadata != nil {
+			return metadata.Delete([]byte(name))
+		}
+		return nil
+	})
+}
+
+func (s *Store) ListMetadata(ctx context.Context, userId, prefix string) ([]string, error) {
+	var names []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		user, err := userBucket(tx, userId, false)
+		if err == storage.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		metadata := user.Bucket(metadataBucket)
+		if metadata == nil {
+			return nil
+		}
+
+		cursor := metadata.Cursor()
+		for k, _ := cursor.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = cursor.Next() {
+			names = append(names, string(k))
+		}
+		return nil
+	})
+
+	return names, err
+}
+
+// userBucket returns the bucket for a user, optionally creating it along with
+// its credential and index buckets.
+func userBucket(tx *bolt.Tx, userId string, create bool) (*bolt.Bucket, error) {
+	if userId == "" {
+		return nil, fmt.Errorf("invalid user id %q", userId)
+	}
+
+	users := tx.Bucket(usersBucket)
+	if !create {
+		user := users.Bucket([]byte(userId))
+		if user == nil {
+			return nil, storage.ErrNotFound
+		}
+		return user, nil
+	}
+
+	user, err := users.CreateBucketIfNotExists([]byte(userId))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range [][]byte{credentialsBucket, serviceIndex, usernameIndex, updatedIndex, metadataBucket} {
+		if _, err := user.CreateBucketIfNotExists(name); err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+func get(user *bolt.Bucket, uid []byte) (models.Credential, error) {
+	var credential models.Credential
+	buf := user.Bucket(credentialsBucket).Get(uid)
+	if buf == nil {
+		return credential, storage.ErrNotFound
+	}
+
+	err := json.Unmarshal(buf, &credential)
+	return credential, err
+}
+
+func put(user *bolt.Bucket, credential models.Credential) error {
+	uid := []byte(credential.Uid.String())
+	if err := remove(user, uid); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+
+	if err := user.Bucket(credentialsBucket).Put(uid, buf); err != nil {
+		return err
+	}
+
+	// Index what was stored rather than what was passed in so remove, which
+	// only sees the stored copy, always finds the same keys.
+	stored, err := get(user, uid)
+	if err != nil {
+		return err
+	}
+
+	for name, key := range indexKeys(stored) {
+		if err := user.Bucket([]byte(name)).Put(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes a credential and its index entries if it exists.
+func remove(user *bolt.Bucket, uid []byte) error {
+	existing, err := get(user, uid)
+	if err == storage.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for name, key := range indexKeys(existing) {
+		if err := user.Bucket([]byte(name)).Delete(key); err != nil {
+			return err
+		}
+	}
+	return user.Bucket(credentialsBucket).Delete(uid)
+}
+
+func indexKeys(c models.Credential) map[string][]byte {
+	uid := []byte(c.Uid.String())
+	return map[string][]byte{
+		string(serviceIndex):  indexKey([]byte(strings.ToLower(c.Service)), uid),
+		string(usernameIndex): indexKey([]byte(strings.ToLower(c.Username)), uid),
+		string(updatedIndex):  indexKey(timeKey(time.Time(c.UpdatedAt)), uid),
+	}
+}
+
+func indexKey(value, uid []byte) []byte {
+	key := make([]byte, 0, len(value)+1+len(uid))
+	key = append(key, value...)
+	key = append(key, 0)
+	return append(key, uid...)
+}
+
+// timeKey encodes t so byte order matches time order, including times before
+// the unix epoch.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.Unix())^(1<<63))
+	return key
+}
+
+// indexFor picks the bucket to scan for q. Sorted queries walk the index for
+// their sort order, unsorted queries walk the service or username index from
+// the filter prefix, or otherwise the credentials themselves which are keyed
+// by uid.
+func indexFor(q storage.Query) ([]byte, []byte) {
+	switch q.SortBy {
+	case storage.SortByService:
+		return serviceIndex, []byte(strings.ToLower(q.Service))
+	case storage.SortByUsername:
+		return usernameIndex, []byte(strings.ToLower(q.Username))
+	case storage.SortByUpdatedAt:
+		return updatedIndex, nil
+	}
+
+	if q.Service != "" {
+		return serviceIndex, []byte(strings.ToLower(q.Service))
+	}
+
+	if q.Username != "" {
+		return usernameIndex, []byte(strings.ToLower(q.Username))
+	}
+	return credentialsBucket, nil
+}
+
+// keyFor returns the key of c in the index bucket.
+func keyFor(index []byte, c models.Credential) []byte {
+	if bytes.Equal(index, credentialsBucket) {
+		return []byte(c.Uid.String())
+	}
+	return indexKeys(c)[string(index)]
+}
+
+// scan walks the keys of the index for q that start with its filter prefix,
+// in reverse when q is descending and resuming after the cursor, loading and
+// matching the credential each key points to until the page is full.
+func scan(ctx context.Context, user *bolt.Bucket, q storage.Query, after *models.Credential) (storage.Page, error) {
+	index, prefix := indexFor(q)
+
+	// A filter index is not in uid order, so unsorted queries using one have
+	// to collect every match and order and page them afterwards.
+	ordered := q.SortBy != "" || bytes.Equal(index, credentialsBucket)
+
+	cursor := user.Bucket(index).Cursor()
+	var k []byte
+	next := cursor.Next
+	switch {
+	case ordered && after != nil && q.Desc:
+		if k, _ = cursor.Seek(keyFor(index, *after)); k == nil {
+			k, _ = cursor.Last()
+		} else {
+			k, _ = cursor.Prev()
+		}
+		next = cursor.Prev
+	case ordered && after != nil:
+		start := keyFor(index, *after)
+		if k, _ = cursor.Seek(start); bytes.Equal(k, start) {
+			k, _ = cursor.Next()
+		}
+	case ordered && q.Desc:
+		k, _ = seekLast(cursor, prefix)
+		next = cursor.Prev
+	default:
+		k, _ = cursor.Seek(prefix)
+	}
+
+	page := storage.Page{Credentials: []models.Credential{}}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, _ = next() {
+		if err := ctx.Err(); err != nil {
+			return page, err
+		}
+
+		uid := k
+		if !bytes.Equal(index, credentialsBucket) {
+			uid = k[bytes.LastIndexByte(k, 0)+1:]
+		}
+
+		credential, err := get(user, uid)
+		if err != nil {
+			return page, fmt.Errorf("error reading credential %s %w", uid, err)
+		}
+
+		if !q.Match(credential) {
+			continue
+		}
+
+		if ordered && q.Limit > 0 && len(page.Credentials) == q.Limit {
+			page.Next = q.CursorFor(page.Credentials[q.Limit-1])
+			break
+		}
+		page.Credentials = append(page.Credentials, credential)
+	}
+
+	if !ordered {
+		return q.Apply(page.Credentials)
+	}
+	return page, nil
+}
+
+// seekLast moves the cursor to the last key starting with prefix.
+func seekLast(cursor *bolt.Cursor, prefix []byte) ([]byte, []byte) {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			end = end[:i+1]
+			if k, _ := cursor.Seek(end); k == nil {
+				return cursor.Last()
+			}
+			return cursor.Prev()
+		}
+	}
+	return cursor.Last()
+}
@@ -0,0 +1,192 @@
+package boltdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+var log *logrus.Logger
+
+func init() {
+	log = logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+}
+
+func testCredential(service, username string, updated time.Time) models.Credential {
+	return models.Credential{
+		Uid:       uuid.Must(uuid.NewV4()),
+		Service:   service,
+		Username:  username,
+		Password:  "hunter2",
+		CreatedAt: models.CustomTime(updated.Add(-time.Duration(len(username)) * time.Hour)),
+		UpdatedAt: models.CustomTime(updated),
+	}
+}
+
+func uids(credentials []models.Credential) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(credentials))
+	for i := range credentials {
+		ids = append(ids, credentials[i].Uid)
+	}
+	return ids
+}
+
+// TestMain runs the tests in America/New_York, where models.CustomTime
+// writes times, so that they are read back as the same instants.
+func TestMain(m *testing.M) {
+	time.Local, _ = time.LoadLocation("America/New_York")
+	os.Exit(m.Run())
+}
+
+func TestBolt(t *testing.T) {
+	store, err := NewStore(log, filepath.Join(t.TempDir(), "jackstand.db"))
+	assert.NoError(t, err)
+	defer store.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	credentials := []models.Credential{
+		testCredential("GitHub", "jon", now.Add(-time.Hour)),
+		testCredential("gitlab", "zach", now),
+		testCredential("Amazon", "jon", now.Add(-2*time.Hour)),
+		testCredential("git", "amy", now.Add(-time.Minute)),
+		testCredential("bank", "Jonathan", now.Add(-72*time.Hour)),
+	}
+	credentials[0].Tags = []string{"work", "code"}
+	credentials[1].Tags = []string{"Work"}
+	credentials[2].Description = "shopping at the hub"
+
+	t.Run("test create credentials", func(t *testing.T) {
+		for i := range credentials {
+			assert.NoError(t, store.Create(ctx, "user1", credentials[i]))
+		}
+		assert.NoError(t, store.Create(ctx, "user2", testCredential("github", "other", now)))
+	})
+
+	t.Run("test get credential", func(t *testing.T) {
+		c, err := store.Get(ctx, "user1", credentials[0].Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, credentials[0].Service, c.Service)
+
+		_, err = store.Get(ctx, "user2", credentials[0].Uid)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		_, err = store.Get(ctx, "nobody", credentials[0].Uid)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("test queries match the generic filter", func(t *testing.T) {
+		queries := []storage.Query{
+			{},
+			{Desc: true},
+			{Service: "git"},
+			{Service: "GIT", Desc: true},
+			{Username: "jon"},
+			{SortBy: storage.SortByService},
+			{SortBy: storage.SortByService, Desc: true},
+			{SortBy: storage.SortByService, Service: "git", Desc: true},
+			{SortBy: storage.SortByUsername, Username: "jo"},
+			{SortBy: storage.SortByUpdatedAt},
+			{SortBy: storage.SortByUpdatedAt, Desc: true, Username: "jon"},
+			{SortBy: storage.SortByCreatedAt},
+			{SortBy: storage.SortByCreatedAt, Desc: true, Service: "git"},
+			{Search: "hub"},
+			{Search: "GIT ZA"},
+			{Tags: []string{"work"}},
+			{Tags: []string{"work", "code"}, SortBy: storage.SortByService},
+			{UpdatedAfter: now.Add(-90 * time.Minute), SortBy: storage.SortByUpdatedAt},
+			{CreatedBefore: now.Add(-270 * time.Minute), Desc: true},
+			{Service: "nothing"},
+		}
+
+		for _, q := range queries {
+			expected, err := q.Apply(append([]models.Credential{}, credentials...))
+			assert.NoError(t, err)
+			actual, err := store.Query(ctx, "user1", q)
+			assert.NoError(t, err)
+			assert.Equal(t, uids(expected.Credentials), uids(actual.Credentials), "query %+v", q)
+		}
+	})
+
+	t.Run("test paged queries match the generic filter", func(t *testing.T) {
+		queries := []storage.Query{
+			{Limit: 2},
+			{Limit: 2, Desc: true},
+			{Limit: 1, Service: "git"},
+			{Limit: 2, SortBy: storage.SortByService},
+			{Limit: 1, SortBy: storage.SortByService, Service: "git", Desc: true},
+			{Limit: 3, SortBy: storage.SortByUpdatedAt, Desc: true},
+			{Limit: 10, SortBy: storage.SortByUsername},
+			{Limit: 2, SortBy: storage.SortByCreatedAt, Desc: true},
+		}
+
+		for _, q := range queries {
+			expected, err := storage.Query{Service: q.Service, SortBy: q.SortBy, Desc: q.Desc}.Apply(append([]models.Credential{}, credentials...))
+			assert.NoError(t, err)
+
+			var actual []models.Credential
+			for pages := 0; pages < 10; pages++ {
+				page, err := store.Query(ctx, "user1", q)
+				assert.NoError(t, err)
+				assert.LessOrEqual(t, len(page.Credentials), q.Limit)
+				actual = append(actual, page.Credentials...)
+				if page.Next == "" {
+					break
+				}
+				q.Cursor = page.Next
+			}
+			assert.Equal(t, uids(expected.Credentials), uids(actual), "query %+v", q)
+		}
+	})
+
+	t.Run("test update moves index entries", func(t *testing.T) {
+		credentials[1].Service = "bitbucket"
+		assert.NoError(t, store.Update(ctx, "user1", credentials[1]))
+
+		page, err := store.Query(ctx, "user1", storage.Query{Service: "gitlab"})
+		assert.NoError(t, err)
+		assert.Empty(t, page.Credentials)
+
+		page, err = store.Query(ctx, "user1", storage.Query{Service: "bit"})
+		assert.NoError(t, err)
+		assert.Equal(t, []uuid.UUID{credentials[1].Uid}, uids(page.Credentials))
+	})
+
+	t.Run("test update credential does not exist", func(t *testing.T) {
+		err := store.Update(ctx, "user1", testCredential("nope", "nope", now))
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("test list users", func(t *testing.T) {
+		users, err := store.Users(ctx)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"user1", "user2"}, users)
+	})
+
+	t.Run("test delete credential", func(t *testing.T) {
+		assert.NoError(t, store.Delete(ctx, "user1", credentials[0].Uid))
+		c, err := store.List(ctx, "user1")
+		assert.NoError(t, err)
+		assert.Len(t, c, len(credentials)-1)
+
+		page, err := store.Query(ctx, "user1", storage.Query{SortBy: storage.SortByUpdatedAt})
+		assert.NoError(t, err)
+		assert.NotContains(t, uids(page.Credentials), credentials[0].Uid)
+	})
+
+	t.Run("test delete all credentials", func(t *testing.T) {
+		assert.NoError(t, store.DeleteAll(ctx, "user1"))
+		c, err := store.List(ctx, "user1")
+		assert.NoError(t, err)
+		assert.Empty(t, c)
+	})
+}
@@ -0,0 +1,247 @@
+package cacher
+
+import (
+	"container/list"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/gofrs/uuid"
+)
+
+const (
+	DefaultTTL      = 5 * time.Minute
+	DefaultMaxItems = 10000
+)
+
+// Stats counts the cache's activity since it was created.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Items     int
+}
+
+// Cacher is an in-process cache of credentials, grouped by user. A user's
+// entry expires TTL after it was first filled and the least recently used
+// users are evicted once more than MaxItems credentials are held. Like the
+// stores, credentials are kept JSON encoded so callers never share maps or
+// slices with the cache.
+type Cacher struct {
+	ttl      time.Duration
+	maxItems int
+	now      func() time.Time
+
+	mu    sync.Mutex
+	lru   *list.List
+	users map[string]*list.Element
+	items int
+	stats Stats
+	// generation is bumped by every invalidation so a read that started
+	// before a write cannot cache what it read after the write.
+	generation uint64
+}
+
+type entry struct {
+	userId  string
+	expires time.Time
+	// listed is set when credentials holds every credential of the user.
+	listed      bool
+	credentials map[uuid.UUID][]byte
+}
+
+func NewCacher(ttl time.Duration, maxItems int) *Cacher {
+	return &Cacher{
+		ttl:      ttl,
+		maxItems: maxItems,
+		now:      time.Now,
+		lru:      list.New(),
+		users:    make(map[string]*list.Element),
+	}
+}
+
+func NewCacherDefault() *Cacher {
+	return NewCacher(DefaultTTL, DefaultMaxItems)
+}
+
+// Get returns a cached credential.
+func (c *Cacher) Get(userId string, credentialUid uuid.UUID) (models.Credential, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var credential models.Credential
+	e := c.entry(userId)
+	if e == nil {
+		c.stats.Misses++
+		return credential, false
+	}
+
+	buf, ok := e.credentials[credentialUid]
+	if !ok || json.Unmarshal(buf, &credential) != nil {
+		c.stats.Misses++
+		return credential, false
+	}
+
+	c.stats.Hits++
+	return credential, true
+}
+
+// List returns every credential of the user, ordered by uid like the stores
+// list them, if they have all been cached by PutList.
+func (c *Cacher) List(userId string) ([]models.Credential, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entry(userId)
+	if e == nil || !e.listed {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	credentials := make([]models.Credential, 0, len(e.credentials))
+	for _, buf := range e.credentials {
+		var credential models.Credential
+		if err := json.Unmarshal(buf, &credential); err != nil {
+			c.stats.Misses++
+			return nil, false
+		}
+		credentials = append(credentials, credential)
+	}
+
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].Uid.String() < credentials[j].Uid.String()
+	})
+
+	c.stats.Hits++
+	return credentials, true
+}
+
+// Generation returns the current generation, which the caller reads before
+// reading the store and passes to Put or PutList.
+func (c *Cacher) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Put caches a single credential of the user unless the cache has been
+// invalidated since generation.
+func (c *Cacher) Put(userId string, credential models.Credential, generation uint64) {
+	buf, err := json.Marshal(credential)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	e := c.entry(userId)
+	if e == nil {
+		e = c.add(userId)
+	}
+
+	if _, ok := e.credentials[credential.Uid]; !ok {
+		c.items++
+	}
+	e.credentials[credential.Uid] = buf
+	c.evict()
+}
+
+// PutList caches every credential of the user, replacing what was cached,
+// unless the cache has been invalidated since generation.
+func (c *Cacher) PutList(userId string, credentials []models.Credential, generation uint64) {
+	encoded := make(map[uuid.UUID][]byte, len(credentials))
+	for i := range credentials {
+		buf, err := json.Marshal(credentials[i])
+		if err != nil {
+			return
+		}
+		encoded[credentials[i].Uid] = buf
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	c.remove(userId)
+	e := c.add(userId)
+	e.listed = true
+	e.credentials = encoded
+	c.items += len(encoded)
+	c.evict()
+}
+
+// Invalidate drops everything cached for the user.
+func (c *Cacher) Invalidate(userId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.remove(userId)
+}
+
+// Stats returns the cache's counters and the number of credentials it holds.
+func (c *Cacher) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.stats
+	s.Items = c.items
+	return s
+}
+
+// entry returns the user's unexpired entry, marking it recently used.
+func (c *Cacher) entry(userId string) *entry {
+	el, ok := c.users[userId]
+	if !ok {
+		return nil
+	}
+
+	e := el.Value.(*entry)
+	if !c.now().Before(e.expires) {
+		c.remove(userId)
+		return nil
+	}
+
+	c.lru.MoveToFront(el)
+	return e
+}
+
+func (c *Cacher) add(userId string) *entry {
+	e := &entry{
+		userId:      userId,
+		expires:     c.now().Add(c.ttl),
+		credentials: make(map[uuid.UUID][]byte),
+	}
+	c.users[userId] = c.lru.PushFront(e)
+	return e
+}
+
+func (c *Cacher) remove(userId string) {
+	el, ok := c.users[userId]
+	if !ok {
+		return
+	}
+
+	c.items -= len(el.Value.(*entry).credentials)
+	c.lru.Remove(el)
+	delete(c.users, userId)
+}
+
+// evict drops the least recently used users until the cache is within its
+// size. The most recently used user is kept even if they alone exceed it.
+func (c *Cacher) evict() {
+	for c.items > c.maxItems && c.lru.Len() > 1 {
+		e := c.lru.Back().Value.(*entry)
+		c.remove(e.userId)
+		c.stats.Evictions++
+	}
+}
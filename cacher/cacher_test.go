@@ -0,0 +1,213 @@
+package cacher
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/brianvoe/gofakeit"
+	"github.com/dbubel/jackstand-api/memory"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func randomCredential() models.Credential {
+	return models.Credential{
+		Uid:      uuid.Must(uuid.NewV4()),
+		Service:  gofakeit.HackerVerb(),
+		Username: gofakeit.BeerAlcohol(),
+		Password: gofakeit.JobLevel(),
+		Metadata: map[string]string{"a": "b"},
+	}
+}
+
+// TestMain runs the tests in America/New_York, where models.CustomTime
+// writes times, so that they are read back as the same instants.
+func TestMain(m *testing.M) {
+	time.Local, _ = time.LoadLocation("America/New_York")
+	os.Exit(m.Run())
+}
+
+// inUTC returns the credentials with their times in UTC, like the ones they
+// were stored from.
+func inUTC(credentials ...models.Credential) []models.Credential {
+	for i := range credentials {
+		credentials[i].CreatedAt = models.CustomTime(time.Time(credentials[i].CreatedAt).UTC())
+		credentials[i].UpdatedAt = models.CustomTime(time.Time(credentials[i].UpdatedAt).UTC())
+	}
+	return credentials
+}
+
+func TestCacher(t *testing.T) {
+	userId := gofakeit.Username()
+	credential := randomCredential()
+
+	t.Run("test get and stats", func(t *testing.T) {
+		c := NewCacherDefault()
+		_, ok := c.Get(userId, credential.Uid)
+		assert.False(t, ok)
+
+		c.Put(userId, credential, c.Generation())
+		got, ok := c.Get(userId, credential.Uid)
+		assert.True(t, ok)
+		assert.Equal(t, credential, inUTC(got)[0])
+
+		got.Metadata["a"] = "changed"
+		got, _ = c.Get(userId, credential.Uid)
+		assert.Equal(t, "b", got.Metadata["a"])
+
+		assert.Equal(t, Stats{Hits: 2, Misses: 1, Items: 1}, c.Stats())
+	})
+
+	t.Run("test list needs put list", func(t *testing.T) {
+		c := NewCacherDefault()
+		c.Put(userId, credential, c.Generation())
+		_, ok := c.List(userId)
+		assert.False(t, ok)
+
+		other := randomCredential()
+		c.PutList(userId, []models.Credential{credential, other}, c.Generation())
+		list, ok := c.List(userId)
+		assert.True(t, ok)
+		assert.Len(t, list, 2)
+		assert.Equal(t, 2, c.Stats().Items)
+	})
+
+	t.Run("test entries expire", func(t *testing.T) {
+		now := time.Now()
+		c := NewCacher(time.Minute, 10)
+		c.now = func() time.Time { return now }
+		c.Put(userId, credential, c.Generation())
+
+		now = now.Add(time.Minute)
+		_, ok := c.Get(userId, credential.Uid)
+		assert.False(t, ok)
+		assert.Equal(t, 0, c.Stats().Items)
+	})
+
+	t.Run("test least recently used users are evicted", func(t *testing.T) {
+		c := NewCacher(time.Minute, 2)
+		c.Put("a", randomCredential(), c.Generation())
+		c.Put("b", randomCredential(), c.Generation())
+		c.List("a")
+		c.Put("c", randomCredential(), c.Generation())
+
+		stats := c.Stats()
+		assert.Equal(t, uint64(1), stats.Evictions)
+		assert.Equal(t, 2, stats.Items)
+		_, ok := c.users["b"]
+		assert.False(t, ok)
+	})
+
+	t.Run("test invalidated reads are not cached", func(t *testing.T) {
+		c := NewCacherDefault()
+		generation := c.Generation()
+		c.Invalidate(userId)
+		c.Put(userId, credential, generation)
+		_, ok := c.Get(userId, credential.Uid)
+		assert.False(t, ok)
+	})
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	backend := memory.NewStore()
+	cache := NewCacherDefault()
+	store := NewStore(backend, cache)
+
+	var reads int
+	backend.SetFaults(memory.Faults{Err: func(op string) error {
+		if op == "Get" || op == "List" {
+			reads++
+		}
+		return nil
+	}})
+
+	credential := randomCredential()
+	assert.NoError(t, store.Create(ctx, userId, credential))
+
+	t.Run("test reads are cached", func(t *testing.T) {
+		reads = 0
+		for i := 0; i < 3; i++ {
+			_, err := store.Get(ctx, userId, credential.Uid)
+			assert.NoError(t, err)
+			_, err = store.List(ctx, userId)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, 2, reads)
+	})
+
+	t.Run("test writes invalidate", func(t *testing.T) {
+		credential.Username = "coffee"
+		assert.NoError(t, store.Update(ctx, userId, credential))
+
+		got, err := store.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, "coffee", got.Username)
+
+		assert.NoError(t, store.Delete(ctx, userId, credential.Uid))
+		list, err := store.List(ctx, userId)
+		assert.NoError(t, err)
+		assert.Empty(t, list)
+	})
+}
+
+// querier is a store that answers queries itself.
+type querier struct {
+	*memory.Store
+	queries int
+}
+
+func (q *querier) Query(ctx context.Context, userId string, query storage.Query) (storage.Page, error) {
+	q.queries++
+	return storage.Filter(ctx, q.Store, userId, query)
+}
+
+func TestStoreQuery(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	credential := randomCredential()
+
+	t.Run("test queries go to a querier until the listing is cached", func(t *testing.T) {
+		backend := &querier{Store: memory.NewStore()}
+		store := NewStore(backend, NewCacherDefault())
+		assert.NoError(t, store.Create(ctx, userId, credential))
+
+		page, err := store.Query(ctx, userId, storage.Query{Service: credential.Service})
+		assert.NoError(t, err)
+		assert.Len(t, page.Credentials, 1)
+		assert.Equal(t, 1, backend.queries)
+
+		_, err = store.List(ctx, userId)
+		assert.NoError(t, err)
+		page, err = store.Query(ctx, userId, storage.Query{Service: credential.Service})
+		assert.NoError(t, err)
+		assert.Len(t, page.Credentials, 1)
+		assert.Equal(t, 1, backend.queries)
+	})
+
+	t.Run("test other stores are listed once", func(t *testing.T) {
+		backend := memory.NewStore()
+		store := NewStore(backend, NewCacherDefault())
+		assert.NoError(t, store.Create(ctx, userId, credential))
+
+		var lists int
+		backend.SetFaults(memory.Faults{Err: func(op string) error {
+			if op == "List" {
+				lists++
+			}
+			return nil
+		}})
+
+		for i := 0; i < 3; i++ {
+			page, err := store.Query(ctx, userId, storage.Query{Service: credential.Service})
+			assert.NoError(t, err)
+			assert.Len(t, page.Credentials, 1)
+		}
+		assert.Equal(t, 1, lists)
+	})
+}
@@ -0,0 +1,97 @@
+package cacher
+
+import (
+	"context"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+)
+
+// Store reads credentials through a Cacher in front of another store and
+// invalidates the user's cached credentials on every write. Metadata is not
+// cached.
+type Store struct {
+	storage.CredentialStore
+	cache *Cacher
+}
+
+func NewStore(store storage.CredentialStore, cache *Cacher) *Store {
+	return &Store{CredentialStore: store, cache: cache}
+}
+
+func (s *Store) Create(ctx context.Context, userId string, credential models.Credential) error {
+	defer s.cache.Invalidate(userId)
+	return s.CredentialStore.Create(ctx, userId, credential)
+}
+
+func (s *Store) Get(ctx context.Context, userId string, credentialUid uuid.UUID) (models.Credential, error) {
+	if credential, ok := s.cache.Get(userId, credentialUid); ok {
+		return credential, nil
+	}
+
+	generation := s.cache.Generation()
+	credential, err := s.CredentialStore.Get(ctx, userId, credentialUid)
+	if err != nil {
+		return credential, err
+	}
+
+	s.cache.Put(userId, credential, generation)
+	return credential, nil
+}
+
+// List serves the user's credentials from the cache, filling it from the
+// underlying store. Partial listings are returned but not cached.
+func (s *Store) List(ctx context.Context, userId string) ([]models.Credential, error) {
+	if credentials, ok := s.cache.List(userId); ok {
+		return credentials, nil
+	}
+
+	generation := s.cache.Generation()
+	credentials, err := s.CredentialStore.List(ctx, userId)
+	if err != nil {
+		return credentials, err
+	}
+
+	s.cache.PutList(userId, credentials, generation)
+	return credentials, nil
+}
+
+// Query filters the cached listing when there is one. Otherwise a store that
+// answers queries itself, like bolt from its indexes, is queried, and the
+// listing of any other store is read once and cached to page through.
+func (s *Store) Query(ctx context.Context, userId string, q storage.Query) (storage.Page, error) {
+	if credentials, ok := s.cache.List(userId); ok {
+		return q.Apply(credentials)
+	}
+
+	if querier, ok := s.CredentialStore.(storage.Querier); ok {
+		return querier.Query(ctx, userId, q)
+	}
+	return storage.Filter(ctx, s, userId, q)
+}
+
+// Search filters the cached listing when there is one and otherwise passes
+// the search on to the underlying store, which may answer it without reading
+// every credential.
+func (s *Store) Search(ctx context.Context, userId string, search storage.Search) ([]models.Credential, error) {
+	if credentials, ok := s.cache.List(userId); ok {
+		return search.Apply(credentials), nil
+	}
+	return storage.RunSearch(ctx, s.CredentialStore, userId, search)
+}
+
+func (s *Store) Update(ctx context.Context, userId string, credential models.Credential) error {
+	defer s.cache.Invalidate(userId)
+	return s.CredentialStore.Update(ctx, userId, credential)
+}
+
+func (s *Store) Delete(ctx context.Context, userId string, credentialUid uuid.UUID) error {
+	defer s.cache.Invalidate(userId)
+	return s.CredentialStore.Delete(ctx, userId, credentialUid)
+}
+
+func (s *Store) DeleteAll(ctx context.Context, userId string) error {
+	defer s.cache.Invalidate(userId)
+	return s.CredentialStore.DeleteAll(ctx, userId)
+}
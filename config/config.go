@@ -1,12 +1,31 @@
 package config
 
+import "time"
+
 type Config struct {
-	Port           int    `default:"4000" envconfig:"PORT"`
-	S3Bucket       string `default:"jackstand-s3-test" envconfig:"S3_BUCKET"`
-	LogLevel       string `default:"info" envconfig:"LOG_LEVEL"`
-	JwtIssuer      string "https://securetoken.google.com/passman-fc9e0"
-	JwtAud         string "passman-fc9e0"
-	PublicKeyUrl   string "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com"
-	FirebaseApiKey string `envconfig:"FIREBASE_API_KEY" required:"true"`
-	FirebaseURL    string `default:"https://www.googleapis.com/identitytoolkit/v3/relyingparty" envconfig:"FIREBASE_URL"`
+	Port                      int           `default:"4000" envconfig:"PORT"`
+	S3Bucket                  string        `default:"jackstand-s3-test" envconfig:"S3_BUCKET"`
+	S3Endpoint                string        `envconfig:"S3_ENDPOINT"`
+	Storage                   string        `default:"s3" envconfig:"STORAGE"`
+	StorageRoot               string        `default:"/var/lib/jackstand" envconfig:"STORAGE_ROOT"`
+	BoltPath                  string        `default:"/var/lib/jackstand/jackstand.db" envconfig:"BOLT_PATH"`
+	ManifestReconcileInterval time.Duration `default:"1h" envconfig:"MANIFEST_RECONCILE_INTERVAL"`
+	CacheTTL                  time.Duration `default:"5m" envconfig:"CACHE_TTL"`
+	CacheMaxItems             int           `default:"10000" envconfig:"CACHE_MAX_ITEMS"`
+	HistoryVersions           int           `default:"10" envconfig:"HISTORY_VERSIONS"`
+	TrashRetention            time.Duration `default:"720h" envconfig:"TRASH_RETENTION"`
+	TrashPurgeInterval        time.Duration `default:"1h" envconfig:"TRASH_PURGE_INTERVAL"`
+	RequireIfMatch            bool          `default:"false" envconfig:"REQUIRE_IF_MATCH"`
+	ExportMaxTokenAge         time.Duration `default:"5m" envconfig:"EXPORT_MAX_TOKEN_AGE"`
+	BulkTimeout               time.Duration `default:"2m" envconfig:"BULK_TIMEOUT"`
+	MasterKey                 string        `envconfig:"MASTER_KEY"`
+	MasterKeyFile             string        `envconfig:"MASTER_KEY_FILE"`
+	PreviousMasterKeys        []string      `envconfig:"PREVIOUS_MASTER_KEYS"`
+	Encryption                string        `default:"full" envconfig:"ENCRYPTION"`
+	LogLevel                  string        `default:"info" envconfig:"LOG_LEVEL"`
+	JwtIssuer                 string        "https://securetoken.google.com/passman-fc9e0"
+	JwtAud                    string        "passman-fc9e0"
+	PublicKeyUrl              string        "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com"
+	FirebaseApiKey            string        `envconfig:"FIREBASE_API_KEY" required:"true"`
+	FirebaseURL               string        `default:"https://www.googleapis.com/identitytoolkit/v3/relyingparty" envconfig:"FIREBASE_URL"`
 }
@@ -0,0 +1,103 @@
+package envelope
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+)
+
+// blindIndex returns the blind index of the normalized values: a keyed hash
+// of each field and value, so equal values can be matched without revealing
+// them.
+func (s *Store) blindIndex(ctx context.Context, userId string, values map[string]string) ([]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	keys, err := s.dataKeys(ctx, userId, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// The index key is derived from the current data key, which stays the
+	// same when the master key is rotated.
+	mac := hmac.New(sha256.New, keys.keys[keys.current])
+	mac.Write([]byte("blind-index"))
+	indexKey := mac.Sum(nil)
+
+	index := make([]string, 0, len(values))
+	for field, value := range values {
+		mac := hmac.New(sha256.New, indexKey)
+		mac.Write([]byte(field + "\x00" + value))
+		index = append(index, hex.EncodeToString(mac.Sum(nil)[:16]))
+	}
+
+	sort.Strings(index)
+	return index, nil
+}
+
+// Search finds credentials by their blind index and decrypts only the
+// matches. Credentials stored before blind indexes were added are decrypted
+// and matched directly.
+func (s *Store) Search(ctx context.Context, userId string, search storage.Search) ([]models.Credential, error) {
+	stored, err := s.CredentialStore.List(ctx, userId)
+	var partial *storage.PartialError
+	if err != nil && !errors.As(err, &partial) {
+		return nil, err
+	}
+
+	if partial == nil {
+		partial = &storage.PartialError{}
+	}
+
+	var tokens []string
+	var matches []models.Credential
+	for i := range stored {
+		indexed := stored[i].BlindIndex != nil
+		if indexed {
+			if tokens == nil {
+				if tokens, err = s.blindIndex(ctx, userId, search.Terms()); err != nil {
+					return nil, err
+				}
+			}
+
+			if !containsAll(stored[i].BlindIndex, tokens) {
+				continue
+			}
+		}
+
+		credential, err := s.openCredential(ctx, userId, stored[i])
+		if err != nil {
+			partial.Failures = append(partial.Failures, storage.Failure{
+				Key: stored[i].Uid.String(),
+				Err: err.Error(),
+			})
+			continue
+		}
+
+		if indexed || search.Match(credential) {
+			matches = append(matches, credential)
+		}
+	}
+
+	if len(partial.Failures) > 0 {
+		return matches, partial
+	}
+	return matches, nil
+}
+
+func containsAll(index, tokens []string) bool {
+	for _, token := range tokens {
+		i := sort.SearchStrings(index, token)
+		if i == len(index) || index[i] != token {
+			return false
+		}
+	}
+	return true
+}
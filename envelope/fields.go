@@ -0,0 +1,120 @@
+package envelope
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/dbubel/jackstand-api/models"
+)
+
+// FieldPrefix starts a field value encrypted by a field store. The rest of
+// the value is the data key id and the base64 encoded nonce and ciphertext,
+// separated by colons.
+const FieldPrefix = "enc:v1:"
+
+// sealFields returns the credential with its password and secret metadata
+// values encrypted, leaving the other fields readable.
+func (s *Store) sealFields(ctx context.Context, userId string, credential models.Credential) (models.Credential, error) {
+	name := "credential/" + credential.Uid.String()
+
+	var err error
+	if credential.Password, err = s.sealField(ctx, userId, name+"/password", credential.Password); err != nil {
+		return models.Credential{}, err
+	}
+
+	if len(credential.Metadata) > 0 {
+		metadata := make(map[string]string, len(credential.Metadata))
+		for key, value := range credential.Metadata {
+			if models.IsSecretMetadata(key) {
+				if value, err = s.sealField(ctx, userId, name+"/metadata/"+key, value); err != nil {
+					return models.Credential{}, err
+				}
+			}
+			metadata[key] = value
+		}
+		credential.Metadata = metadata
+	}
+	return credential, nil
+}
+
+// openFields decrypts the fields sealFields encrypted. Fields stored in
+// plaintext are returned as they are.
+func (s *Store) openFields(ctx context.Context, userId string, credential models.Credential) (models.Credential, error) {
+	name := "credential/" + credential.Uid.String()
+
+	var err error
+	if credential.Password, err = s.openField(ctx, userId, name+"/password", credential.Password); err != nil {
+		return credential, err
+	}
+
+	if len(credential.Metadata) > 0 {
+		metadata := make(map[string]string, len(credential.Metadata))
+		for key, value := range credential.Metadata {
+			if models.IsSecretMetadata(key) {
+				if value, err = s.openField(ctx, userId, name+"/metadata/"+key, value); err != nil {
+					return credential, err
+				}
+			}
+			metadata[key] = value
+		}
+		credential.Metadata = metadata
+	}
+	return credential, nil
+}
+
+// fieldsSealed reports whether every field sealFields encrypts is stored
+// encrypted or empty.
+func fieldsSealed(credential models.Credential) bool {
+	if credential.Password != "" && !strings.HasPrefix(credential.Password, FieldPrefix) {
+		return false
+	}
+
+	for key, value := range credential.Metadata {
+		if models.IsSecretMetadata(key) && value != "" && !strings.HasPrefix(value, FieldPrefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// sealField encrypts a single value. Empty values are kept empty so that
+// validation of a stored credential still sees them as missing.
+func (s *Store) sealField(ctx context.Context, userId, name, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	envelope, err := s.seal(ctx, userId, name, value)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := append(append([]byte{}, envelope.Nonce...), envelope.Ciphertext...)
+	return FieldPrefix + envelope.KeyId + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *Store) openField(ctx context.Context, userId, name, value string) (string, error) {
+	if !strings.HasPrefix(value, FieldPrefix) {
+		// Written before field encryption was enabled.
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, FieldPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed encrypted field %s", name)
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < nonceSize {
+		return "", fmt.Errorf("malformed encrypted field %s", name)
+	}
+
+	var plaintext string
+	envelope := &models.Envelope{KeyId: parts[0], Nonce: sealed[:nonceSize], Ciphertext: sealed[nonceSize:]}
+	if err := s.open(ctx, userId, name, envelope, &plaintext); err != nil {
+		return "", err
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,136 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// KeySize is the size of master and data keys, which are AES-256 keys.
+const KeySize = 32
+
+// nonceSize is the size of the AES-GCM nonces seal prefixes.
+const nonceSize = 12
+
+// ErrUnknownMasterKey is returned when a data key was wrapped with a master
+// key that is not configured.
+var ErrUnknownMasterKey = errors.New("unknown master key")
+
+// MasterKeys are the keys data keys are wrapped with. New data keys are
+// wrapped with the current key, the others are only used to unwrap.
+type MasterKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewMasterKeys returns master keys wrapping with current and unwrapping with
+// current or any of the others.
+func NewMasterKeys(current []byte, others ...[]byte) (*MasterKeys, error) {
+	m := &MasterKeys{keys: make(map[string][]byte)}
+	for _, key := range append([][]byte{current}, others...) {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("master key must be %d bytes, got %d", KeySize, len(key))
+		}
+		m.keys[KeyId(key)] = key
+	}
+
+	m.current = KeyId(current)
+	return m, nil
+}
+
+// KeyId identifies a master key without revealing it.
+func KeyId(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Current returns the id of the key new data keys are wrapped with.
+func (m *MasterKeys) Current() string {
+	return m.current
+}
+
+// Has reports whether the master key with the id is configured.
+func (m *MasterKeys) Has(id string) bool {
+	_, ok := m.keys[id]
+	return ok
+}
+
+// LoadMasterKey decodes a base64 master key given directly or read from a
+// file, returning nil when neither is set.
+func LoadMasterKey(value, file string) ([]byte, error) {
+	if value == "" && file != "" {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading master key file %w", err)
+		}
+		value = string(buf)
+	}
+
+	if value = strings.TrimSpace(value); value == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64 %w", err)
+	}
+	return key, nil
+}
+
+// wrap encrypts a data key with the current master key.
+func (m *MasterKeys) wrap(dataKey, aad []byte) (string, []byte, error) {
+	wrapped, err := seal(m.keys[m.current], dataKey, aad)
+	return m.current, wrapped, err
+}
+
+// unwrap decrypts a data key wrapped with the master key id.
+func (m *MasterKeys) unwrap(id string, wrapped, aad []byte) ([]byte, error) {
+	key, ok := m.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownMasterKey, id)
+	}
+	return open(key, wrapped, aad)
+}
+
+// seal encrypts plaintext with AES-GCM, prefixing the random nonce.
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open decrypts what seal encrypted.
+func open(key, sealed, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,601 @@
+package envelope
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+)
+
+// KeysName is the metadata document holding a user's wrapped data keys. It is
+// stored as is and hidden from the Store's callers.
+const KeysName = "keys"
+
+// ErrReservedName is returned for metadata names the Store keeps for itself.
+var ErrReservedName = errors.New("reserved metadata name")
+
+// UserKeys are a user's data keys, each wrapped with a master key.
+type UserKeys struct {
+	Current string       `json:"current"`
+	Keys    []WrappedKey `json:"keys"`
+}
+
+type WrappedKey struct {
+	Id          string            `json:"id"`
+	MasterKeyId string            `json:"masterKeyId"`
+	Wrapped     []byte            `json:"wrapped"`
+	CreatedAt   models.CustomTime `json:"createdAt"`
+}
+
+// sealedDocument is how an encrypted metadata document is stored.
+type sealedDocument struct {
+	Envelope *models.Envelope `json:"envelope"`
+}
+
+// Store encrypts credentials and metadata documents before handing them to
+// another store and decrypts them on the way back. Each user's documents are
+// encrypted with AES-GCM under a per-user data key, which is stored next to
+// them wrapped with a master key. Credentials and documents written before
+// encryption was enabled are read as they are and encrypted when next
+// written.
+//
+// Only the uid and timestamps of an encrypted credential are visible to the
+// underlying store, so it is filtered and sorted after decrypting rather than
+// by the store's own indexes.
+//
+// A Store created with NewFieldStore encrypts only the password and secret
+// metadata values of credentials, each on its own, and leaves the rest
+// readable so the underlying store can still answer queries. Metadata
+// documents are encrypted whole either way, since they hold past versions of
+// credentials.
+type Store struct {
+	storage.CredentialStore
+	master *MasterKeys
+	fields bool
+
+	// load serialises loading and creating data keys.
+	load sync.Mutex
+	mu   sync.RWMutex
+	keys map[string]*dataKeys
+}
+
+// dataKeys are a user's unwrapped data keys.
+type dataKeys struct {
+	current string
+	keys    map[string][]byte
+	// fresh is set for a data key this process created until a document
+	// sealed with it is written and the key is found still stored.
+	fresh bool
+}
+
+func NewStore(store storage.CredentialStore, master *MasterKeys) *Store {
+	return &Store{
+		CredentialStore: store,
+		master:          master,
+		keys:            make(map[string]*dataKeys),
+	}
+}
+
+// NewFieldStore returns a Store that only encrypts the secret fields of
+// credentials, see Store.
+func NewFieldStore(store storage.CredentialStore, master *MasterKeys) *Store {
+	s := NewStore(store, master)
+	s.fields = true
+	return s
+}
+
+func (s *Store) Create(ctx context.Context, userId string, credential models.Credential) error {
+	create := s.CredentialStore.Create
+	return s.writeSealed(ctx, userId, func() error {
+		sealed, err := s.sealCredential(ctx, userId, credential)
+		if err != nil {
+			return err
+		}
+
+		err = create(ctx, userId, sealed)
+		// A retry replaces what the first attempt created.
+		create = s.CredentialStore.Update
+		return err
+	})
+}
+
+func (s *Store) Get(ctx context.Context, userId string, credentialUid uuid.UUID) (models.Credential, error) {
+	credential, err := s.CredentialStore.Get(ctx, userId, credentialUid)
+	if err != nil {
+		return credential, err
+	}
+	return s.openCredential(ctx, userId, credential)
+}
+
+// List decrypts the user's credentials. Credentials that cannot be decrypted
+// are left out and reported in a *storage.PartialError like unreadable ones.
+func (s *Store) List(ctx context.Context, userId string) ([]models.Credential, error) {
+	credentials, err := s.CredentialStore.List(ctx, userId)
+	var partial *storage.PartialError
+	if err != nil && !errors.As(err, &partial) {
+		return nil, err
+	}
+
+	if partial == nil {
+		partial = &storage.PartialError{}
+	}
+
+	opened := credentials[:0]
+	for i := range credentials {
+		credential, err := s.openCredential(ctx, userId, credentials[i])
+		if err != nil {
+			partial.Failures = append(partial.Failures, storage.Failure{
+				Key: credentials[i].Uid.String(),
+				Err: err.Error(),
+			})
+			continue
+		}
+		opened = append(opened, credential)
+	}
+
+	if len(partial.Failures) > 0 {
+		return opened, partial
+	}
+	return opened, nil
+}
+
+// Query filters the decrypted credentials, see Store. A field store passes
+// the query on to the underlying store and decrypts the page it returns.
+func (s *Store) Query(ctx context.Context, userId string, q storage.Query) (storage.Page, error) {
+	if !s.fields {
+		return storage.Filter(ctx, s, userId, q)
+	}
+
+	page, err := storage.Run(ctx, s.CredentialStore, userId, q)
+	var partial *storage.PartialError
+	if err != nil && !errors.As(err, &partial) {
+		return storage.Page{}, err
+	}
+
+	if partial == nil {
+		partial = &storage.PartialError{}
+	}
+
+	opened := page.Credentials[:0]
+	for i := range page.Credentials {
+		credential, err := s.openCredential(ctx, userId, page.Credentials[i])
+		if err != nil {
+			partial.Failures = append(partial.Failures, storage.Failure{
+				Key: page.Credentials[i].Uid.String(),
+				Err: err.Error(),
+			})
+			continue
+		}
+		opened = append(opened, credential)
+	}
+
+	page.Credentials = opened
+	if len(partial.Failures) > 0 {
+		return page, partial
+	}
+	return page, nil
+}
+
+func (s *Store) Update(ctx context.Context, userId string, credential models.Credential) error {
+	return s.writeSealed(ctx, userId, func() error {
+		sealed, err := s.sealCredential(ctx, userId, credential)
+		if err != nil {
+			return err
+		}
+		return s.CredentialStore.Update(ctx, userId, sealed)
+	})
+}
+
+func (s *Store) GetMetadata(ctx context.Context, userId, name string, v interface{}) error {
+	if name == KeysName {
+		return ErrReservedName
+	}
+
+	var raw json.RawMessage
+	if err := s.CredentialStore.GetMetadata(ctx, userId, name, &raw); err != nil {
+		return err
+	}
+
+	var doc sealedDocument
+	if err := json.Unmarshal(raw, &doc); err != nil || doc.Envelope == nil {
+		// Written before encryption was enabled.
+		return json.Unmarshal(raw, v)
+	}
+	return s.open(ctx, userId, "metadata/"+name, doc.Envelope, v)
+}
+
+func (s *Store) PutMetadata(ctx context.Context, userId, name string, v interface{}) error {
+	if name == KeysName {
+		return ErrReservedName
+	}
+
+	return s.writeSealed(ctx, userId, func() error {
+		envelope, err := s.seal(ctx, userId, "metadata/"+name, v)
+		if err != nil {
+			return err
+		}
+		return s.CredentialStore.PutMetadata(ctx, userId, name, sealedDocument{Envelope: envelope})
+	})
+}
+
+func (s *Store) DeleteMetadata(ctx context.Context, userId, name string) error {
+	if name == KeysName {
+		return ErrReservedName
+	}
+	return s.CredentialStore.DeleteMetadata(ctx, userId, name)
+}
+
+func (s *Store) ListMetadata(ctx context.Context, userId, prefix string) ([]string, error) {
+	names, err := s.CredentialStore.ListMetadata(ctx, userId, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := names[:0]
+	for i := range names {
+		if names[i] != KeysName {
+			kept = append(kept, names[i])
+		}
+	}
+	return kept, nil
+}
+
+// sealCredential returns the credential as it is stored: its uid, timestamps
+// and everything else encrypted, or only its secret fields for a field store.
+func (s *Store) sealCredential(ctx context.Context, userId string, credential models.Credential) (models.Credential, error) {
+	credential.Envelope = nil
+	credential.BlindIndex = nil
+	index, err := s.blindIndex(ctx, userId, storage.SearchValues(credential))
+	if err != nil {
+		return models.Credential{}, err
+	}
+
+	if s.fields {
+		sealed, err := s.sealFields(ctx, userId, credential)
+		if err != nil {
+			return models.Credential{}, err
+		}
+
+		sealed.BlindIndex = index
+		return sealed, nil
+	}
+
+	envelope, err := s.seal(ctx, userId, "credential/"+credential.Uid.String(), credential)
+	if err != nil {
+		return models.Credential{}, err
+	}
+
+	return models.Credential{
+		Uid:        credential.Uid,
+		CreatedAt:  credential.CreatedAt,
+		UpdatedAt:  credential.UpdatedAt,
+		BlindIndex: index,
+		Envelope:   envelope,
+	}, nil
+}
+
+func (s *Store) openCredential(ctx context.Context, userId string, stored models.Credential) (models.Credential, error) {
+	stored.BlindIndex = nil
+	if stored.Envelope == nil {
+		// Written before encryption was enabled or by a field store.
+		return s.openFields(ctx, userId, stored)
+	}
+
+	var credential models.Credential
+	if err := s.open(ctx, userId, "credential/"+stored.Uid.String(), stored.Envelope, &credential); err != nil {
+		return credential, err
+	}
+
+	// The uid is authenticated as part of the additional data, so a sealed
+	// body copied onto another credential fails to open.
+	credential.Uid = stored.Uid
+	return credential, nil
+}
+
+// sealed reports whether a credential is stored the way the Store writes it.
+func (s *Store) sealed(stored models.Credential) bool {
+	if s.fields {
+		return stored.Envelope == nil && fieldsSealed(stored)
+	}
+	return stored.Envelope != nil
+}
+
+// Encrypt rewrites every credential and metadata document of the user that
+// is not stored the way the Store writes it, reporting how many it rewrote.
+// It encrypts what was stored before encryption was enabled, converts
+// between whole and field encryption and adds missing blind indexes.
+// Encrypting a user again does nothing.
+func (s *Store) Encrypt(ctx context.Context, userId string) (int, error) {
+	credentials, err := s.CredentialStore.List(ctx, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	var encrypted int
+	for i := range credentials {
+		sealed := s.sealed(credentials[i])
+		if sealed && credentials[i].BlindIndex != nil {
+			continue
+		}
+
+		credential, err := s.openCredential(ctx, userId, credentials[i])
+		if err != nil {
+			return encrypted, err
+		}
+
+		if sealed {
+			// Only rewrite it if it has something to index.
+			if index, err := s.blindIndex(ctx, userId, storage.SearchValues(credential)); err != nil {
+				return encrypted, err
+			} else if index == nil {
+				continue
+			}
+		}
+
+		if err := s.Update(ctx, userId, credential); err != nil {
+			return encrypted, err
+		}
+		encrypted++
+	}
+
+	names, err := s.ListMetadata(ctx, userId, "")
+	if err != nil {
+		return encrypted, err
+	}
+
+	for _, name := range names {
+		var raw json.RawMessage
+		if err := s.CredentialStore.GetMetadata(ctx, userId, name, &raw); err != nil {
+			return encrypted, err
+		}
+
+		var doc sealedDocument
+		if err := json.Unmarshal(raw, &doc); err == nil && doc.Envelope != nil {
+			continue
+		}
+
+		if err := s.PutMetadata(ctx, userId, name, raw); err != nil {
+			return encrypted, err
+		}
+		encrypted++
+	}
+	return encrypted, nil
+}
+
+// seal encrypts v under the user's current data key. The user id and the
+// document's name are authenticated so a sealed document cannot be passed off
+// as another.
+func (s *Store) seal(ctx context.Context, userId, name string, v interface{}) (*models.Envelope, error) {
+	keys, err := s.dataKeys(ctx, userId, "")
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := seal(keys.keys[keys.current], plaintext, additionalData(userId, keys.current, name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.Envelope{
+		KeyId:      keys.current,
+		Nonce:      sealed[:nonceSize],
+		Ciphertext: sealed[nonceSize:],
+	}, nil
+}
+
+func (s *Store) open(ctx context.Context, userId, name string, envelope *models.Envelope, v interface{}) error {
+	keys, err := s.dataKeys(ctx, userId, envelope.KeyId)
+	if err != nil {
+		return err
+	}
+
+	key, ok := keys.keys[envelope.KeyId]
+	if !ok {
+		return fmt.Errorf("unknown data key %s", envelope.KeyId)
+	}
+
+	sealed := append(append([]byte{}, envelope.Nonce...), envelope.Ciphertext...)
+	plaintext, err := open(key, sealed, additionalData(userId, envelope.KeyId, name))
+	if err != nil {
+		return fmt.Errorf("error decrypting %s %w", name, err)
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+// dataKeys returns the user's unwrapped data keys, loading them if they are
+// not cached or do not include keyId, and creating the first data key of a
+// user that has none.
+func (s *Store) dataKeys(ctx context.Context, userId, keyId string) (*dataKeys, error) {
+	if keys, ok := s.cached(userId, keyId); ok {
+		return keys, nil
+	}
+
+	s.load.Lock()
+	defer s.load.Unlock()
+
+	if keys, ok := s.cached(userId, keyId); ok {
+		return keys, nil
+	}
+
+	var stored UserKeys
+	var created bool
+	err := s.CredentialStore.GetMetadata(ctx, userId, KeysName, &stored)
+	if errors.Is(err, storage.ErrNotFound) {
+		if keyId != "" {
+			return nil, fmt.Errorf("unknown data key %s", keyId)
+		}
+		stored, created, err = s.createDataKey(ctx, userId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &dataKeys{current: stored.Current, keys: make(map[string][]byte), fresh: created}
+	for _, wrapped := range stored.Keys {
+		key, err := s.master.unwrap(wrapped.MasterKeyId, wrapped.Wrapped, additionalData(userId, wrapped.Id, KeysName))
+		if err != nil {
+			return nil, fmt.Errorf("error unwrapping data key %s %w", wrapped.Id, err)
+		}
+		keys.keys[wrapped.Id] = key
+	}
+
+	s.mu.Lock()
+	s.keys[userId] = keys
+	s.mu.Unlock()
+	return keys, nil
+}
+
+// Rewrap wraps every data key of the user that is wrapped with an older
+// master key with the current one instead, reporting how many it rewrapped.
+// The data keys themselves are unchanged, so nothing they encrypt has to be
+// rewritten, and rewrapping a user again does nothing.
+func (s *Store) Rewrap(ctx context.Context, userId string) (int, error) {
+	s.load.Lock()
+	defer s.load.Unlock()
+
+	var stored UserKeys
+	err := s.CredentialStore.GetMetadata(ctx, userId, KeysName, &stored)
+	if errors.Is(err, storage.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var rewrapped int
+	for i, wrapped := range stored.Keys {
+		if wrapped.MasterKeyId == s.master.Current() {
+			continue
+		}
+
+		aad := additionalData(userId, wrapped.Id, KeysName)
+		key, err := s.master.unwrap(wrapped.MasterKeyId, wrapped.Wrapped, aad)
+		if err != nil {
+			return 0, fmt.Errorf("error unwrapping data key %s %w", wrapped.Id, err)
+		}
+
+		stored.Keys[i].MasterKeyId, stored.Keys[i].Wrapped, err = s.master.wrap(key, aad)
+		if err != nil {
+			return 0, err
+		}
+		rewrapped++
+	}
+
+	if rewrapped == 0 {
+		return 0, nil
+	}
+	return rewrapped, s.CredentialStore.PutMetadata(ctx, userId, KeysName, stored)
+}
+
+func (s *Store) cached(userId, keyId string) (*dataKeys, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys, ok := s.keys[userId]
+	if !ok {
+		return nil, false
+	}
+
+	if keyId == "" {
+		return keys, true
+	}
+
+	_, ok = keys.keys[keyId]
+	return keys, ok
+}
+
+// createDataKey generates the user's first data key and stores it wrapped
+// with the current master key. The storage has no conditional writes, so
+// another instance creating the user's first key at the same time can
+// overwrite it: the keys are read back after writing and whichever key is
+// stored is returned, reporting whether it is the one created here. A key
+// overwritten after that is caught by writeSealed.
+func (s *Store) createDataKey(ctx context.Context, userId string) (UserKeys, bool, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return UserKeys{}, false, err
+	}
+
+	id := uuid.Must(uuid.NewV4()).String()
+	masterKeyId, wrapped, err := s.master.wrap(key, additionalData(userId, id, KeysName))
+	if err != nil {
+		return UserKeys{}, false, err
+	}
+
+	keys := UserKeys{
+		Current: id,
+		Keys: []WrappedKey{{
+			Id:          id,
+			MasterKeyId: masterKeyId,
+			Wrapped:     wrapped,
+			CreatedAt:   models.CustomTime(time.Now()),
+		}},
+	}
+	if err := s.CredentialStore.PutMetadata(ctx, userId, KeysName, keys); err != nil {
+		return UserKeys{}, false, err
+	}
+
+	var stored UserKeys
+	if err := s.CredentialStore.GetMetadata(ctx, userId, KeysName, &stored); err != nil {
+		return UserKeys{}, false, err
+	}
+	return stored, stored.Current == id, nil
+}
+
+// writeSealed runs write, which seals a document of the user and writes it.
+// When the document was sealed with a data key this process just created,
+// the stored keys are read back afterwards, and should another instance have
+// replaced the key in the meantime the document is sealed again with the
+// stored key and written again, so it never stays sealed with a lost key.
+func (s *Store) writeSealed(ctx context.Context, userId string, write func() error) error {
+	for {
+		keys, err := s.dataKeys(ctx, userId, "")
+		if err != nil {
+			return err
+		}
+
+		if err := write(); err != nil {
+			return err
+		}
+
+		s.mu.RLock()
+		fresh := keys.fresh
+		s.mu.RUnlock()
+		if !fresh {
+			return nil
+		}
+
+		var stored UserKeys
+		if err := s.CredentialStore.GetMetadata(ctx, userId, KeysName, &stored); err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		if stored.Current == keys.current {
+			keys.fresh = false
+		} else if s.keys[userId] == keys {
+			delete(s.keys, userId)
+		}
+		s.mu.Unlock()
+
+		if stored.Current == keys.current {
+			return nil
+		}
+	}
+}
+
+func additionalData(userId, keyId, name string) []byte {
+	return []byte(userId + "\x00" + keyId + "\x00" + name)
+}
@@ -0,0 +1,403 @@
+package envelope
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianvoe/gofakeit"
+	"github.com/dbubel/jackstand-api/memory"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func randomKey(t *testing.T) []byte {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+	return key
+}
+
+func randomCredential() models.Credential {
+	return models.Credential{
+		Uid:      uuid.Must(uuid.NewV4()),
+		Service:  gofakeit.HackerVerb(),
+		Username: gofakeit.BeerAlcohol(),
+		Password: gofakeit.JobLevel(),
+		Metadata: map[string]string{"pin": "1234"},
+	}
+}
+
+// TestMain runs the tests in America/New_York, where models.CustomTime
+// writes times, so that they are read back as the same instants.
+func TestMain(m *testing.M) {
+	time.Local, _ = time.LoadLocation("America/New_York")
+	os.Exit(m.Run())
+}
+
+// inUTC returns the credentials with their times in UTC, like the ones they
+// were stored from.
+func inUTC(credentials ...models.Credential) []models.Credential {
+	for i := range credentials {
+		credentials[i].CreatedAt = models.CustomTime(time.Time(credentials[i].CreatedAt).UTC())
+		credentials[i].UpdatedAt = models.CustomTime(time.Time(credentials[i].UpdatedAt).UTC())
+	}
+	return credentials
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	backend := memory.NewStore()
+	master, err := NewMasterKeys(randomKey(t))
+	assert.NoError(t, err)
+	store := NewStore(backend, master)
+
+	credential := randomCredential()
+	assert.NoError(t, store.Create(ctx, userId, credential))
+
+	t.Run("test credentials are stored encrypted", func(t *testing.T) {
+		stored, err := backend.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.NotNil(t, stored.Envelope)
+		assert.Empty(t, stored.Password)
+		assert.Empty(t, stored.Service)
+		assert.Nil(t, stored.Metadata)
+
+		got, err := store.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, credential, inUTC(got)[0])
+
+		list, err := store.List(ctx, userId)
+		assert.NoError(t, err)
+		assert.Equal(t, []models.Credential{credential}, inUTC(list...))
+	})
+
+	t.Run("test plaintext credentials are still read", func(t *testing.T) {
+		plain := randomCredential()
+		plain.Username = "plain-" + plain.Uid.String()
+		assert.NoError(t, backend.Create(ctx, userId, plain))
+
+		got, err := store.Get(ctx, userId, plain.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, plain, inUTC(got)[0])
+
+		assert.NoError(t, store.Update(ctx, userId, got))
+		stored, err := backend.Get(ctx, userId, plain.Uid)
+		assert.NoError(t, err)
+		assert.NotNil(t, stored.Envelope)
+	})
+
+	t.Run("test metadata is stored encrypted", func(t *testing.T) {
+		doc := map[string]string{"secret": "coffee"}
+		assert.NoError(t, store.PutMetadata(ctx, userId, "history/x", doc))
+
+		var raw json.RawMessage
+		assert.NoError(t, backend.GetMetadata(ctx, userId, "history/x", &raw))
+		assert.NotContains(t, string(raw), "coffee")
+
+		var got map[string]string
+		assert.NoError(t, store.GetMetadata(ctx, userId, "history/x", &got))
+		assert.Equal(t, doc, got)
+
+		names, err := store.ListMetadata(ctx, userId, "")
+		assert.NoError(t, err)
+		assert.NotContains(t, names, KeysName)
+
+		assert.ErrorIs(t, store.PutMetadata(ctx, userId, KeysName, doc), ErrReservedName)
+	})
+
+	t.Run("test sealed bodies cannot be moved", func(t *testing.T) {
+		stored, err := backend.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+
+		stored.Uid = uuid.Must(uuid.NewV4())
+		assert.NoError(t, backend.Create(ctx, userId, stored))
+		_, err = store.Get(ctx, userId, stored.Uid)
+		assert.Error(t, err)
+
+		list, err := store.List(ctx, userId)
+		var partial *storage.PartialError
+		assert.True(t, errors.As(err, &partial))
+		assert.Len(t, partial.Failures, 1)
+		assert.Len(t, list, 2)
+		assert.NoError(t, backend.Delete(ctx, userId, stored.Uid))
+	})
+
+	t.Run("test other master keys cannot read", func(t *testing.T) {
+		other, err := NewMasterKeys(randomKey(t))
+		assert.NoError(t, err)
+		_, err = NewStore(backend, other).Get(ctx, userId, credential.Uid)
+		assert.ErrorIs(t, err, ErrUnknownMasterKey)
+	})
+
+	t.Run("test previous master keys still unwrap", func(t *testing.T) {
+		current, err := LoadMasterKey(base64.StdEncoding.EncodeToString(randomKey(t)), "")
+		assert.NoError(t, err)
+
+		previous := master.keys[master.Current()]
+		both, err := NewMasterKeys(current, previous)
+		assert.NoError(t, err)
+
+		got, err := NewStore(backend, both).Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, credential, inUTC(got)[0])
+	})
+}
+
+// raceStore runs race once, right after the first credential is created,
+// to let another instance step in between the write and what follows it.
+type raceStore struct {
+	*memory.Store
+	race func()
+}
+
+func (s *raceStore) Create(ctx context.Context, userId string, credential models.Credential) error {
+	err := s.Store.Create(ctx, userId, credential)
+	if race := s.race; race != nil {
+		s.race = nil
+		race()
+	}
+	return err
+}
+
+func TestDataKeyRace(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	backend := memory.NewStore()
+	master, err := NewMasterKeys(randomKey(t))
+	assert.NoError(t, err)
+
+	// Another instance creates the user's first data key too, overwriting
+	// the one the first credential was just sealed with.
+	other := NewStore(backend, master)
+	second := randomCredential()
+	store := NewStore(&raceStore{Store: backend, race: func() {
+		assert.NoError(t, backend.DeleteMetadata(ctx, userId, KeysName))
+		assert.NoError(t, other.Create(ctx, userId, second))
+	}}, master)
+
+	first := randomCredential()
+	assert.NoError(t, store.Create(ctx, userId, first))
+
+	var stored UserKeys
+	assert.NoError(t, backend.GetMetadata(ctx, userId, KeysName, &stored))
+	assert.Len(t, stored.Keys, 1)
+
+	// Both credentials open with the stored key, in a process that has none
+	// of them cached.
+	fresh := NewStore(backend, master)
+	got, err := fresh.List(ctx, userId)
+	assert.NoError(t, err)
+	assert.Len(t, got, 2)
+
+	c, err := fresh.Get(ctx, userId, first.Uid)
+	assert.NoError(t, err)
+	assert.Equal(t, first.Password, c.Password)
+
+	// Later writes go on with the stored key without reading it back.
+	assert.NoError(t, store.Update(ctx, userId, first))
+	assert.NoError(t, backend.GetMetadata(ctx, userId, KeysName, &stored))
+	assert.Len(t, stored.Keys, 1)
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	key, err := LoadMasterKey("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+
+	file := filepath.Join(t.TempDir(), "master.key")
+	encoded := base64.StdEncoding.EncodeToString(randomKey(t))
+	assert.NoError(t, ioutil.WriteFile(file, []byte(encoded+"\n"), 0600))
+
+	key, err = LoadMasterKey("", file)
+	assert.NoError(t, err)
+	assert.Len(t, key, KeySize)
+
+	_, err = NewMasterKeys([]byte("short"))
+	assert.Error(t, err)
+
+	_, err = LoadMasterKey("not base64!", "")
+	assert.Error(t, err)
+}
+
+func TestRewrap(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	backend := memory.NewStore()
+	oldKey, newKey := randomKey(t), randomKey(t)
+
+	old, err := NewMasterKeys(oldKey)
+	assert.NoError(t, err)
+	credential := randomCredential()
+	assert.NoError(t, NewStore(backend, old).Create(ctx, userId, credential))
+
+	both, err := NewMasterKeys(newKey, oldKey)
+	assert.NoError(t, err)
+	store := NewStore(backend, both)
+
+	n, err := store.Rewrap(ctx, userId)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = store.Rewrap(ctx, userId)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = store.Rewrap(ctx, gofakeit.Username())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Once rewrapped the old master key is no longer needed.
+	current, err := NewMasterKeys(newKey)
+	assert.NoError(t, err)
+	got, err := NewStore(backend, current).Get(ctx, userId, credential.Uid)
+	assert.NoError(t, err)
+	assert.Equal(t, credential, inUTC(got)[0])
+
+	_, err = NewStore(backend, old).Get(ctx, userId, credential.Uid)
+	assert.ErrorIs(t, err, ErrUnknownMasterKey)
+}
+
+func TestFieldStore(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	backend := memory.NewStore()
+	master, err := NewMasterKeys(randomKey(t))
+	assert.NoError(t, err)
+	store := NewFieldStore(backend, master)
+
+	credential := randomCredential()
+	credential.Metadata["secret:pin"] = "4321"
+	assert.NoError(t, store.Create(ctx, userId, credential))
+
+	t.Run("test only secret fields are stored encrypted", func(t *testing.T) {
+		stored, err := backend.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.Nil(t, stored.Envelope)
+		assert.Equal(t, credential.Service, stored.Service)
+		assert.Equal(t, credential.Username, stored.Username)
+		assert.Equal(t, "1234", stored.Metadata["pin"])
+		assert.True(t, strings.HasPrefix(stored.Password, FieldPrefix))
+		assert.True(t, strings.HasPrefix(stored.Metadata["secret:pin"], FieldPrefix))
+
+		got, err := store.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, credential, inUTC(got)[0])
+	})
+
+	t.Run("test queries are answered by the underlying store", func(t *testing.T) {
+		page, err := store.Query(ctx, userId, storage.Query{Service: credential.Service})
+		assert.NoError(t, err)
+		assert.Equal(t, []models.Credential{credential}, inUTC(page.Credentials...))
+	})
+
+	t.Run("test sealed fields cannot be moved", func(t *testing.T) {
+		stored, err := backend.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+
+		stored.Uid = uuid.Must(uuid.NewV4())
+		assert.NoError(t, backend.Create(ctx, userId, stored))
+		_, err = store.Get(ctx, userId, stored.Uid)
+		assert.Error(t, err)
+		assert.NoError(t, backend.Delete(ctx, userId, stored.Uid))
+	})
+
+	t.Run("test whole encryption reads field encrypted credentials", func(t *testing.T) {
+		got, err := NewStore(backend, master).Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, credential, inUTC(got)[0])
+	})
+}
+
+func TestEncrypt(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	backend := memory.NewStore()
+	master, err := NewMasterKeys(randomKey(t))
+	assert.NoError(t, err)
+
+	credential := randomCredential()
+	assert.NoError(t, backend.Create(ctx, userId, credential))
+	assert.NoError(t, backend.PutMetadata(ctx, userId, "history/x", map[string]string{"password": "coffee"}))
+
+	fields := NewFieldStore(backend, master)
+	n, err := fields.Encrypt(ctx, userId)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	stored, err := backend.Get(ctx, userId, credential.Uid)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.Password, FieldPrefix))
+
+	var raw json.RawMessage
+	assert.NoError(t, backend.GetMetadata(ctx, userId, "history/x", &raw))
+	assert.NotContains(t, string(raw), "coffee")
+
+	n, err = fields.Encrypt(ctx, userId)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Switching to whole encryption converts the credential.
+	whole := NewStore(backend, master)
+	n, err = whole.Encrypt(ctx, userId)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	stored, err = backend.Get(ctx, userId, credential.Uid)
+	assert.NoError(t, err)
+	assert.NotNil(t, stored.Envelope)
+
+	got, err := whole.Get(ctx, userId, credential.Uid)
+	assert.NoError(t, err)
+	assert.Equal(t, credential, inUTC(got)[0])
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	backend := memory.NewStore()
+	master, err := NewMasterKeys(randomKey(t))
+	assert.NoError(t, err)
+
+	for _, store := range []*Store{NewStore(backend, master), NewFieldStore(backend, master)} {
+		assert.NoError(t, backend.DeleteAll(ctx, userId))
+
+		credential := randomCredential()
+		credential.Service = "GitHub"
+		credential.Metadata["url"] = "https://www.github.com/login"
+		assert.NoError(t, store.Create(ctx, userId, credential))
+		assert.NoError(t, store.Create(ctx, userId, randomCredential()))
+
+		stored, err := backend.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.Len(t, stored.BlindIndex, 3)
+		assert.NotContains(t, strings.Join(stored.BlindIndex, ""), "github")
+
+		got, err := store.Search(ctx, userId, storage.Search{Service: " github ", URL: "github.com"})
+		assert.NoError(t, err)
+		assert.Equal(t, []models.Credential{credential}, inUTC(got...))
+
+		got, err = store.Search(ctx, userId, storage.Search{Service: "git"})
+		assert.NoError(t, err)
+		assert.Empty(t, got)
+
+		// Credentials stored before blind indexes are matched directly.
+		plain := randomCredential()
+		plain.Username = "plain-" + plain.Uid.String()
+		assert.NoError(t, backend.Create(ctx, userId, plain))
+		got, err = store.Search(ctx, userId, storage.Search{Username: plain.Username})
+		assert.NoError(t, err)
+		assert.Equal(t, []models.Credential{plain}, inUTC(got...))
+	}
+}
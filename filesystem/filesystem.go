@@ -0,0 +1,457 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Store is a storage.CredentialStore that keeps each credential as a JSON file
+// under <root>/users/<userId>/<credentialUid>, the same layout the S3 store
+// uses for object keys. Each user directory is guarded by a lock held both
+// within the process and, through flock on <root>/locks/<userId>, against
+// other processes sharing the root, like the CLI commands.
+type Store struct {
+	log  *logrus.Logger
+	root string
+
+	mu    sync.Mutex
+	locks map[string]*dirLock
+}
+
+// dirLock is a user directory's lock and the number of callers holding or
+// waiting for it, so it can be dropped when there are none.
+type dirLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func NewStore(log *logrus.Logger, root string) (*Store, error) {
+	for _, dir := range []string{"users", "locks"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			return nil, fmt.Errorf("error creating storage root %w", err)
+		}
+	}
+
+	return &Store{
+		log:   log,
+		root:  root,
+		locks: make(map[string]*dirLock),
+	}, nil
+}
+
+func (s *Store) Create(ctx context.Context, userId string, credential models.Credential) error {
+	dir, err := s.userDir(userId)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock(dir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	return s.write(dir, credential)
+}
+
+func (s *Store) Get(ctx context.Context, userId string, credentialUid uuid.UUID) (models.Credential, error) {
+	dir, err := s.userDir(userId)
+	if err != nil {
+		return models.Credential{}, err
+	}
+
+	unlock, err := s.lock(dir, false)
+	if err != nil {
+		return models.Credential{}, err
+	}
+	defer unlock()
+
+	return s.read(filepath.Join(dir, credentialUid.String()))
+}
+
+func (s *Store) List(ctx context.Context, userId string) ([]models.Credential, error) {
+	dir, err := s.userDir(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := s.lock(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	files, err := credentialFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := make([]models.Credential, 0, len(files))
+	for i := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		credential, err := s.read(filepath.Join(dir, files[i]))
+		if err != nil {
+			return nil, fmt.Errorf("error reading credential in list %w", err)
+		}
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, nil
+}
+
+func (s *Store) Update(ctx context.Context, userId string, credential models.Credential) error {
+	dir, err := s.userDir(userId)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock(dir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(filepath.Join(dir, credential.Uid.String())); err != nil {
+		if os.IsNotExist(err) {
+			return storage.ErrNotFound
+		}
+		return err
+	}
+
+	return s.write(dir, credential)
+}
+
+func (s *Store) Delete(ctx context.Context, userId string, credentialUid uuid.UUID) error {
+	dir, err := s.userDir(userId)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock(dir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s.log.WithFields(logrus.Fields{"dir": dir, "credentialUid": credentialUid}).Debug("filesystem delete")
+	if err := os.Remove(filepath.Join(dir, credentialUid.String())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func (s *Store) DeleteAll(ctx context.Context, userId string) error {
+	dir, err := s.userDir(userId)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock(dir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	files, err := credentialFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	for i := range files {
+		if err := os.Remove(filepath.Join(dir, files[i])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return syncDir(dir)
+}
+
+func (s *Store) Users(ctx context.Context) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.root, "users"))
+	if err != nil {
+		return nil, err
+	}
+
+	var users []string
+	for i := range entries {
+		if entries[i].IsDir() {
+			users = append(users, entries[i].Name())
+		}
+	}
+	return users, nil
+}
+
+// Metadata documents live next to the credentials as _<name>.json, so a
+// name like history/<uid> becomes the file _history/<uid>.json.
+func (s *Store) GetMetadata(ctx context.Context, userId, name string, v interface{}) error {
+	path, dir, err := s.metadataPath(userId, name)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock(dir, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return s.readFile(path, v)
+}
+
+func (s *Store) PutMetadata(ctx context.Context, userId, name string, v interface{}) error {
+	path, dir, err := s.metadataPath(userId, name)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock(dir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	return s.writeFile(path, v)
+}
+
+func (s *Store) DeleteMetadata(ctx context.Context, userId, name string) error {
+	path, dir, err := s.metadataPath(userId, name)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock(dir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+func (s *Store) ListMetadata(ctx context.Context, userId, prefix string) ([]string, error) {
+	dir, err := s.userDir(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := s.lock(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var names []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() || !strings.HasPrefix(rel, "_") || !strings.HasSuffix(rel, ".json") {
+			return nil
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(rel, "_"), ".json")
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+
+	sort.Strings(names)
+	return names, err
+}
+
+// metadataPath returns the file holding the named document and the user
+// directory whose lock guards it.
+func (s *Store) metadataPath(userId, name string) (string, string, error) {
+	dir, err := s.userDir(userId)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := storage.CheckMetadataName(name); err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, "_"+filepath.FromSlash(name)+".json"), dir, nil
+}
+
+// userDir returns the directory holding a user's credentials. The user id
+// comes from the JWT claims but is still checked so it can never escape root.
+func (s *Store) userDir(userId string) (string, error) {
+	if userId == "" || userId == "." || userId == ".." || strings.ContainsAny(userId, `/\`) {
+		return "", fmt.Errorf("invalid user id %q", userId)
+	}
+
+	return filepath.Join(s.root, "users", userId), nil
+}
+
+// lock takes the lock guarding a single user directory, exclusive for writes
+// and shared for reads, and returns the function releasing it.
+func (s *Store) lock(dir string, exclusive bool) (func(), error) {
+	s.mu.Lock()
+	l, ok := s.locks[dir]
+	if !ok {
+		l = &dirLock{}
+		s.locks[dir] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	lock, runlock := l.RLock, l.RUnlock
+	if exclusive {
+		lock, runlock = l.Lock, l.Unlock
+	}
+
+	unlock := func() {
+		runlock()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, dir)
+		}
+	}
+
+	lock()
+	funlock, err := flock(filepath.Join(s.root, "locks", filepath.Base(dir)), exclusive)
+	if err != nil {
+		unlock()
+		return nil, fmt.Errorf("error locking user directory %w", err)
+	}
+
+	return func() {
+		funlock()
+		unlock()
+	}, nil
+}
+
+func (s *Store) read(path string) (models.Credential, error) {
+	var credential models.Credential
+	err := s.readFile(path, &credential)
+	return credential, err
+}
+
+func (s *Store) readFile(path string, v interface{}) error {
+	s.log.WithFields(logrus.Fields{"path": path}).Debug("filesystem get")
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return storage.ErrNotFound
+		}
+		return err
+	}
+
+	return json.Unmarshal(buf, v)
+}
+
+func (s *Store) write(dir string, credential models.Credential) error {
+	return s.writeFile(filepath.Join(dir, credential.Uid.String()), credential)
+}
+
+// writeFile atomically replaces the file at path by writing a temp file in
+// the same directory, syncing it and renaming it over the old one.
+func (s *Store) writeFile(path string, v interface{}) error {
+	s.log.WithFields(logrus.Fields{"path": path}).Debug("filesystem create")
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// credentialFiles returns the names of the credential files in dir, skipping
+// temp files and anything else that is not named after a credential uid.
+func credentialFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var files []string
+	for i := range entries {
+		if entries[i].IsDir() {
+			continue
+		}
+
+		if _, err := uuid.FromString(entries[i].Name()); err != nil {
+			continue
+		}
+		files = append(files, entries[i].Name())
+	}
+	return files, nil
+}
+
+// syncDir flushes directory entries so renames and removals survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
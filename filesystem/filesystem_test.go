@@ -0,0 +1,175 @@
+package filesystem
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+var log *logrus.Logger
+
+func init() {
+	log = logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+}
+
+func testCredential(service string) models.Credential {
+	return models.Credential{
+		Uid:      uuid.Must(uuid.NewV4()),
+		Service:  service,
+		Username: "jon",
+		Password: "hunter2",
+	}
+}
+
+// assertCredential compares everything but the timestamps since CustomTime
+// does not round trip its location.
+func assertCredential(t *testing.T, expected, actual models.Credential) {
+	expected.CreatedAt, expected.UpdatedAt = actual.CreatedAt, actual.UpdatedAt
+	assert.Equal(t, expected, actual)
+}
+
+func TestFilesystem(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewStore(log, root)
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	cred1 := testCredential("github")
+	cred2 := testCredential("gitlab")
+
+	t.Run("test create credentials", func(t *testing.T) {
+		assert.NoError(t, store.Create(ctx, "user1", cred1))
+		assert.NoError(t, store.Create(ctx, "user1", cred2))
+		assert.FileExists(t, filepath.Join(root, "users", "user1", cred1.Uid.String()))
+	})
+
+	t.Run("test get credential", func(t *testing.T) {
+		c, err := store.Get(ctx, "user1", cred1.Uid)
+		assert.NoError(t, err)
+		assertCredential(t, cred1, c)
+	})
+
+	t.Run("test get credential of another user", func(t *testing.T) {
+		_, err := store.Get(ctx, "user2", cred1.Uid)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("test list ignores temp files", func(t *testing.T) {
+		err := ioutil.WriteFile(filepath.Join(root, "users", "user1", ".tmp-123"), []byte("{"), 0600)
+		assert.NoError(t, err)
+		c, err := store.List(ctx, "user1")
+		assert.NoError(t, err)
+		assert.Len(t, c, 2)
+	})
+
+	t.Run("test list for user without credentials", func(t *testing.T) {
+		c, err := store.List(ctx, "nobody")
+		assert.NoError(t, err)
+		assert.Empty(t, c)
+	})
+
+	t.Run("test update credential", func(t *testing.T) {
+		cred1.Password = "correct horse"
+		assert.NoError(t, store.Update(ctx, "user1", cred1))
+		c, err := store.Get(ctx, "user1", cred1.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, "correct horse", c.Password)
+	})
+
+	t.Run("test update credential does not exist", func(t *testing.T) {
+		err := store.Update(ctx, "user1", testCredential("bitbucket"))
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("test concurrent updates", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, store.Update(ctx, "user1", cred2))
+			}()
+		}
+		wg.Wait()
+		c, err := store.Get(ctx, "user1", cred2.Uid)
+		assert.NoError(t, err)
+		assertCredential(t, cred2, c)
+	})
+
+	t.Run("test invalid user id", func(t *testing.T) {
+		_, err := store.List(ctx, "../user1")
+		assert.Error(t, err)
+		_, err = store.Get(ctx, "..", cred1.Uid)
+		assert.Error(t, err)
+	})
+
+	t.Run("test delete credential", func(t *testing.T) {
+		assert.NoError(t, store.Delete(ctx, "user1", cred1.Uid))
+		_, err := store.Get(ctx, "user1", cred1.Uid)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("test delete all credentials", func(t *testing.T) {
+		assert.NoError(t, store.DeleteAll(ctx, "user1"))
+		c, err := store.List(ctx, "user1")
+		assert.NoError(t, err)
+		assert.Empty(t, c)
+		_, err = os.Stat(filepath.Join(root, "users", "user1"))
+		assert.NoError(t, err)
+	})
+}
+
+func TestFilesystemLockAcrossStores(t *testing.T) {
+	root, err := ioutil.TempDir("", "jackstand")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	a, err := NewStore(log, root)
+	assert.NoError(t, err)
+	b, err := NewStore(log, root)
+	assert.NoError(t, err)
+
+	cred := testCredential("github")
+	assert.NoError(t, a.Create(ctx, "user1", cred))
+
+	dir, err := a.userDir("user1")
+	assert.NoError(t, err)
+	unlock, err := a.lock(dir, true)
+	assert.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := b.Get(ctx, "user1", cred.Uid)
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("read went ahead while another store held the user directory")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("read did not go ahead after the lock was released")
+	}
+
+	// Directories are only kept while their lock is held or waited for.
+	assert.Empty(t, a.locks)
+	assert.Empty(t, b.locks)
+}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package filesystem
+
+// flock is a no-op on Windows, where user directories are only locked
+// within the process.
+func flock(path string, exclusive bool) (func(), error) {
+	return func() {}, nil
+}
@@ -23,6 +23,7 @@ require (
 	github.com/posener/complete v1.2.3 // indirect
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.7.0
-	golang.org/x/crypto v0.0.0-20211108221036-ceb1ce70b4fa // indirect
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20211108221036-ceb1ce70b4fa
 	golang.org/x/sys v0.0.0-20211113001501-0c823b97ae02 // indirect
 )
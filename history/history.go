@@ -0,0 +1,120 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+)
+
+// ErrVersionNotFound is returned for a version that was never recorded or has
+// been trimmed.
+var ErrVersionNotFound = errors.New("version not found")
+
+// Version is a credential as it was before an update replaced it. Versions
+// are numbered from 1 per credential and keep their number when older
+// versions are trimmed.
+type Version struct {
+	Version    int               `json:"version"`
+	ReplacedAt models.CustomTime `json:"replacedAt"`
+	Credential models.Credential `json:"credential"`
+}
+
+// History holds the prior versions of a credential, oldest first.
+type History struct {
+	Versions []Version `json:"versions"`
+}
+
+// Recorder keeps the history of each credential in a metadata document named
+// history/<credentialUid>. Callers serialise writes to a user's credentials.
+type Recorder struct {
+	store       storage.MetadataStore
+	maxVersions int
+}
+
+// New returns a Recorder keeping at most maxVersions versions per credential.
+// A Recorder with maxVersions below one records nothing.
+func New(store storage.MetadataStore, maxVersions int) *Recorder {
+	return &Recorder{store: store, maxVersions: maxVersions}
+}
+
+// Record adds the credential, as it is before being replaced, to its history
+// and drops the oldest versions beyond the limit.
+func (h *Recorder) Record(ctx context.Context, userId string, credential models.Credential) error {
+	if h.maxVersions < 1 {
+		return nil
+	}
+
+	hist, err := h.Get(ctx, userId, credential.Uid)
+	if err != nil {
+		return err
+	}
+
+	next := 1
+	if n := len(hist.Versions); n > 0 {
+		next = hist.Versions[n-1].Version + 1
+	}
+
+	hist.Versions = append(hist.Versions, Version{
+		Version:    next,
+		ReplacedAt: models.CustomTime(time.Now()),
+		Credential: credential,
+	})
+
+	if n := len(hist.Versions); n > h.maxVersions {
+		hist.Versions = hist.Versions[n-h.maxVersions:]
+	}
+	return h.store.PutMetadata(ctx, userId, name(credential.Uid), hist)
+}
+
+// Get returns the history of a credential, which is empty if it was never
+// updated.
+func (h *Recorder) Get(ctx context.Context, userId string, credentialUid uuid.UUID) (History, error) {
+	hist := History{Versions: []Version{}}
+	err := h.store.GetMetadata(ctx, userId, name(credentialUid), &hist)
+	if errors.Is(err, storage.ErrNotFound) {
+		return History{Versions: []Version{}}, nil
+	}
+	return hist, err
+}
+
+// Version returns a single version of a credential.
+func (h *Recorder) Version(ctx context.Context, userId string, credentialUid uuid.UUID, version int) (Version, error) {
+	hist, err := h.Get(ctx, userId, credentialUid)
+	if err != nil {
+		return Version{}, err
+	}
+
+	for i := range hist.Versions {
+		if hist.Versions[i].Version == version {
+			return hist.Versions[i], nil
+		}
+	}
+	return Version{}, ErrVersionNotFound
+}
+
+// Put replaces the history of a credential, as when undoing an update
+// recorded with Record. An empty history is dropped.
+func (h *Recorder) Put(ctx context.Context, userId string, credentialUid uuid.UUID, hist History) error {
+	if len(hist.Versions) == 0 {
+		return h.Delete(ctx, userId, credentialUid)
+	}
+	return h.store.PutMetadata(ctx, userId, name(credentialUid), hist)
+}
+
+// Delete drops the history of a credential.
+func (h *Recorder) Delete(ctx context.Context, userId string, credentialUid uuid.UUID) error {
+	err := h.store.DeleteMetadata(ctx, userId, name(credentialUid))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func name(credentialUid uuid.UUID) string {
+	return fmt.Sprintf("history/%s", credentialUid)
+}
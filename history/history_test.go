@@ -0,0 +1,86 @@
+package history
+
+import (
+	"context"
+	"testing"
+
+	"github.com/brianvoe/gofakeit"
+	"github.com/dbubel/jackstand-api/memory"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	credential := models.Credential{
+		Uid:      uuid.Must(uuid.NewV4()),
+		Service:  gofakeit.HackerVerb(),
+		Username: gofakeit.BeerAlcohol(),
+	}
+
+	t.Run("test empty history", func(t *testing.T) {
+		h := New(memory.NewStore(), 2)
+		hist, err := h.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.NotNil(t, hist.Versions)
+		assert.Empty(t, hist.Versions)
+
+		_, err = h.Version(ctx, userId, credential.Uid, 1)
+		assert.ErrorIs(t, err, ErrVersionNotFound)
+	})
+
+	t.Run("test versions are capped", func(t *testing.T) {
+		h := New(memory.NewStore(), 2)
+		for _, password := range []string{"one", "two", "three"} {
+			credential.Password = password
+			assert.NoError(t, h.Record(ctx, userId, credential))
+		}
+
+		hist, err := h.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.Len(t, hist.Versions, 2)
+		assert.Equal(t, 2, hist.Versions[0].Version)
+		assert.Equal(t, 3, hist.Versions[1].Version)
+
+		v, err := h.Version(ctx, userId, credential.Uid, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, "two", v.Credential.Password)
+
+		_, err = h.Version(ctx, userId, credential.Uid, 1)
+		assert.ErrorIs(t, err, ErrVersionNotFound)
+
+		assert.NoError(t, h.Delete(ctx, userId, credential.Uid))
+		hist, err = h.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.Empty(t, hist.Versions)
+	})
+
+	t.Run("test put history back", func(t *testing.T) {
+		h := New(memory.NewStore(), 2)
+		assert.NoError(t, h.Record(ctx, userId, credential))
+		before, err := h.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+
+		assert.NoError(t, h.Record(ctx, userId, credential))
+		assert.NoError(t, h.Put(ctx, userId, credential.Uid, before))
+		hist, err := h.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.Len(t, hist.Versions, 1)
+		assert.Equal(t, 1, hist.Versions[0].Version)
+
+		assert.NoError(t, h.Put(ctx, userId, credential.Uid, History{}))
+		hist, err = h.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.Empty(t, hist.Versions)
+	})
+
+	t.Run("test disabled history", func(t *testing.T) {
+		h := New(memory.NewStore(), 0)
+		assert.NoError(t, h.Record(ctx, userId, credential))
+		hist, err := h.Get(ctx, userId, credential.Uid)
+		assert.NoError(t, err)
+		assert.Empty(t, hist.Versions)
+	})
+}
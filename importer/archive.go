@@ -0,0 +1,28 @@
+package importer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/dbubel/jackstand-api/archive"
+)
+
+func parseArchive(data []byte, password string) ([]Row, error) {
+	if password == "" {
+		return nil, ErrPasswordRequired
+	}
+
+	doc, err := archive.Read(bytes.NewReader(data), password)
+	if errors.Is(err, archive.ErrInvalidFile) {
+		return nil, fmt.Errorf("%w %v", ErrInvalidFile, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows := make([]Row, len(doc.Credentials))
+	for i := range doc.Credentials {
+		rows[i] = newRow(i+1, doc.Credentials[i].Model())
+	}
+	return rows, nil
+}
@@ -0,0 +1,119 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+)
+
+// bitwardenLogin is the type of Bitwarden items holding a login; secure
+// notes, cards and identities are not credentials.
+const bitwardenLogin = 1
+
+// bitwardenHidden is the type of Bitwarden custom fields holding secrets.
+const bitwardenHidden = 1
+
+type bitwardenExport struct {
+	Encrypted bool `json:"encrypted"`
+	Folders   []struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"folders"`
+	Items []struct {
+		Type     int     `json:"type"`
+		Name     string  `json:"name"`
+		Notes    *string `json:"notes"`
+		FolderId *string `json:"folderId"`
+		Login    *struct {
+			Username *string `json:"username"`
+			Password *string `json:"password"`
+			Totp     *string `json:"totp"`
+			Uris     []struct {
+				Uri *string `json:"uri"`
+			} `json:"uris"`
+		} `json:"login"`
+		Fields []struct {
+			Name  string  `json:"name"`
+			Value *string `json:"value"`
+			Type  int     `json:"type"`
+		} `json:"fields"`
+	} `json:"items"`
+}
+
+func parseBitwarden(data []byte) ([]Row, error) {
+	var export bitwardenExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("%w %v", ErrInvalidFile, err)
+	}
+
+	if export.Encrypted {
+		return nil, fmt.Errorf("%w export is encrypted, export it unencrypted instead", ErrInvalidFile)
+	}
+
+	folders := make(map[string]string, len(export.Folders))
+	for _, folder := range export.Folders {
+		folders[folder.Id] = folder.Name
+	}
+
+	rows := make([]Row, len(export.Items))
+	for i, item := range export.Items {
+		if item.Type != bitwardenLogin || item.Login == nil {
+			rows[i] = Row{Row: i + 1, Credential: models.Credential{Service: item.Name}, Err: errors.New("not a login")}
+			continue
+		}
+
+		c := models.Credential{
+			Service:     strings.TrimSpace(item.Name),
+			Username:    strings.TrimSpace(str(item.Login.Username)),
+			Password:    str(item.Login.Password),
+			Description: strings.TrimSpace(str(item.Notes)),
+			Metadata:    map[string]string{},
+		}
+
+		// Further addresses are kept as url2, url3 and so on.
+		n := 0
+		for _, uri := range item.Login.Uris {
+			if u := strings.TrimSpace(str(uri.Uri)); u != "" {
+				key := storage.URLMetadataKey
+				if n++; n > 1 {
+					key = fmt.Sprintf("%s%d", key, n)
+				}
+				c.Metadata[key] = u
+			}
+		}
+
+		if totp := strings.TrimSpace(str(item.Login.Totp)); totp != "" {
+			c.Metadata[totpMetadataKey] = totp
+		}
+
+		if item.FolderId != nil && folders[*item.FolderId] != "" {
+			c.Metadata[models.FolderMetadataKey] = folders[*item.FolderId]
+		}
+
+		for _, field := range item.Fields {
+			name := strings.TrimSpace(field.Name)
+			if name == "" || str(field.Value) == "" {
+				continue
+			}
+
+			if field.Type == bitwardenHidden && !models.IsSecretMetadata(name) {
+				name = models.SecretMetadataPrefix + name
+			}
+			c.Metadata[name] = str(field.Value)
+		}
+
+		rows[i] = newRow(i+1, c)
+	}
+	return rows, nil
+}
+
+func str(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,177 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+)
+
+// csvFormat names the columns of a CSV export that map onto credential
+// fields. Columns are matched case insensitively; any other non empty column
+// that is not ignored is kept as metadata under its lower case name.
+type csvFormat struct {
+	// Detect is a column only this format has.
+	Detect   string
+	Service  string
+	URL      string
+	Username string
+	Password string
+	Notes    string
+	// TOTP holds a one time password secret, kept as secret:totp metadata.
+	TOTP string
+	// Tags holds comma separated tags and Folder a single folder, which is
+	// kept as folder metadata.
+	Tags   string
+	Folder string
+	Ignore []string
+}
+
+// bom is the byte order mark some spreadsheets put at the start of a CSV.
+var bom = []byte("\ufeff")
+
+var csvFormats = map[string]csvFormat{
+	Chrome: {
+		Service:  "name",
+		URL:      "url",
+		Username: "username",
+		Password: "password",
+		Notes:    "note",
+	},
+	Firefox: {
+		Detect:   "httprealm",
+		URL:      "url",
+		Username: "username",
+		Password: "password",
+		Ignore:   []string{"guid", "timecreated", "timelastused", "timepasswordchanged"},
+	},
+	LastPass: {
+		Detect:   "grouping",
+		Service:  "name",
+		URL:      "url",
+		Username: "username",
+		Password: "password",
+		Notes:    "extra",
+		TOTP:     "totp",
+		Folder:   "grouping",
+		Ignore:   []string{"fav"},
+	},
+	OnePassword: {
+		Detect:   "otpauth",
+		Service:  "title",
+		URL:      "url",
+		Username: "username",
+		Password: "password",
+		Notes:    "notes",
+		TOTP:     "otpauth",
+		Tags:     "tags",
+		Ignore:   []string{"favorite", "archived"},
+	},
+}
+
+// detectCSV picks the format by the columns of the header, falling back to
+// Chrome, whose columns the other formats share.
+func detectCSV(data []byte) string {
+	header, err := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, bom))).Read()
+	if err != nil {
+		return Chrome
+	}
+
+	for _, format := range []string{Firefox, LastPass, OnePassword} {
+		for _, column := range header {
+			if strings.EqualFold(strings.TrimSpace(column), csvFormats[format].Detect) {
+				return format
+			}
+		}
+	}
+	return Chrome
+}
+
+func parseCSV(f csvFormat, data []byte) ([]Row, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, bom)))
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w reading header %v", ErrInvalidFile, err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i := range header {
+		columns[strings.ToLower(strings.TrimSpace(header[i]))] = i
+	}
+
+	for _, column := range []string{f.Username, f.Password} {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("%w missing column %s", ErrInvalidFile, column)
+		}
+	}
+
+	mapped := map[string]bool{}
+	for _, column := range append([]string{f.Service, f.URL, f.Username, f.Password, f.Notes, f.TOTP, f.Tags, f.Folder}, f.Ignore...) {
+		mapped[column] = true
+	}
+
+	var rows []Row
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+
+		if err != nil {
+			// A malformed line cannot be told apart from the rest of the
+			// file, so nothing after it is trusted.
+			return nil, fmt.Errorf("%w row %d %v", ErrInvalidFile, n, err)
+		}
+
+		raw := func(column string) string {
+			if i, ok := columns[column]; ok && column != "" && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		value := func(column string) string {
+			return strings.TrimSpace(raw(column))
+		}
+
+		c := models.Credential{
+			Service:     value(f.Service),
+			Username:    value(f.Username),
+			Password:    raw(f.Password),
+			Description: value(f.Notes),
+			Metadata:    map[string]string{},
+		}
+
+		if url := value(f.URL); url != "" {
+			c.Metadata[storage.URLMetadataKey] = url
+		}
+
+		if totp := value(f.TOTP); totp != "" {
+			c.Metadata[totpMetadataKey] = totp
+		}
+
+		// LastPass separates subfolders with backslashes.
+		if folder := value(f.Folder); folder != "" {
+			c.Metadata[models.FolderMetadataKey] = strings.ReplaceAll(folder, `\`, "/")
+		}
+
+		for _, tag := range strings.Split(value(f.Tags), ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				c.Tags = append(c.Tags, tag)
+			}
+		}
+
+		for column, i := range columns {
+			if !mapped[column] && i < len(record) && strings.TrimSpace(record[i]) != "" {
+				c.Metadata[column] = strings.TrimSpace(record[i])
+			}
+		}
+
+		rows = append(rows, newRow(n, c))
+	}
+}
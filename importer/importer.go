@@ -0,0 +1,298 @@
+// Package importer reads the exports of browsers and other password managers
+// into credentials.
+package importer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbubel/jackstand-api/archive"
+	"github.com/dbubel/jackstand-api/kdbx"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+)
+
+// Formats Parse reads.
+const (
+	Chrome      = "chrome"
+	Firefox     = "firefox"
+	LastPass    = "lastpass"
+	Bitwarden   = "bitwarden"
+	OnePassword = "1password"
+	KeePass     = "kdbx"
+	Archive     = "archive"
+)
+
+// Statuses of a row in a Report.
+const (
+	// StatusCreated rows were imported, or would be in a dry run.
+	StatusCreated = "created"
+	// StatusDuplicate rows match an existing credential or an earlier row.
+	StatusDuplicate = "duplicate"
+	// StatusInvalid rows are not valid credentials.
+	StatusInvalid = "invalid"
+	// StatusFailed rows could not be stored.
+	StatusFailed = "failed"
+	// StatusCancelled rows were not attempted because the import ran out of
+	// time or was cancelled.
+	StatusCancelled = "cancelled"
+)
+
+// importConcurrency is how many credentials an import creates at once.
+const importConcurrency = 8
+
+// totpMetadataKey holds the one time password secret of imported
+// credentials.
+const totpMetadataKey = models.SecretMetadataPrefix + "totp"
+
+// ErrInvalidFile is returned for files that cannot be read in the format.
+var ErrInvalidFile = errors.New("invalid import file")
+
+// ErrPasswordRequired is returned for KeePass databases and archives parsed
+// without a password.
+var ErrPasswordRequired = errors.New("a password is required")
+
+// Row is a credential read from an export, or why it could not be.
+type Row struct {
+	// Row is the 1 based position of the row in the export, not counting a
+	// CSV header.
+	Row        int
+	Credential models.Credential
+	Err        error
+}
+
+// Parse reads an export in the format, or the format Detect picks when it is
+// empty. The password opens KeePass databases and archives and is ignored
+// otherwise. Rows
+// that are not valid credentials are returned with their error; an error is
+// returned only when the file as a whole cannot be read.
+func Parse(format string, data []byte, password string) ([]Row, error) {
+	if format == "" {
+		format = Detect(data)
+	}
+
+	switch format {
+	case Bitwarden:
+		return parseBitwarden(data)
+	case KeePass:
+		return parseKeePass(data, password)
+	case Archive:
+		return parseArchive(data, password)
+	}
+
+	f, ok := csvFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown import format %q", format)
+	}
+	return parseCSV(f, data)
+}
+
+// Detect guesses the format of an export: KeePass databases and archives by
+// their signature, Bitwarden for JSON, otherwise the CSV format whose columns
+// the header has.
+func Detect(data []byte) string {
+	switch {
+	case kdbx.IsDatabase(data):
+		return KeePass
+	case archive.IsArchive(data):
+		return Archive
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")):
+		return Bitwarden
+	}
+	return detectCSV(data)
+}
+
+// newRow names credentials without a service after the host of their URL and
+// checks the fields every credential needs.
+func newRow(n int, c models.Credential) Row {
+	if c.Service == "" {
+		c.Service = storage.Normalize(storage.SearchURL, c.Metadata[storage.URLMetadataKey])
+	}
+
+	if len(c.Metadata) == 0 {
+		c.Metadata = nil
+	}
+
+	row := Row{Row: n, Credential: c}
+	var missing []string
+	for _, field := range []struct{ name, value string }{
+		{"service", c.Service},
+		{"username", c.Username},
+		{"password", c.Password},
+	} {
+		if field.value == "" {
+			missing = append(missing, field.name)
+		}
+	}
+
+	if len(missing) > 0 {
+		row.Err = fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return row
+}
+
+// Result is what happened to a row.
+type Result struct {
+	Row      int    `json:"row"`
+	Status   string `json:"status"`
+	Service  string `json:"service,omitempty"`
+	Username string `json:"username,omitempty"`
+	// Uid is the created credential, or for a duplicate the existing one.
+	Uid *uuid.UUID `json:"uid,omitempty"`
+	// DuplicateOf is the earlier row a duplicate repeats.
+	DuplicateOf int    `json:"duplicateOf,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Report summarises an import.
+type Report struct {
+	DryRun     bool     `json:"dryRun"`
+	Created    int      `json:"created"`
+	Duplicates int      `json:"duplicates"`
+	Invalid    int      `json:"invalid"`
+	Failed     int      `json:"failed"`
+	Cancelled  int      `json:"cancelled"`
+	Results    []Result `json:"results"`
+}
+
+// Import creates the valid rows for the user, skipping those that duplicate
+// an existing credential or an earlier row: the same username for the same
+// service or URL host. A dry run reports what would happen without creating
+// anything. Credentials get new uids, and keep when they were created if the
+// export has it. Rows are created concurrently. Failing rows are reported and
+// do not stop the import; once the context is done the rows not yet created
+// are reported as cancelled, so the report tells exactly which rows were
+// committed. An error is returned only when the existing credentials cannot
+// be read.
+func Import(ctx context.Context, store storage.CredentialStore, userId string, rows []Row, dryRun bool) (Report, error) {
+	existing, err := store.List(ctx, userId)
+	if err != nil {
+		return Report{}, err
+	}
+
+	seen := make(map[string]Result)
+	for i := range existing {
+		uid := existing[i].Uid
+		for _, key := range keys(existing[i]) {
+			seen[key] = Result{Uid: &uid}
+		}
+	}
+
+	report := Report{DryRun: dryRun, Results: make([]Result, len(rows))}
+	index := make(map[int]int, len(rows))
+	var create []int
+	for i, row := range rows {
+		index[row.Row] = i
+		result := Result{Row: row.Row, Service: row.Credential.Service, Username: row.Credential.Username}
+		if row.Err != nil {
+			result.Status, result.Error = StatusInvalid, row.Err.Error()
+			report.Results[i] = result
+			continue
+		}
+
+		if duplicate, ok := find(seen, row.Credential); ok {
+			result.Status = StatusDuplicate
+			result.Uid, result.DuplicateOf = duplicate.Uid, duplicate.Row
+			report.Results[i] = result
+			continue
+		}
+
+		result.Status = StatusCreated
+		report.Results[i] = result
+		create = append(create, i)
+		for _, key := range keys(row.Credential) {
+			seen[key] = Result{Row: row.Row}
+		}
+	}
+
+	if !dryRun {
+		createRows(ctx, store, userId, rows, create, report.Results)
+	}
+
+	for i := range report.Results {
+		result := &report.Results[i]
+		if result.Status == StatusDuplicate && result.DuplicateOf != 0 {
+			// Rows repeating a row of this import get the credential it
+			// created, if it was.
+			result.Uid = report.Results[index[result.DuplicateOf]].Uid
+		}
+
+		switch result.Status {
+		case StatusCreated:
+			report.Created++
+		case StatusDuplicate:
+			report.Duplicates++
+		case StatusInvalid:
+			report.Invalid++
+		case StatusFailed:
+			report.Failed++
+		case StatusCancelled:
+			report.Cancelled++
+		}
+	}
+	return report, nil
+}
+
+// createRows creates the credentials of the rows at the indexes in create,
+// recording the outcome of each in its result.
+func createRows(ctx context.Context, store storage.CredentialStore, userId string, rows []Row, create []int, results []Result) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, importConcurrency)
+	for _, i := range create {
+		sem <- struct{}{}
+		if err := ctx.Err(); err != nil {
+			<-sem
+			results[i].Status, results[i].Error = StatusCancelled, err.Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			c := rows[i].Credential
+			c.Uid = uuid.Must(uuid.NewV4())
+			c.UpdatedAt = models.CustomTime(time.Now())
+			if time.Time(c.CreatedAt).IsZero() {
+				c.CreatedAt = c.UpdatedAt
+			}
+
+			if err := store.Create(ctx, userId, c); err != nil {
+				results[i].Status, results[i].Error = StatusFailed, err.Error()
+				return
+			}
+			results[i].Uid = &c.Uid
+		}(i)
+	}
+	wg.Wait()
+}
+
+func find(seen map[string]Result, c models.Credential) (Result, bool) {
+	for _, key := range keys(c) {
+		if result, ok := seen[key]; ok {
+			return result, true
+		}
+	}
+	return Result{}, false
+}
+
+// keys returns what identifies the credential's account for duplicate
+// detection.
+func keys(c models.Credential) []string {
+	values := storage.SearchValues(c)
+	username := values[storage.SearchUsername]
+	var keys []string
+	for _, field := range []string{storage.SearchService, storage.SearchURL} {
+		if value, ok := values[field]; ok {
+			keys = append(keys, field+"\x00"+value+"\x00"+username)
+		}
+	}
+	return keys
+}
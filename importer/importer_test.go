@@ -0,0 +1,298 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dbubel/jackstand-api/archive"
+	"github.com/dbubel/jackstand-api/kdbx"
+	"github.com/dbubel/jackstand-api/memory"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+const chromeExport = "\ufeffname,url,username,password,note\n" +
+	"github.com,https://github.com/login,octocat, pass word ,work account\n" +
+	",https://www.example.com/,alice,secret,\n" +
+	"nopassword,https://example.org,bob,,\n"
+
+const firefoxExport = `"url","username","password","httpRealm","formActionOrigin","guid","timeCreated","timeLastUsed","timePasswordChanged"
+"https://accounts.firefox.com","fox","hunter2","","https://accounts.firefox.com","{1b2c}","1600000000000","1600000000000","1600000000000"
+`
+
+const lastPassExport = `url,username,password,totp,extra,name,grouping,fav
+https://bank.com,carol,p4ss,JBSWY3DPEHPK3PXP,"line one
+line two",Bank,Finance\Banks,1
+http://sn,,,,a secure note,Note,,0
+`
+
+const onePasswordExport = `"Title","Url","Username","Password","OTPAuth","Favorite","Archived","Tags","Notes"
+"Mail","https://mail.com","dave","pw","otpauth://totp/mail?secret=ABC","false","false","email, personal","notes here"
+`
+
+const bitwardenJSON = `{
+  "encrypted": false,
+  "folders": [{"id": "f1", "name": "Social"}],
+  "items": [
+    {"type": 1, "name": "Forum", "notes": "old account", "folderId": "f1",
+     "login": {"username": "erin", "password": "pw1", "totp": null,
+               "uris": [{"uri": "https://forum.net"}, {"uri": "https://m.forum.net"}]},
+     "fields": [{"name": "pin", "value": "1234", "type": 1}, {"name": "hint", "value": "blue", "type": 0}]},
+    {"type": 2, "name": "A note", "notes": "text"}
+  ]
+}`
+
+func TestParse(t *testing.T) {
+	t.Run("test chrome", func(t *testing.T) {
+		assert.Equal(t, Chrome, Detect([]byte(chromeExport)))
+		rows, err := Parse("", []byte(chromeExport), "")
+		assert.NoError(t, err)
+		assert.Len(t, rows, 3)
+
+		assert.NoError(t, rows[0].Err)
+		assert.Equal(t, 1, rows[0].Row)
+		assert.Equal(t, "github.com", rows[0].Credential.Service)
+		assert.Equal(t, " pass word ", rows[0].Credential.Password)
+		assert.Equal(t, "work account", rows[0].Credential.Description)
+		assert.Equal(t, map[string]string{"url": "https://github.com/login"}, rows[0].Credential.Metadata)
+
+		assert.NoError(t, rows[1].Err)
+		assert.Equal(t, "example.com", rows[1].Credential.Service)
+
+		assert.EqualError(t, rows[2].Err, "missing password")
+	})
+
+	t.Run("test firefox", func(t *testing.T) {
+		assert.Equal(t, Firefox, Detect([]byte(firefoxExport)))
+		rows, err := Parse(Firefox, []byte(firefoxExport), "")
+		assert.NoError(t, err)
+		assert.Len(t, rows, 1)
+		assert.NoError(t, rows[0].Err)
+		assert.Equal(t, "accounts.firefox.com", rows[0].Credential.Service)
+		assert.Equal(t, map[string]string{
+			"url":              "https://accounts.firefox.com",
+			"formactionorigin": "https://accounts.firefox.com",
+		}, rows[0].Credential.Metadata)
+	})
+
+	t.Run("test lastpass", func(t *testing.T) {
+		assert.Equal(t, LastPass, Detect([]byte(lastPassExport)))
+		rows, err := Parse(LastPass, []byte(lastPassExport), "")
+		assert.NoError(t, err)
+		assert.Len(t, rows, 2)
+		assert.NoError(t, rows[0].Err)
+		assert.Equal(t, "Bank", rows[0].Credential.Service)
+		assert.Equal(t, "line one\nline two", rows[0].Credential.Description)
+		assert.Equal(t, "Finance/Banks", rows[0].Credential.Metadata["folder"])
+		assert.Equal(t, "JBSWY3DPEHPK3PXP", rows[0].Credential.Metadata["secret:totp"])
+		assert.NotContains(t, rows[0].Credential.Metadata, "fav")
+		assert.EqualError(t, rows[1].Err, "missing username, password")
+	})
+
+	t.Run("test 1password", func(t *testing.T) {
+		assert.Equal(t, OnePassword, Detect([]byte(onePasswordExport)))
+		rows, err := Parse(OnePassword, []byte(onePasswordExport), "")
+		assert.NoError(t, err)
+		assert.Len(t, rows, 1)
+		assert.NoError(t, rows[0].Err)
+		assert.Equal(t, "Mail", rows[0].Credential.Service)
+		assert.Equal(t, "notes here", rows[0].Credential.Description)
+		assert.Equal(t, []string{"email", "personal"}, rows[0].Credential.Tags)
+		assert.Equal(t, map[string]string{
+			"url":         "https://mail.com",
+			"secret:totp": "otpauth://totp/mail?secret=ABC",
+		}, rows[0].Credential.Metadata)
+	})
+
+	t.Run("test bitwarden", func(t *testing.T) {
+		assert.Equal(t, Bitwarden, Detect([]byte(bitwardenJSON)))
+		rows, err := Parse("", []byte(bitwardenJSON), "")
+		assert.NoError(t, err)
+		assert.Len(t, rows, 2)
+		assert.NoError(t, rows[0].Err)
+		assert.Equal(t, models.Credential{
+			Service:     "Forum",
+			Username:    "erin",
+			Password:    "pw1",
+			Description: "old account",
+			Metadata: map[string]string{
+				"folder":     "Social",
+				"url":        "https://forum.net",
+				"url2":       "https://m.forum.net",
+				"secret:pin": "1234",
+				"hint":       "blue",
+			},
+		}, rows[0].Credential)
+		assert.EqualError(t, rows[1].Err, "not a login")
+
+		_, err = Parse(Bitwarden, []byte(`{"encrypted": true, "items": []}`), "")
+		assert.ErrorIs(t, err, ErrInvalidFile)
+	})
+
+	t.Run("test keepass", func(t *testing.T) {
+		var buf bytes.Buffer
+		db := kdbx.FromCredentials("jackstand", []models.Credential{
+			{Service: "Forum", Username: "erin", Password: "pw1", Metadata: map[string]string{"folder": "Social", "secret:pin": "1234"}},
+			{Service: "Blank"},
+		})
+		opts := kdbx.Options{Cipher: kdbx.CipherChaCha20, KDF: kdbx.KDFArgon2d, Iterations: 1, Memory: 1 << 20, Parallelism: 1}
+		assert.NoError(t, kdbx.Write(&buf, db, "s3cret", opts))
+
+		assert.Equal(t, KeePass, Detect(buf.Bytes()))
+		rows, err := Parse("", buf.Bytes(), "s3cret")
+		assert.NoError(t, err)
+		assert.Len(t, rows, 2)
+		assert.EqualError(t, rows[0].Err, "missing username, password")
+		assert.NoError(t, rows[1].Err)
+		assert.Equal(t, "erin", rows[1].Credential.Username)
+		assert.Equal(t, map[string]string{"folder": "Social", "secret:pin": "1234"}, rows[1].Credential.Metadata)
+
+		_, err = Parse(KeePass, buf.Bytes(), "")
+		assert.ErrorIs(t, err, ErrPasswordRequired)
+
+		_, err = Parse(KeePass, buf.Bytes(), "wrong")
+		assert.ErrorIs(t, err, kdbx.ErrInvalidPassword)
+
+		_, err = Parse(KeePass, []byte(chromeExport), "s3cret")
+		assert.ErrorIs(t, err, ErrInvalidFile)
+	})
+
+	t.Run("test archive", func(t *testing.T) {
+		var buf bytes.Buffer
+		created := models.CustomTime(time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC))
+		assert.NoError(t, archive.Write(&buf, "s3cret", archive.Params{Time: 1, Memory: 64, Threads: 1}, []models.Credential{
+			{Service: "Forum", Username: "erin", Password: "pw1", CreatedAt: created},
+		}))
+
+		assert.Equal(t, Archive, Detect(buf.Bytes()))
+		rows, err := Parse("", buf.Bytes(), "s3cret")
+		assert.NoError(t, err)
+		if assert.Len(t, rows, 1) {
+			assert.NoError(t, rows[0].Err)
+			assert.Equal(t, "erin", rows[0].Credential.Username)
+			assert.Equal(t, created, rows[0].Credential.CreatedAt)
+		}
+
+		_, err = Parse(Archive, buf.Bytes(), "")
+		assert.ErrorIs(t, err, ErrPasswordRequired)
+
+		_, err = Parse(Archive, buf.Bytes(), "wrong")
+		assert.ErrorIs(t, err, archive.ErrInvalidPassword)
+	})
+
+	t.Run("test invalid files", func(t *testing.T) {
+		_, err := Parse("keepass", []byte(chromeExport), "")
+		assert.Error(t, err)
+
+		_, err = Parse(Chrome, []byte("name,url\nexample,https://example.com\n"), "")
+		assert.ErrorIs(t, err, ErrInvalidFile)
+
+		_, err = Parse(Chrome, []byte("name,url,username,password\n\"unterminated,x,y,z\n"), "")
+		assert.ErrorIs(t, err, ErrInvalidFile)
+	})
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewStore()
+	existing := models.Credential{
+		Uid:      uuid.Must(uuid.NewV4()),
+		Service:  "GitHub",
+		Username: "OctoCat",
+		Password: "old",
+		Metadata: map[string]string{"url": "github.com"},
+	}
+	assert.NoError(t, store.Create(ctx, "user", existing))
+
+	rows, err := Parse(Chrome, []byte(chromeExport+"example.com,https://example.com,alice,again,\n"), "")
+	assert.NoError(t, err)
+
+	report, err := Import(ctx, store, "user", rows, true)
+	assert.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 2, report.Duplicates)
+	assert.Equal(t, 1, report.Invalid)
+
+	assert.Equal(t, StatusDuplicate, report.Results[0].Status)
+	assert.Equal(t, existing.Uid, *report.Results[0].Uid)
+	assert.Equal(t, StatusCreated, report.Results[1].Status)
+	assert.Nil(t, report.Results[1].Uid)
+	assert.Equal(t, StatusInvalid, report.Results[2].Status)
+	assert.Equal(t, "missing password", report.Results[2].Error)
+	assert.Equal(t, StatusDuplicate, report.Results[3].Status)
+	assert.Equal(t, 2, report.Results[3].DuplicateOf)
+
+	credentials, err := store.List(ctx, "user")
+	assert.NoError(t, err)
+	assert.Len(t, credentials, 1)
+
+	report, err = Import(ctx, store, "user", rows, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Created)
+	assert.NotNil(t, report.Results[1].Uid)
+	assert.Equal(t, report.Results[1].Uid, report.Results[3].Uid)
+
+	created, err := store.Get(ctx, "user", *report.Results[1].Uid)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", created.Username)
+	assert.False(t, created.Uid == uuid.Nil)
+
+	report, err = Import(ctx, store, "user", rows, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.Created)
+	assert.Equal(t, 3, report.Duplicates)
+}
+
+func TestImportCutShort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := memory.NewStore()
+
+	var rows []Row
+	for i := 0; i < 40; i++ {
+		rows = append(rows, newRow(i+1, models.Credential{
+			Service:  fmt.Sprintf("service%d", i),
+			Username: "alice",
+			Password: "hunter2",
+		}))
+	}
+
+	// The import runs out of time after ten credentials are created.
+	var creates int32
+	store.SetFaults(memory.Faults{Err: func(op string) error {
+		if op == "Create" && atomic.AddInt32(&creates, 1) == 10 {
+			cancel()
+		}
+		return nil
+	}})
+
+	report, err := Import(ctx, store, "user", rows, false)
+	assert.NoError(t, err)
+	assert.NotZero(t, report.Cancelled)
+	assert.Zero(t, report.Failed)
+	assert.Equal(t, len(rows), report.Created+report.Cancelled)
+
+	store.SetFaults(memory.Faults{})
+	credentials, err := store.List(context.Background(), "user")
+	assert.NoError(t, err)
+	assert.Len(t, credentials, report.Created)
+
+	for _, result := range report.Results {
+		switch result.Status {
+		case StatusCreated:
+			_, err := store.Get(context.Background(), "user", *result.Uid)
+			assert.NoError(t, err)
+		case StatusCancelled:
+			assert.Nil(t, result.Uid)
+			assert.Equal(t, context.Canceled.Error(), result.Error)
+		default:
+			t.Errorf("row %d is %s", result.Row, result.Status)
+		}
+	}
+}
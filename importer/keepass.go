@@ -0,0 +1,28 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dbubel/jackstand-api/kdbx"
+)
+
+func parseKeePass(data []byte, password string) ([]Row, error) {
+	if password == "" {
+		return nil, ErrPasswordRequired
+	}
+
+	db, err := kdbx.Read(data, password)
+	if errors.Is(err, kdbx.ErrInvalidFile) {
+		return nil, fmt.Errorf("%w %v", ErrInvalidFile, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	credentials := db.Credentials()
+	rows := make([]Row, len(credentials))
+	for i := range credentials {
+		rows[i] = newRow(i+1, credentials[i])
+	}
+	return rows, nil
+}
@@ -0,0 +1,213 @@
+package kdbx
+
+import (
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// argon2d derives a key with Argon2d version 1.3 (RFC 9106), the default key
+// derivation of KDBX 4, which golang.org/x/crypto/argon2 does not expose.
+// memory is in KiB.
+func argon2d(password, salt, secret, data []byte, time, memory, threads, keyLen uint32) []byte {
+	const syncPoints = 4
+	h, _ := blake2b.New512(nil)
+	for _, v := range []uint32{threads, keyLen, memory, time, argon2Version, 0} {
+		writeUint32(h, v)
+	}
+	for _, b := range [][]byte{password, salt, secret, data} {
+		writeUint32(h, uint32(len(b)))
+		h.Write(b)
+	}
+
+	var h0 [blake2b.Size + 8]byte
+	h.Sum(h0[:0])
+
+	if memory < 2*syncPoints*threads {
+		memory = 2 * syncPoints * threads
+	}
+	memory = memory / (syncPoints * threads) * (syncPoints * threads)
+	lanes := memory / threads
+	segments := lanes / syncPoints
+
+	B := make([]argon2Block, memory)
+	var buf [1024]byte
+	for lane := uint32(0); lane < threads; lane++ {
+		for i := uint32(0); i < 2; i++ {
+			binary.LittleEndian.PutUint32(h0[blake2b.Size:], i)
+			binary.LittleEndian.PutUint32(h0[blake2b.Size+4:], lane)
+			blake2bLong(buf[:], h0[:])
+			B[lane*lanes+i].load(buf[:])
+		}
+	}
+
+	segment := func(pass, slice, lane uint32) {
+		index := uint32(0)
+		if pass == 0 && slice == 0 {
+			// The first two blocks of every lane are already filled.
+			index = 2
+		}
+
+		for offset := lane*lanes + slice*segments + index; index < segments; index, offset = index+1, offset+1 {
+			prev := offset - 1
+			if index == 0 && slice == 0 {
+				prev += lanes
+			}
+
+			rand := B[prev][0]
+			refLane := uint32(rand>>32) % threads
+			if pass == 0 && slice == 0 {
+				refLane = lane
+			}
+
+			// The reference area is every block computed so far that is
+			// not being computed concurrently, see RFC 9106 section 3.4.1.2.
+			area, start := 3*segments, ((slice+1)%syncPoints)*segments
+			if pass == 0 {
+				area, start = slice*segments, 0
+			}
+
+			if refLane == lane {
+				area += index - 1
+			} else if index == 0 {
+				area--
+			}
+
+			x := (rand & 0xFFFFFFFF) * (rand & 0xFFFFFFFF) >> 32
+			x = uint64(area) - 1 - (uint64(area) * x >> 32)
+			ref := refLane*lanes + uint32((uint64(start)+x)%uint64(lanes))
+			compress(&B[offset], &B[prev], &B[ref])
+		}
+	}
+
+	for pass := uint32(0); pass < time; pass++ {
+		for slice := uint32(0); slice < syncPoints; slice++ {
+			var wg sync.WaitGroup
+			for lane := uint32(0); lane < threads; lane++ {
+				wg.Add(1)
+				go func(lane uint32) {
+					defer wg.Done()
+					segment(pass, slice, lane)
+				}(lane)
+			}
+			wg.Wait()
+		}
+	}
+
+	final := B[lanes-1]
+	for lane := uint32(1); lane < threads; lane++ {
+		for i, v := range B[lane*lanes+lanes-1] {
+			final[i] ^= v
+		}
+	}
+
+	final.store(buf[:])
+	key := make([]byte, keyLen)
+	blake2bLong(key, buf[:])
+	return key
+}
+
+// argon2Version is the only version of Argon2 KDBX 4 writes, 1.3.
+const argon2Version = 0x13
+
+type argon2Block [128]uint64
+
+func (b *argon2Block) load(in []byte) {
+	for i := range b {
+		b[i] = binary.LittleEndian.Uint64(in[i*8:])
+	}
+}
+
+func (b *argon2Block) store(out []byte) {
+	for i, v := range b {
+		binary.LittleEndian.PutUint64(out[i*8:], v)
+	}
+}
+
+// compress sets out to out ^ G(x, y), the compression function of Argon2
+// with the XOR of later passes in version 1.3; in the first pass out is
+// still zero.
+func compress(out, x, y *argon2Block) {
+	var r, q argon2Block
+	for i := range r {
+		r[i] = x[i] ^ y[i]
+	}
+	q = r
+
+	for i := 0; i < 128; i += 16 {
+		permute(&q[i], &q[i+1], &q[i+2], &q[i+3], &q[i+4], &q[i+5], &q[i+6], &q[i+7],
+			&q[i+8], &q[i+9], &q[i+10], &q[i+11], &q[i+12], &q[i+13], &q[i+14], &q[i+15])
+	}
+	for i := 0; i < 16; i += 2 {
+		permute(&q[i], &q[i+1], &q[i+16], &q[i+17], &q[i+32], &q[i+33], &q[i+48], &q[i+49],
+			&q[i+64], &q[i+65], &q[i+80], &q[i+81], &q[i+96], &q[i+97], &q[i+112], &q[i+113])
+	}
+
+	for i := range out {
+		out[i] ^= q[i] ^ r[i]
+	}
+}
+
+// permute is the permutation P of Argon2, BLAKE2b's round with
+// multiplications added.
+func permute(v0, v1, v2, v3, v4, v5, v6, v7, v8, v9, v10, v11, v12, v13, v14, v15 *uint64) {
+	mix(v0, v4, v8, v12)
+	mix(v1, v5, v9, v13)
+	mix(v2, v6, v10, v14)
+	mix(v3, v7, v11, v15)
+	mix(v0, v5, v10, v15)
+	mix(v1, v6, v11, v12)
+	mix(v2, v7, v8, v13)
+	mix(v3, v4, v9, v14)
+}
+
+func mix(a, b, c, d *uint64) {
+	*a = *a + *b + 2*uint64(uint32(*a))*uint64(uint32(*b))
+	*d = bits.RotateLeft64(*d^*a, -32)
+	*c = *c + *d + 2*uint64(uint32(*c))*uint64(uint32(*d))
+	*b = bits.RotateLeft64(*b^*c, -24)
+	*a = *a + *b + 2*uint64(uint32(*a))*uint64(uint32(*b))
+	*d = bits.RotateLeft64(*d^*a, -16)
+	*c = *c + *d + 2*uint64(uint32(*c))*uint64(uint32(*d))
+	*b = bits.RotateLeft64(*b^*c, -63)
+}
+
+// blake2bLong is the variable length hash H' of Argon2.
+func blake2bLong(out, in []byte) {
+	if len(out) <= blake2b.Size {
+		h, _ := blake2b.New(len(out), nil)
+		writeUint32(h, uint32(len(out)))
+		h.Write(in)
+		h.Sum(out[:0])
+		return
+	}
+
+	h, _ := blake2b.New512(nil)
+	writeUint32(h, uint32(len(out)))
+	h.Write(in)
+	v := h.Sum(nil)
+	for {
+		copy(out, v[:32])
+		if out = out[32:]; len(out) <= blake2b.Size {
+			break
+		}
+		h.Reset()
+		h.Write(v)
+		v = h.Sum(v[:0])
+	}
+
+	// The last up to 64 bytes are a hash of the last V with their own
+	// length.
+	h, _ = blake2b.New(len(out), nil)
+	h.Write(v)
+	h.Sum(out[:0])
+}
+
+func writeUint32(h io.Writer, v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	h.Write(b[:])
+}
@@ -0,0 +1,35 @@
+package kdbx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArgon2d(t *testing.T) {
+	// RFC 9106 section 5.1.
+	key := argon2d(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16), bytes.Repeat([]byte{3}, 8), bytes.Repeat([]byte{4}, 12), 3, 32, 4, 32)
+	assert.Equal(t, "512b391b6f1162975371d30919734294f868e3be3984f3c1a13a4db9fabe4acb", hex.EncodeToString(key))
+
+	// Generated with the reference implementation's command line.
+	tests := []struct {
+		time, memory, threads uint32
+		hash                  string
+	}{
+		{1, 64, 1, "8727405fd07c32c78d64f547f24150d3f2e703a89f981a19"},
+		{2, 64, 1, "3be9ec79a69b75d3752acb59a1fbb8b295a46529c48fbb75"},
+		{2, 64, 2, "68e2462c98b8bc6bb60ec68db418ae2c9ed24fc6748a40e9"},
+		{3, 256, 2, "f4f0669218eaf3641f39cc97efb915721102f4b128211ef2"},
+		{4, 4096, 4, "935598181aa8dc2b720914aa6435ac8d3e3a4210c5b0fb2d"},
+		{4, 1024, 8, "83604fc2ad0589b9d055578f4d3cc55bc616df3578a896e9"},
+		{2, 64, 3, "22474a423bda2ccd36ec9afd5119e5c8949798cadf659f51"},
+		{3, 1024, 6, "a3351b0319a53229152023d9206902f4ef59661cdca89481"},
+	}
+
+	for _, test := range tests {
+		key := argon2d([]byte("password"), []byte("somesalt"), nil, nil, test.time, test.memory, test.threads, 24)
+		assert.Equal(t, test.hash, hex.EncodeToString(key), "%+v", test)
+	}
+}
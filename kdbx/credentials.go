@@ -0,0 +1,150 @@
+package kdbx
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+)
+
+// Credentials returns the entries of the database as credentials. The title,
+// user name, password, URL and notes map onto the credential's fields, other
+// fields onto metadata, protected ones as secret: metadata, and the path of
+// the entry's group below the root onto its folder.
+func (db *Database) Credentials() []models.Credential {
+	var credentials []models.Credential
+	var walk func(g Group, folder string)
+	walk = func(g Group, folder string) {
+		for _, e := range g.Entries {
+			credentials = append(credentials, credential(e, folder))
+		}
+
+		for _, sub := range g.Groups {
+			path := sub.Name
+			if folder != "" {
+				path = folder + "/" + sub.Name
+			}
+			walk(sub, path)
+		}
+	}
+
+	walk(db.Root, "")
+	return credentials
+}
+
+func credential(e Entry, folder string) models.Credential {
+	c := models.Credential{
+		Uid:       e.UUID,
+		Tags:      e.Tags,
+		CreatedAt: models.CustomTime(e.CreatedAt),
+		UpdatedAt: models.CustomTime(e.UpdatedAt),
+		Metadata:  map[string]string{},
+	}
+
+	for _, field := range e.Fields {
+		switch field.Key {
+		case FieldTitle:
+			c.Service = strings.TrimSpace(field.Value)
+		case FieldUserName:
+			c.Username = strings.TrimSpace(field.Value)
+		case FieldPassword:
+			c.Password = field.Value
+		case FieldNotes:
+			c.Description = field.Value
+		case FieldURL:
+			if url := strings.TrimSpace(field.Value); url != "" {
+				c.Metadata[storage.URLMetadataKey] = url
+			}
+		default:
+			key := field.Key
+			if field.Protected && !models.IsSecretMetadata(key) {
+				key = models.SecretMetadataPrefix + key
+			}
+
+			if field.Value != "" {
+				c.Metadata[key] = field.Value
+			}
+		}
+	}
+
+	if folder != "" {
+		c.Metadata[models.FolderMetadataKey] = folder
+	}
+
+	if len(c.Metadata) == 0 {
+		c.Metadata = nil
+	}
+	return c
+}
+
+// FromCredentials returns a database of the credentials, the reverse of
+// Credentials: folders become groups and secret: metadata protected fields.
+func FromCredentials(name string, credentials []models.Credential) *Database {
+	db := &Database{Name: name, Root: Group{Name: name}}
+	for _, c := range credentials {
+		group := &db.Root
+		for _, part := range strings.Split(c.Metadata[models.FolderMetadataKey], "/") {
+			if part = strings.TrimSpace(part); part != "" {
+				group = group.subgroup(part)
+			}
+		}
+		group.Entries = append(group.Entries, entry(c))
+	}
+	return db
+}
+
+func (g *Group) subgroup(name string) *Group {
+	for i := range g.Groups {
+		if g.Groups[i].Name == name {
+			return &g.Groups[i]
+		}
+	}
+
+	g.Groups = append(g.Groups, Group{Name: name})
+	return &g.Groups[len(g.Groups)-1]
+}
+
+func entry(c models.Credential) Entry {
+	e := Entry{
+		UUID:      c.Uid,
+		Tags:      c.Tags,
+		CreatedAt: time.Time(c.CreatedAt),
+		UpdatedAt: time.Time(c.UpdatedAt),
+		Fields: []Field{
+			{Key: FieldTitle, Value: c.Service},
+			{Key: FieldUserName, Value: c.Username},
+			{Key: FieldPassword, Value: c.Password, Protected: true},
+			{Key: FieldURL, Value: c.Metadata[storage.URLMetadataKey]},
+			{Key: FieldNotes, Value: c.Description},
+		},
+	}
+
+	used := map[string]bool{FieldTitle: true, FieldUserName: true, FieldPassword: true, FieldURL: true, FieldNotes: true}
+	keys := make([]string, 0, len(c.Metadata))
+	for key := range c.Metadata {
+		if key != storage.URLMetadataKey && key != models.FolderMetadataKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		protected := models.IsSecretMetadata(key)
+		name := strings.TrimPrefix(key, models.SecretMetadataPrefix)
+		if used[name] {
+			name = key
+		}
+
+		// Keys must be unique within an entry.
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s (%d)", key, n)
+		}
+
+		used[name] = true
+		e.Fields = append(e.Fields, Field{Key: name, Value: c.Metadata[key], Protected: protected})
+	}
+	return e
+}
@@ -0,0 +1,426 @@
+// Package kdbx reads and writes KeePass databases in the KDBX 4 format,
+// protected by a password only; key files are not supported.
+package kdbx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+var (
+	// ErrInvalidFile is returned for data that is not a readable KDBX 4
+	// database.
+	ErrInvalidFile = errors.New("invalid KDBX database")
+	// ErrInvalidPassword is returned when the password does not open the
+	// database.
+	ErrInvalidPassword = errors.New("invalid password")
+	// ErrUnsupported is returned for databases using features this package
+	// does not implement, or key derivation costs above its limits.
+	ErrUnsupported = errors.New("unsupported KDBX database")
+)
+
+const (
+	signature1 = 0x9AA2D903
+	signature2 = 0xB54BFB67
+	// version is the version written, KDBX 4.0; 4.1 is read as well.
+	version = 4 << 16
+)
+
+// Outer header fields.
+const (
+	headerEnd         = 0
+	headerCipher      = 2
+	headerCompression = 3
+	headerMasterSeed  = 4
+	headerIV          = 7
+	headerKdf         = 11
+)
+
+// Inner header fields.
+const (
+	innerEnd       = 0
+	innerStreamId  = 1
+	innerStreamKey = 2
+)
+
+// chaCha20Stream is the inner random stream protecting values in KDBX 4.
+const chaCha20Stream = 3
+
+// blockSize is the size of the HMAC blocks written.
+const blockSize = 1 << 20
+
+// maxPayload bounds the decompressed size of a database read.
+const maxPayload = 256 << 20
+
+// Ciphers encrypting the payload.
+const (
+	CipherAES256   = "aes256"
+	CipherChaCha20 = "chacha20"
+)
+
+var cipherIds = map[string][]byte{
+	CipherAES256:   {0x31, 0xc1, 0xf2, 0xe6, 0xbf, 0x71, 0x43, 0x50, 0xbe, 0x58, 0x05, 0x21, 0x6a, 0xfc, 0x5a, 0xff},
+	CipherChaCha20: {0xd6, 0x03, 0x8a, 0x2b, 0x8b, 0x6f, 0x4c, 0xb5, 0xa5, 0x24, 0x33, 0x9a, 0x31, 0xdb, 0xb5, 0x9a},
+}
+
+// Options are the encryption settings of a written database.
+type Options struct {
+	Cipher string
+	// KDF is KDFArgon2d, KDFArgon2id or KDFAES. Iterations are the rounds
+	// of AES-KDF.
+	KDF         string
+	Iterations  uint64
+	Memory      uint64
+	Parallelism uint32
+}
+
+// DefaultOptions are those of a new KeePassXC database: AES-256 and 64 MiB
+// of Argon2d.
+var DefaultOptions = Options{
+	Cipher:      CipherAES256,
+	KDF:         KDFArgon2d,
+	Iterations:  10,
+	Memory:      64 << 20,
+	Parallelism: 2,
+}
+
+// IsDatabase reports whether the data starts like a KeePass database.
+func IsDatabase(data []byte) bool {
+	return len(data) >= 8 && binary.LittleEndian.Uint32(data) == signature1 && binary.LittleEndian.Uint32(data[4:]) == signature2
+}
+
+// Read opens a database with its password.
+func Read(data []byte, password string) (*Database, error) {
+	r := bytes.NewReader(data)
+	var sig [3]uint32
+	if err := binary.Read(r, binary.LittleEndian, &sig); err != nil || sig[0] != signature1 || sig[1] != signature2 {
+		return nil, ErrInvalidFile
+	}
+
+	if major := sig[2] >> 16; major != 4 {
+		return nil, fmt.Errorf("%w KDBX %d, only KDBX 4 is supported", ErrUnsupported, major)
+	}
+
+	fields := make(map[byte][]byte)
+	for {
+		id, value, err := readField(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if id == headerEnd {
+			break
+		}
+		fields[id] = value
+	}
+
+	header := data[:len(data)-r.Len()]
+	var sum, mac [32]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return nil, fmt.Errorf("%w truncated header", ErrInvalidFile)
+	}
+
+	if _, err := io.ReadFull(r, mac[:]); err != nil {
+		return nil, fmt.Errorf("%w truncated header", ErrInvalidFile)
+	}
+
+	if expected := sha256.Sum256(header); !hmac.Equal(sum[:], expected[:]) {
+		return nil, fmt.Errorf("%w corrupt header", ErrInvalidFile)
+	}
+
+	seed := fields[headerMasterSeed]
+	if len(seed) != 32 {
+		return nil, fmt.Errorf("%w invalid master seed", ErrInvalidFile)
+	}
+
+	kdf, err := readVariants(fields[headerKdf])
+	if err != nil {
+		return nil, err
+	}
+
+	transformed, err := transformKey(compositeKey(password), kdf)
+	if err != nil {
+		return nil, err
+	}
+
+	hmacKey := hmacBaseKey(seed, transformed)
+	if !hmac.Equal(mac[:], blockMAC(hmacKey, math.MaxUint64, header)) {
+		return nil, ErrInvalidPassword
+	}
+
+	var payload []byte
+	for i := uint64(0); ; i++ {
+		var size int32
+		if _, err := io.ReadFull(r, mac[:]); err != nil {
+			return nil, fmt.Errorf("%w truncated block %d", ErrInvalidFile, i)
+		}
+
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil || size < 0 || int(size) > r.Len() {
+			return nil, fmt.Errorf("%w invalid block %d", ErrInvalidFile, i)
+		}
+
+		block := make([]byte, size)
+		io.ReadFull(r, block)
+		if !hmac.Equal(mac[:], blockMAC(hmacKey, i, block)) {
+			return nil, fmt.Errorf("%w corrupt block %d", ErrInvalidFile, i)
+		}
+
+		if size == 0 {
+			break
+		}
+		payload = append(payload, block...)
+	}
+
+	key := sha256.Sum256(append(append([]byte{}, seed...), transformed...))
+	if payload, err = decrypt(fields[headerCipher], key[:], fields[headerIV], payload); err != nil {
+		return nil, err
+	}
+
+	if compression := fields[headerCompression]; len(compression) == 4 && binary.LittleEndian.Uint32(compression) == 1 {
+		gz, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("%w %v", ErrInvalidFile, err)
+		}
+
+		if payload, err = ioutil.ReadAll(io.LimitReader(gz, maxPayload+1)); err != nil || len(payload) > maxPayload {
+			return nil, fmt.Errorf("%w invalid compressed payload", ErrInvalidFile)
+		}
+	}
+
+	r = bytes.NewReader(payload)
+	inner := make(map[byte][]byte)
+	for {
+		id, value, err := readField(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if id == innerEnd {
+			break
+		}
+
+		// Attachments are repeated and not kept.
+		if id == innerStreamId || id == innerStreamKey {
+			inner[id] = value
+		}
+	}
+
+	if id := inner[innerStreamId]; len(id) != 4 || binary.LittleEndian.Uint32(id) != chaCha20Stream {
+		return nil, fmt.Errorf("%w inner stream, only ChaCha20 is supported", ErrUnsupported)
+	}
+
+	stream, err := innerStream(inner[innerStreamKey])
+	if err != nil {
+		return nil, err
+	}
+	return decodeXML(payload[len(payload)-r.Len():], stream)
+}
+
+// Write writes the database protected by the password.
+func Write(w io.Writer, db *Database, password string, opts Options) error {
+	id, ok := cipherIds[opts.Cipher]
+	if !ok {
+		return fmt.Errorf("%w cipher %q", ErrUnsupported, opts.Cipher)
+	}
+
+	secrets := make([]byte, 32+32+64+16)
+	if _, err := io.ReadFull(rand.Reader, secrets); err != nil {
+		return err
+	}
+
+	seed, salt, streamKey, iv := secrets[:32], secrets[32:64], secrets[64:128], secrets[128:]
+	if opts.Cipher == CipherChaCha20 {
+		iv = iv[:12]
+	}
+
+	kdf, err := newKdf(opts, salt)
+	if err != nil {
+		return err
+	}
+
+	var header bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, []uint32{signature1, signature2, version})
+	writeField(&header, headerCipher, id)
+	writeField(&header, headerCompression, []byte{1, 0, 0, 0})
+	writeField(&header, headerMasterSeed, seed)
+	writeField(&header, headerIV, iv)
+	writeField(&header, headerKdf, writeVariants(kdf))
+	writeField(&header, headerEnd, []byte("\r\n\r\n"))
+
+	transformed, err := transformKey(compositeKey(password), kdf)
+	if err != nil {
+		return err
+	}
+
+	stream, err := innerStream(streamKey)
+	if err != nil {
+		return err
+	}
+
+	doc, err := encodeXML(db, stream)
+	if err != nil {
+		return err
+	}
+
+	var payload bytes.Buffer
+	gz := gzip.NewWriter(&payload)
+	writeField(gz, innerStreamId, []byte{chaCha20Stream, 0, 0, 0})
+	writeField(gz, innerStreamKey, streamKey)
+	writeField(gz, innerEnd, nil)
+	gz.Write(doc)
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	key := sha256.Sum256(append(append([]byte{}, seed...), transformed...))
+	encrypted, err := encrypt(opts.Cipher, key[:], iv, payload.Bytes())
+	if err != nil {
+		return err
+	}
+
+	hmacKey := hmacBaseKey(seed, transformed)
+	sum := sha256.Sum256(header.Bytes())
+	out := bytes.NewBuffer(header.Bytes())
+	out.Write(sum[:])
+	out.Write(blockMAC(hmacKey, math.MaxUint64, header.Bytes()))
+	for i := uint64(0); ; i++ {
+		n := len(encrypted)
+		if n > blockSize {
+			n = blockSize
+		}
+
+		block := encrypted[:n]
+		out.Write(blockMAC(hmacKey, i, block))
+		binary.Write(out, binary.LittleEndian, int32(n))
+		out.Write(block)
+		if n == 0 {
+			break
+		}
+		encrypted = encrypted[n:]
+	}
+
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+func readField(r *bytes.Reader) (byte, []byte, error) {
+	var id byte
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &id); err != nil {
+		return 0, nil, fmt.Errorf("%w truncated header", ErrInvalidFile)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil || int64(size) > int64(r.Len()) {
+		return 0, nil, fmt.Errorf("%w invalid header field %d", ErrInvalidFile, id)
+	}
+
+	value := make([]byte, size)
+	io.ReadFull(r, value)
+	return id, value, nil
+}
+
+func writeField(w io.Writer, id byte, value []byte) {
+	w.Write([]byte{id})
+	binary.Write(w, binary.LittleEndian, uint32(len(value)))
+	w.Write(value)
+}
+
+func compositeKey(password string) []byte {
+	sum := sha256.Sum256([]byte(password))
+	sum = sha256.Sum256(sum[:])
+	return sum[:]
+}
+
+func hmacBaseKey(seed, transformed []byte) []byte {
+	h := sha512.New()
+	h.Write(seed)
+	h.Write(transformed)
+	h.Write([]byte{1})
+	return h.Sum(nil)
+}
+
+// blockMAC authenticates the i-th block of the payload, or the header when i
+// is MaxUint64.
+func blockMAC(hmacKey []byte, i uint64, block []byte) []byte {
+	var index [8]byte
+	binary.LittleEndian.PutUint64(index[:], i)
+	key := sha512.Sum512(append(index[:], hmacKey...))
+
+	mac := hmac.New(sha256.New, key[:])
+	if i != math.MaxUint64 {
+		mac.Write(index[:])
+		binary.Write(mac, binary.LittleEndian, int32(len(block)))
+	}
+	mac.Write(block)
+	return mac.Sum(nil)
+}
+
+func decrypt(id, key, iv, payload []byte) ([]byte, error) {
+	switch {
+	case bytes.Equal(id, cipherIds[CipherAES256]):
+		block, _ := aes.NewCipher(key)
+		if len(iv) != aes.BlockSize || len(payload) == 0 || len(payload)%aes.BlockSize != 0 {
+			return nil, fmt.Errorf("%w invalid payload", ErrInvalidFile)
+		}
+
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(payload, payload)
+		pad := int(payload[len(payload)-1])
+		if pad == 0 || pad > aes.BlockSize {
+			return nil, fmt.Errorf("%w invalid padding", ErrInvalidFile)
+		}
+		return payload[:len(payload)-pad], nil
+	case bytes.Equal(id, cipherIds[CipherChaCha20]):
+		stream, err := chacha20.NewUnauthenticatedCipher(key, iv)
+		if err != nil {
+			return nil, fmt.Errorf("%w %v", ErrInvalidFile, err)
+		}
+
+		stream.XORKeyStream(payload, payload)
+		return payload, nil
+	default:
+		return nil, fmt.Errorf("%w cipher, only AES-256 and ChaCha20 are supported", ErrUnsupported)
+	}
+}
+
+func encrypt(name string, key, iv, payload []byte) ([]byte, error) {
+	if name == CipherChaCha20 {
+		stream, err := chacha20.NewUnauthenticatedCipher(key, iv)
+		if err != nil {
+			return nil, err
+		}
+
+		stream.XORKeyStream(payload, payload)
+		return payload, nil
+	}
+
+	block, _ := aes.NewCipher(key)
+	pad := aes.BlockSize - len(payload)%aes.BlockSize
+	payload = append(payload, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(payload, payload)
+	return payload, nil
+}
+
+// innerStream returns the cipher protecting values like passwords within
+// the XML document.
+func innerStream(key []byte) (*chacha20.Cipher, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%w missing inner stream key", ErrInvalidFile)
+	}
+
+	sum := sha512.Sum512(key)
+	return chacha20.NewUnauthenticatedCipher(sum[:32], sum[32:44])
+}
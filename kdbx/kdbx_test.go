@@ -0,0 +1,214 @@
+package kdbx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// testOptions keep the key derivation cheap.
+var testOptions = Options{Cipher: CipherAES256, KDF: KDFArgon2d, Iterations: 2, Memory: 1 << 20, Parallelism: 2}
+
+func testCredentials() []models.Credential {
+	created := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	return []models.Credential{
+		{
+			Uid:         uuid.Must(uuid.NewV4()),
+			Service:     "GitHub",
+			Username:    "octocat",
+			Password:    "correct horse",
+			Description: "work\naccount",
+			Tags:        []string{"dev", "work"},
+			Metadata: map[string]string{
+				"url":        "https://github.com",
+				"folder":     "Work/Dev",
+				"secret:pin": "1234",
+				"team":       "platform",
+			},
+			CreatedAt: models.CustomTime(created),
+			UpdatedAt: models.CustomTime(created.Add(time.Hour)),
+		},
+		{
+			Uid:       uuid.Must(uuid.NewV4()),
+			Service:   "Bank",
+			Username:  "carol",
+			Password:  "<&>\"'",
+			CreatedAt: models.CustomTime(created),
+			UpdatedAt: models.CustomTime(created),
+		},
+		{
+			Uid:       uuid.Must(uuid.NewV4()),
+			Service:   "Mail",
+			Username:  "dave",
+			Password:  "pw",
+			Metadata:  map[string]string{"folder": "Work"},
+			CreatedAt: models.CustomTime(created),
+			UpdatedAt: models.CustomTime(created),
+		},
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	credentials := testCredentials()
+	for _, opts := range []Options{
+		testOptions,
+		{Cipher: CipherChaCha20, KDF: KDFArgon2id, Iterations: 2, Memory: 1 << 20, Parallelism: 2},
+		{Cipher: CipherAES256, KDF: KDFAES, Iterations: 1000},
+	} {
+		var buf bytes.Buffer
+		assert.NoError(t, Write(&buf, FromCredentials("jackstand", credentials), "s3cret", opts))
+
+		db, err := Read(buf.Bytes(), "s3cret")
+		if !assert.NoError(t, err, "%+v", opts) {
+			continue
+		}
+
+		assert.Equal(t, "jackstand", db.Name)
+		read := db.Credentials()
+		assert.Len(t, read, 3)
+
+		// Entries come back grouped by folder.
+		byService := map[string]models.Credential{}
+		for _, c := range read {
+			byService[c.Service] = c
+		}
+
+		for _, c := range credentials {
+			assert.Equal(t, c, byService[c.Service], "%+v", opts)
+		}
+	}
+}
+
+func TestGroups(t *testing.T) {
+	db := FromCredentials("jackstand", testCredentials())
+	assert.Len(t, db.Root.Entries, 1)
+	assert.Len(t, db.Root.Groups, 1)
+	assert.Equal(t, "Work", db.Root.Groups[0].Name)
+	assert.Len(t, db.Root.Groups[0].Entries, 1)
+	assert.Equal(t, "Dev", db.Root.Groups[0].Groups[0].Name)
+
+	entry := db.Root.Groups[0].Groups[0].Entries[0]
+	assert.Equal(t, "1234", entry.Get("pin"))
+	assert.Equal(t, "https://github.com", entry.Get(FieldURL))
+	for _, field := range entry.Fields {
+		assert.Equal(t, field.Key == FieldPassword || field.Key == "pin", field.Protected, field.Key)
+	}
+}
+
+func TestRecycleBin(t *testing.T) {
+	db := FromCredentials("jackstand", testCredentials()[:1])
+	bin := Group{UUID: uuid.Must(uuid.NewV4()), Name: "Recycle Bin", Entries: []Entry{entry(testCredentials()[1])}}
+	db.Root.Groups = append(db.Root.Groups, bin)
+
+	doc, err := encodeXML(db, noStream{})
+	assert.NoError(t, err)
+	doc = bytes.Replace(doc, []byte("<RecycleBinEnabled>False</RecycleBinEnabled>"),
+		[]byte("<RecycleBinEnabled>True</RecycleBinEnabled><RecycleBinUUID>"+encodeUUID(bin.UUID)+"</RecycleBinUUID>"), 1)
+
+	read, err := decodeXML(doc, noStream{})
+	assert.NoError(t, err)
+	assert.Len(t, read.Credentials(), 1)
+}
+
+// TestFixture reads testdata/fixture.kdbx, which testdata/fixture.py writes
+// without this package in the layout of KeePassXC databases.
+func TestFixture(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/fixture.kdbx")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = Read(data, "s3cret")
+	assert.ErrorIs(t, err, ErrInvalidPassword)
+
+	db, err := Read(data, "jackstand")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "Passwords", db.Name)
+	created := models.CustomTime(time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC))
+	assert.Equal(t, []models.Credential{
+		{
+			Uid:       uuid.Must(uuid.FromString("0b8e5a6c-7d2f-4e1a-9b3c-5d7e9f1a2b3c")),
+			Service:   "Bank",
+			Username:  "carol",
+			Password:  "<&>\"'",
+			CreatedAt: created,
+			UpdatedAt: created,
+		},
+		{
+			Uid:       uuid.Must(uuid.FromString("7c1d2e3f-4a5b-4c6d-8e9f-0a1b2c3d4e5f")),
+			Service:   "Mail",
+			Username:  "dave",
+			Password:  "pw",
+			Metadata:  map[string]string{"folder": "Work"},
+			CreatedAt: created,
+			UpdatedAt: created,
+		},
+		{
+			Uid:         uuid.Must(uuid.FromString("5f0c3e9a-1b2d-4c6e-8f0a-1b2c3d4e5f60")),
+			Service:     "GitHub",
+			Username:    "octocat",
+			Password:    "correct horse",
+			Description: "work\naccount",
+			Tags:        []string{"dev", "work"},
+			Metadata: map[string]string{
+				"url":        "https://github.com",
+				"folder":     "Work/Dev",
+				"secret:PIN": "1234",
+				"team":       "platform",
+			},
+			CreatedAt: created,
+			UpdatedAt: models.CustomTime(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)),
+		},
+	}, db.Credentials())
+}
+
+func TestReadErrors(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, Write(&buf, FromCredentials("jackstand", testCredentials()), "s3cret", testOptions))
+	data := buf.Bytes()
+
+	_, err := Read(data, "wrong")
+	assert.ErrorIs(t, err, ErrInvalidPassword)
+
+	_, err = Read([]byte("not a database"), "s3cret")
+	assert.ErrorIs(t, err, ErrInvalidFile)
+
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)-50] ^= 1
+	_, err = Read(corrupt, "s3cret")
+	assert.ErrorIs(t, err, ErrInvalidFile)
+
+	_, err = Read(data[:len(data)-40], "s3cret")
+	assert.ErrorIs(t, err, ErrInvalidFile)
+
+	kdbx3 := append([]byte{}, data...)
+	kdbx3[10] = 3
+	_, err = Read(kdbx3, "s3cret")
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	// Databases beyond the limits are neither read nor written.
+	err = Write(&buf, FromCredentials("jackstand", nil), "s3cret", Options{Cipher: CipherAES256, KDF: KDFAES, Iterations: maxAESRounds + 1})
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	for _, opts := range []Options{
+		{Cipher: CipherAES256, KDF: KDFArgon2d, Iterations: maxArgon2Iterations + 1, Memory: 1 << 20, Parallelism: 2},
+		{Cipher: CipherAES256, KDF: KDFArgon2id, Iterations: 2, Memory: maxArgon2Memory + 1<<20, Parallelism: 2},
+		{Cipher: CipherAES256, KDF: KDFArgon2d, Iterations: 2, Memory: 1 << 20, Parallelism: maxArgon2Parallelism + 1},
+	} {
+		err = Write(&buf, FromCredentials("jackstand", nil), "s3cret", opts)
+		assert.ErrorIs(t, err, ErrUnsupported)
+	}
+}
+
+// noStream leaves protected values as they are.
+type noStream struct{}
+
+func (noStream) XORKeyStream(dst, src []byte) { copy(dst, src) }
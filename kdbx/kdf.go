@@ -0,0 +1,218 @@
+package kdbx
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Key derivation functions.
+const (
+	KDFAES      = "aes"
+	KDFArgon2d  = "argon2d"
+	KDFArgon2id = "argon2id"
+)
+
+var kdfIds = map[string][]byte{
+	KDFAES:      {0xc9, 0xd9, 0xf3, 0x9a, 0x62, 0x8a, 0x44, 0x60, 0xbf, 0x74, 0x0d, 0x08, 0xc1, 0x8a, 0x4f, 0xea},
+	KDFArgon2d:  {0xef, 0x63, 0x6d, 0xdf, 0x8c, 0x29, 0x44, 0x4b, 0x91, 0xf7, 0xa9, 0xa4, 0x03, 0xe3, 0x0a, 0x0c},
+	KDFArgon2id: {0x9e, 0x29, 0x8b, 0x19, 0x56, 0xdb, 0x47, 0x73, 0xb2, 0x3d, 0xfc, 0x3e, 0xc6, 0xf0, 0xa1, 0xe6},
+}
+
+// Limits on the cost of the key derivation of a database, since opening one
+// on the server takes that much time and memory. They are close to what
+// KeePassXC creates by default, so its databases open while an upload cannot
+// tie up the server; databases beyond them fail with ErrUnsupported.
+const (
+	maxAESRounds         = 1 << 24
+	maxArgon2Memory      = 256 << 20
+	maxArgon2Iterations  = 10
+	maxArgon2Parallelism = 64
+)
+
+// Types of variant values.
+const (
+	variantUint32 = 0x04
+	variantUint64 = 0x05
+	variantBytes  = 0x42
+)
+
+// variants is a KeePass variant dictionary, which holds the parameters of
+// the key derivation.
+type variants []variant
+
+type variant struct {
+	key   string
+	kind  byte
+	value []byte
+}
+
+func readVariants(b []byte) (variants, error) {
+	r := bytes.NewReader(b)
+	var version uint16
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, fmt.Errorf("%w missing key derivation parameters", ErrInvalidFile)
+	}
+
+	if version>>8 != 1 {
+		return nil, fmt.Errorf("%w key derivation parameters version %#x", ErrUnsupported, version)
+	}
+
+	var v variants
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w truncated key derivation parameters", ErrInvalidFile)
+		}
+
+		if kind == 0 {
+			return v, nil
+		}
+
+		var key, value []byte
+		for _, field := range []*[]byte{&key, &value} {
+			var size int32
+			if err := binary.Read(r, binary.LittleEndian, &size); err != nil || size < 0 || int(size) > r.Len() {
+				return nil, fmt.Errorf("%w invalid key derivation parameters", ErrInvalidFile)
+			}
+
+			*field = make([]byte, size)
+			r.Read(*field)
+		}
+		v = append(v, variant{key: string(key), kind: kind, value: value})
+	}
+}
+
+func writeVariants(v variants) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint16(0x0100))
+	for i := range v {
+		b.WriteByte(v[i].kind)
+		binary.Write(&b, binary.LittleEndian, int32(len(v[i].key)))
+		b.WriteString(v[i].key)
+		binary.Write(&b, binary.LittleEndian, int32(len(v[i].value)))
+		b.Write(v[i].value)
+	}
+	b.WriteByte(0)
+	return b.Bytes()
+}
+
+func (v variants) bytes(key string) []byte {
+	for i := range v {
+		if v[i].key == key && v[i].kind == variantBytes {
+			return v[i].value
+		}
+	}
+	return nil
+}
+
+func (v variants) uint32(key string) (uint32, bool) {
+	for i := range v {
+		if v[i].key == key && v[i].kind == variantUint32 && len(v[i].value) == 4 {
+			return binary.LittleEndian.Uint32(v[i].value), true
+		}
+	}
+	return 0, false
+}
+
+func (v variants) uint64(key string) (uint64, bool) {
+	for i := range v {
+		if v[i].key == key && v[i].kind == variantUint64 && len(v[i].value) == 8 {
+			return binary.LittleEndian.Uint64(v[i].value), true
+		}
+	}
+	return 0, false
+}
+
+func uint32Variant(key string, value uint32) variant {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, value)
+	return variant{key: key, kind: variantUint32, value: b}
+}
+
+func uint64Variant(key string, value uint64) variant {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, value)
+	return variant{key: key, kind: variantUint64, value: b}
+}
+
+// newKdf returns the key derivation parameters of the options.
+func newKdf(opts Options, salt []byte) (variants, error) {
+	id, ok := kdfIds[opts.KDF]
+	if !ok {
+		return nil, fmt.Errorf("%w key derivation %q", ErrUnsupported, opts.KDF)
+	}
+
+	v := variants{{key: "$UUID", kind: variantBytes, value: id}}
+	if opts.KDF == KDFAES {
+		return append(v, uint64Variant("R", opts.Iterations), variant{key: "S", kind: variantBytes, value: salt}), nil
+	}
+
+	return append(v,
+		variant{key: "S", kind: variantBytes, value: salt},
+		uint32Variant("P", opts.Parallelism),
+		uint64Variant("M", opts.Memory),
+		uint64Variant("I", opts.Iterations),
+		uint32Variant("V", argon2Version),
+	), nil
+}
+
+// transformKey derives the key of the database from the composite key of
+// its credentials.
+func transformKey(composite []byte, kdf variants) ([]byte, error) {
+	id := kdf.bytes("$UUID")
+	switch {
+	case bytes.Equal(id, kdfIds[KDFAES]):
+		rounds, ok := kdf.uint64("R")
+		seed := kdf.bytes("S")
+		if !ok || len(seed) != 32 {
+			return nil, fmt.Errorf("%w invalid AES-KDF parameters", ErrInvalidFile)
+		}
+
+		if rounds > maxAESRounds {
+			return nil, fmt.Errorf("%w more than %d AES-KDF rounds", ErrUnsupported, maxAESRounds)
+		}
+
+		block, _ := aes.NewCipher(seed)
+		key := append([]byte{}, composite...)
+		for i := uint64(0); i < rounds; i++ {
+			block.Encrypt(key[:16], key[:16])
+			block.Encrypt(key[16:], key[16:])
+		}
+		sum := sha256.Sum256(key)
+		return sum[:], nil
+	case bytes.Equal(id, kdfIds[KDFArgon2d]), bytes.Equal(id, kdfIds[KDFArgon2id]):
+		salt := kdf.bytes("S")
+		parallelism, okP := kdf.uint32("P")
+		memory, okM := kdf.uint64("M")
+		iterations, okI := kdf.uint64("I")
+		version, okV := kdf.uint32("V")
+		if len(salt) == 0 || !okP || !okM || !okI || !okV || parallelism == 0 || iterations == 0 {
+			return nil, fmt.Errorf("%w invalid Argon2 parameters", ErrInvalidFile)
+		}
+
+		switch {
+		case version != argon2Version:
+			return nil, fmt.Errorf("%w Argon2 version %#x", ErrUnsupported, version)
+		case memory > maxArgon2Memory || iterations > maxArgon2Iterations || parallelism > maxArgon2Parallelism:
+			return nil, fmt.Errorf("%w Argon2 parameters above the limits of %d MiB, %d iterations and %d threads",
+				ErrUnsupported, maxArgon2Memory>>20, maxArgon2Iterations, maxArgon2Parallelism)
+		}
+
+		secret, data := kdf.bytes("K"), kdf.bytes("A")
+		if bytes.Equal(id, kdfIds[KDFArgon2d]) {
+			return argon2d(composite, salt, secret, data, uint32(iterations), uint32(memory/1024), parallelism, 32), nil
+		}
+
+		if len(secret) > 0 || len(data) > 0 {
+			return nil, fmt.Errorf("%w Argon2id with a secret or associated data", ErrUnsupported)
+		}
+		return argon2.IDKey(composite, salt, uint32(iterations), uint32(memory/1024), uint8(parallelism), 32), nil
+	default:
+		return nil, fmt.Errorf("%w key derivation, only AES-KDF and Argon2 are supported", ErrUnsupported)
+	}
+}
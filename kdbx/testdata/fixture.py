@@ -0,0 +1,231 @@
+#!/usr/bin/env python3
+"""Writes fixture.kdbx, a KDBX 4 database laid out like those KeePassXC
+saves, to check the reader against a database it did not write.
+
+It is written from the KDBX 4 format rather than with this package, using
+only the standard library and the openssl command for AES and ChaCha20.
+The database is gzip compressed, encrypted with AES-256 and keyed with
+AES-KDF, has an inner header attachment, a recycle bin, entry history and
+protected custom fields, as KeePassXC writes them. The password is
+"jackstand".
+
+    python3 fixture.py
+"""
+
+import base64
+import calendar
+import gzip
+import hashlib
+import hmac
+import os
+import struct
+import subprocess
+from xml.sax.saxutils import escape
+
+PASSWORD = b"jackstand"
+ROUNDS = 6000
+
+AES_CIPHER = bytes.fromhex("31c1f2e6bf714350be5805216afc5aff")
+AES_KDF = bytes.fromhex("c9d9f39a628a4460bf740d08c18a4fea")
+
+
+def openssl(args, data):
+    return subprocess.run(["openssl", "enc"] + args, input=data, stdout=subprocess.PIPE, check=True).stdout
+
+
+def aes_kdf(key, seed, rounds):
+    # In CBC with a zero IV each block after the first is encrypted with the
+    # previous ciphertext, so zero blocks repeat the encryption of the first.
+    out = b""
+    for half in (key[:16], key[16:]):
+        data = half + bytes(16 * (rounds - 1))
+        out += openssl(["-aes-256-cbc", "-nopad", "-K", seed.hex(), "-iv", "00" * 16], data)[-16:]
+    return hashlib.sha256(out).digest()
+
+
+def variants(entries):
+    out = struct.pack("<H", 0x0100)
+    for kind, key, value in entries:
+        out += struct.pack("<Bi", kind, len(key)) + key + struct.pack("<i", len(value)) + value
+    return out + b"\x00"
+
+
+def field(id, value):
+    return struct.pack("<Bi", id, len(value)) + value
+
+
+def block_key(hmac_key, i):
+    return hashlib.sha512(struct.pack("<Q", i) + hmac_key).digest()
+
+
+def kdbx_time(year, month, day, hour=0, minute=0, second=0):
+    # Seconds since 0001-01-01, computed from the Unix time.
+    unix = calendar.timegm((year, month, day, hour, minute, second, 0, 0, 0))
+    return base64.b64encode(struct.pack("<q", unix + 62135596800)).decode()
+
+
+def uid(hexstr):
+    return base64.b64encode(bytes.fromhex(hexstr)).decode()
+
+
+class Protector:
+    """Encrypts protected values with the inner ChaCha20 stream, which runs
+    through the values in document order."""
+
+    def __init__(self, key):
+        digest = hashlib.sha512(key).digest()
+        self.stream = openssl(["-chacha20", "-K", digest[:32].hex(), "-iv", "00000000" + digest[32:44].hex()], bytes(1 << 16))
+        self.offset = 0
+
+    def __call__(self, value):
+        value = value.encode()
+        ks = self.stream[self.offset:self.offset + len(value)]
+        self.offset += len(value)
+        return base64.b64encode(bytes(a ^ b for a, b in zip(value, ks))).decode()
+
+
+def times(created, modified):
+    return (
+        "<Times><LastModificationTime>%s</LastModificationTime><CreationTime>%s</CreationTime>"
+        "<LastAccessTime>%s</LastAccessTime><ExpiryTime>%s</ExpiryTime><Expires>False</Expires>"
+        "<UsageCount>0</UsageCount><LocationChanged>%s</LocationChanged></Times>"
+        % (modified, created, modified, kdbx_time(4001, 1, 1), created)
+    )
+
+
+def string(protect, key, value, protected=False):
+    if protected:
+        return "<String><Key>%s</Key><Value Protected=\"True\">%s</Value></String>" % (escape(key), protect(value))
+    if value == "":
+        return "<String><Key>%s</Key><Value/></String>" % escape(key)
+    return "<String><Key>%s</Key><Value>%s</Value></String>" % (escape(key), escape(value))
+
+
+def entry(protect, id, fields, created, modified, tags="", history=""):
+    out = "<Entry><UUID>%s</UUID><IconID>0</IconID><ForegroundColor/><BackgroundColor/><OverrideURL/>" % uid(id)
+    out += "<Tags>%s</Tags>" % escape(tags) if tags else "<Tags/>"
+    out += times(created, modified)
+    for key, value, protected in fields:
+        out += string(protect, key, value, protected)
+    out += "<AutoType><Enabled>True</Enabled><DataTransferObfuscation>0</DataTransferObfuscation></AutoType>"
+    # The history follows the fields, so it is written after them.
+    out += "<History>%s</History></Entry>" % history() if history else "<History/></Entry>"
+    return out
+
+
+def group(id, name, created, content):
+    return (
+        "<Group><UUID>%s</UUID><Name>%s</Name><Notes/><IconID>48</IconID>%s<IsExpanded>True</IsExpanded>"
+        "<DefaultAutoTypeSequence/><EnableAutoType>null</EnableAutoType><EnableSearching>null</EnableSearching>"
+        "<LastTopVisibleEntry>AAAAAAAAAAAAAAAAAAAAAA==</LastTopVisibleEntry>%s</Group>"
+        % (uid(id), escape(name), times(created, created), content)
+    )
+
+
+def document(protect):
+    created = kdbx_time(2021, 3, 4, 5, 6, 7)
+    modified = kdbx_time(2021, 6, 1, 12, 0, 0)
+    recycle_bin = "a4a1f00dc0ffee00a4a1f00dc0ffee01"
+
+    # Values are protected in document order, so entries are written in the
+    # order they appear.
+    bank = entry(protect, "0b8e5a6c7d2f4e1a9b3c5d7e9f1a2b3c", [
+        ("Notes", "", False),
+        ("Password", "<&>\"'", True),
+        ("Title", "Bank", False),
+        ("URL", "", False),
+        ("UserName", "carol", False),
+    ], created, created)
+    mail = entry(protect, "7c1d2e3f4a5b4c6d8e9f0a1b2c3d4e5f", [
+        ("Notes", "", False),
+        ("Password", "pw", True),
+        ("Title", "Mail", False),
+        ("URL", "", False),
+        ("UserName", "dave", False),
+    ], created, created)
+    github_history = lambda: entry(protect, "5f0c3e9a1b2d4c6e8f0a1b2c3d4e5f60", [
+        ("Title", "GitHub", False),
+        ("UserName", "octocat", False),
+        ("Password", "old horse", True),
+    ], created, created)
+    github = entry(protect, "5f0c3e9a1b2d4c6e8f0a1b2c3d4e5f60", [
+        ("Notes", "work\naccount", False),
+        ("Password", "correct horse", True),
+        ("PIN", "1234", True),
+        ("team", "platform", False),
+        ("Title", "GitHub", False),
+        ("URL", "https://github.com", False),
+        ("UserName", "octocat", False),
+    ], created, modified, tags="dev;work", history=github_history)
+    deleted = entry(protect, "d1e2f3a4b5c64d7e8f9a0b1c2d3e4f5a", [
+        ("Password", "gone", True),
+        ("Title", "Deleted", False),
+        ("UserName", "erin", False),
+    ], created, created)
+
+    dev = group("3a4b5c6d7e8f4a0b9c1d2e3f4a5b6c7d", "Dev", created, github)
+    work = group("1f2e3d4c5b6a49788796a5b4c3d2e1f0", "Work", created, mail + dev)
+    bin_ = group(recycle_bin, "Recycle Bin", created, deleted)
+    root = group("9e8d7c6b5a4948372615f4e3d2c1b0a9", "Root", created, bank + work + bin_)
+
+    meta = (
+        "<Meta><Generator>KeePassXC</Generator><DatabaseName>Passwords</DatabaseName>"
+        "<DatabaseNameChanged>%s</DatabaseNameChanged><DatabaseDescription/>"
+        "<DatabaseDescriptionChanged>%s</DatabaseDescriptionChanged><DefaultUserName/>"
+        "<DefaultUserNameChanged>%s</DefaultUserNameChanged><MaintenanceHistoryDays>365</MaintenanceHistoryDays>"
+        "<Color/><MasterKeyChanged>%s</MasterKeyChanged><MasterKeyChangeRec>-1</MasterKeyChangeRec>"
+        "<MasterKeyChangeForce>-1</MasterKeyChangeForce><MemoryProtection><ProtectTitle>False</ProtectTitle>"
+        "<ProtectUserName>False</ProtectUserName><ProtectPassword>True</ProtectPassword>"
+        "<ProtectURL>False</ProtectURL><ProtectNotes>False</ProtectNotes></MemoryProtection>"
+        "<CustomIcons/><RecycleBinEnabled>True</RecycleBinEnabled><RecycleBinUUID>%s</RecycleBinUUID>"
+        "<RecycleBinChanged>%s</RecycleBinChanged><EntryTemplatesGroup>AAAAAAAAAAAAAAAAAAAAAA==</EntryTemplatesGroup>"
+        "<EntryTemplatesGroupChanged>%s</EntryTemplatesGroupChanged>"
+        "<LastSelectedGroup>AAAAAAAAAAAAAAAAAAAAAA==</LastSelectedGroup>"
+        "<LastTopVisibleGroup>AAAAAAAAAAAAAAAAAAAAAA==</LastTopVisibleGroup><HistoryMaxItems>10</HistoryMaxItems>"
+        "<HistoryMaxSize>6291456</HistoryMaxSize><SettingsChanged>%s</SettingsChanged>"
+        "<CustomData><Item><Key>KPXC_DECRYPTION_TIME_PREFERENCE</Key><Value>1000</Value></Item></CustomData></Meta>"
+        % ((created,) * 4 + (uid(recycle_bin),) + (created,) * 3)
+    )
+    deleted_objects = "<DeletedObjects><DeletedObject><UUID>%s</UUID><DeletionTime>%s</DeletionTime></DeletedObject></DeletedObjects>" % (
+        uid("f0e1d2c3b4a5968778695a4b3c2d1e0f"), modified)
+    return ('<?xml version="1.0" encoding="UTF-8" standalone="no"?>\n<KeePassFile>%s<Root>%s%s</Root></KeePassFile>\n'
+            % (meta, root, deleted_objects)).encode()
+
+
+def main():
+    master_seed = os.urandom(32)
+    iv = os.urandom(16)
+    kdf_seed = os.urandom(32)
+    stream_key = os.urandom(64)
+
+    header = struct.pack("<III", 0x9AA2D903, 0xB54BFB67, 0x00040000)
+    header += field(2, AES_CIPHER)
+    header += field(3, struct.pack("<I", 1))
+    header += field(4, master_seed)
+    header += field(7, iv)
+    header += field(11, variants([(0x42, b"$UUID", AES_KDF), (0x05, b"R", struct.pack("<Q", ROUNDS)), (0x42, b"S", kdf_seed)]))
+    header += field(0, b"\r\n\r\n")
+
+    composite = hashlib.sha256(hashlib.sha256(PASSWORD).digest()).digest()
+    transformed = aes_kdf(composite, kdf_seed, ROUNDS)
+    hmac_key = hashlib.sha512(master_seed + transformed + b"\x01").digest()
+    key = hashlib.sha256(master_seed + transformed).digest()
+
+    inner = field(1, struct.pack("<I", 3)) + field(2, stream_key)
+    inner += field(3, b"\x01attachment.txt contents")
+    inner += field(0, b"")
+    payload = gzip.compress(inner + document(Protector(stream_key)))
+    payload = openssl(["-aes-256-cbc", "-K", key.hex(), "-iv", iv.hex()], payload)
+
+    out = header + hashlib.sha256(header).digest()
+    out += hmac.new(block_key(hmac_key, 2**64 - 1), header, hashlib.sha256).digest()
+    for i, block in enumerate([payload, b""]):
+        mac = hmac.new(block_key(hmac_key, i), struct.pack("<Qi", i, len(block)) + block, hashlib.sha256).digest()
+        out += mac + struct.pack("<i", len(block)) + block
+
+    with open(os.path.join(os.path.dirname(os.path.abspath(__file__)), "fixture.kdbx"), "wb") as f:
+        f.write(out)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,292 @@
+package kdbx
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Keys of the standard fields of an entry.
+const (
+	FieldTitle    = "Title"
+	FieldUserName = "UserName"
+	FieldPassword = "Password"
+	FieldURL      = "URL"
+	FieldNotes    = "Notes"
+)
+
+// Database is the content of a KeePass database that credentials map onto.
+// Entry history, attachments and icons are not kept.
+type Database struct {
+	Name string
+	Root Group
+}
+
+type Group struct {
+	UUID    uuid.UUID
+	Name    string
+	Entries []Entry
+	Groups  []Group
+}
+
+type Entry struct {
+	UUID      uuid.UUID
+	Fields    []Field
+	Tags      []string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Field is a string field of an entry. Protected fields, like the password,
+// are encrypted once more within the database.
+type Field struct {
+	Key       string
+	Value     string
+	Protected bool
+}
+
+// Get returns the value of the field with the key.
+func (e Entry) Get(key string) string {
+	for i := range e.Fields {
+		if e.Fields[i].Key == key {
+			return e.Fields[i].Value
+		}
+	}
+	return ""
+}
+
+type xmlFile struct {
+	XMLName xml.Name `xml:"KeePassFile"`
+	Meta    xmlMeta  `xml:"Meta"`
+	Root    struct {
+		Group xmlGroup `xml:"Group"`
+	} `xml:"Root"`
+}
+
+type xmlMeta struct {
+	Generator         string `xml:"Generator"`
+	DatabaseName      string `xml:"DatabaseName"`
+	RecycleBinEnabled string `xml:"RecycleBinEnabled"`
+	RecycleBinUUID    string `xml:"RecycleBinUUID,omitempty"`
+}
+
+// xmlGroup lists entries before subgroups, the order KeePass writes them
+// in, which the order of protected values relies on.
+type xmlGroup struct {
+	UUID    string     `xml:"UUID"`
+	Name    string     `xml:"Name"`
+	Entries []xmlEntry `xml:"Entry"`
+	Groups  []xmlGroup `xml:"Group"`
+}
+
+type xmlEntry struct {
+	UUID  string `xml:"UUID"`
+	Tags  string `xml:"Tags,omitempty"`
+	Times struct {
+		CreationTime         string `xml:"CreationTime"`
+		LastModificationTime string `xml:"LastModificationTime"`
+	} `xml:"Times"`
+	Strings []xmlString `xml:"String"`
+}
+
+type xmlString struct {
+	Key   string `xml:"Key"`
+	Value struct {
+		Protected string `xml:"Protected,attr,omitempty"`
+		Text      string `xml:",chardata"`
+	} `xml:"Value"`
+}
+
+// epoch is where KDBX 4 counts times from, in seconds before the Unix epoch.
+const epoch = 62135596800
+
+func decodeXML(doc []byte, stream cipher.Stream) (*Database, error) {
+	doc, err := unprotect(doc, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	var f xmlFile
+	if err := xml.Unmarshal(doc, &f); err != nil {
+		return nil, fmt.Errorf("%w %v", ErrInvalidFile, err)
+	}
+
+	var recycleBin string
+	if strings.EqualFold(f.Meta.RecycleBinEnabled, "true") {
+		recycleBin = f.Meta.RecycleBinUUID
+	}
+
+	var decodeGroup func(g xmlGroup) Group
+	decodeGroup = func(g xmlGroup) Group {
+		group := Group{UUID: decodeUUID(g.UUID), Name: g.Name}
+		for _, e := range g.Entries {
+			entry := Entry{
+				UUID:      decodeUUID(e.UUID),
+				CreatedAt: decodeTime(e.Times.CreationTime),
+				UpdatedAt: decodeTime(e.Times.LastModificationTime),
+			}
+
+			for _, tag := range strings.FieldsFunc(e.Tags, func(r rune) bool { return r == ';' || r == ',' }) {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					entry.Tags = append(entry.Tags, tag)
+				}
+			}
+
+			for _, s := range e.Strings {
+				entry.Fields = append(entry.Fields, Field{
+					Key:       s.Key,
+					Value:     s.Value.Text,
+					Protected: strings.EqualFold(s.Value.Protected, "true"),
+				})
+			}
+			group.Entries = append(group.Entries, entry)
+		}
+
+		for i := range g.Groups {
+			// Deleted entries are kept in the recycle bin.
+			if recycleBin == "" || g.Groups[i].UUID != recycleBin {
+				group.Groups = append(group.Groups, decodeGroup(g.Groups[i]))
+			}
+		}
+		return group
+	}
+
+	return &Database{Name: f.Meta.DatabaseName, Root: decodeGroup(f.Root.Group)}, nil
+}
+
+// unprotect decrypts the protected values of the document, which the inner
+// stream encrypts in document order.
+func unprotect(doc []byte, stream cipher.Stream) ([]byte, error) {
+	var out bytes.Buffer
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	encoder := xml.NewEncoder(&out)
+	protected := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w %v", ErrInvalidFile, err)
+		}
+
+		switch t := token.(type) {
+		case xml.ProcInst:
+			continue
+		case xml.StartElement:
+			protected = false
+			for _, attr := range t.Attr {
+				if t.Name.Local == "Value" && attr.Name.Local == "Protected" && strings.EqualFold(attr.Value, "true") {
+					protected = true
+				}
+			}
+		case xml.EndElement:
+			protected = false
+		case xml.CharData:
+			if protected {
+				value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(t)))
+				if err != nil {
+					return nil, fmt.Errorf("%w invalid protected value", ErrInvalidFile)
+				}
+
+				stream.XORKeyStream(value, value)
+				token = xml.CharData(value)
+			}
+		}
+
+		if err := encoder.EncodeToken(token); err != nil {
+			return nil, fmt.Errorf("%w %v", ErrInvalidFile, err)
+		}
+	}
+
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func encodeXML(db *Database, stream cipher.Stream) ([]byte, error) {
+	var encodeGroup func(g Group) xmlGroup
+	encodeGroup = func(g Group) xmlGroup {
+		group := xmlGroup{UUID: encodeUUID(g.UUID), Name: g.Name}
+		for _, e := range g.Entries {
+			var entry xmlEntry
+			entry.UUID = encodeUUID(e.UUID)
+			entry.Tags = strings.Join(e.Tags, ";")
+			entry.Times.CreationTime = encodeTime(e.CreatedAt)
+			entry.Times.LastModificationTime = encodeTime(e.UpdatedAt)
+			entry.Strings = make([]xmlString, len(e.Fields))
+
+			for i, field := range e.Fields {
+				entry.Strings[i].Key = field.Key
+				entry.Strings[i].Value.Text = field.Value
+				if field.Protected {
+					value := []byte(field.Value)
+					stream.XORKeyStream(value, value)
+					entry.Strings[i].Value.Protected = "True"
+					entry.Strings[i].Value.Text = base64.StdEncoding.EncodeToString(value)
+				}
+			}
+			group.Entries = append(group.Entries, entry)
+		}
+
+		for i := range g.Groups {
+			group.Groups = append(group.Groups, encodeGroup(g.Groups[i]))
+		}
+		return group
+	}
+
+	f := xmlFile{Meta: xmlMeta{Generator: "jackstand", DatabaseName: db.Name, RecycleBinEnabled: "False"}}
+	f.Root.Group = encodeGroup(db.Root)
+	doc, err := xml.MarshalIndent(f, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), doc...), nil
+}
+
+func decodeUUID(s string) uuid.UUID {
+	b, _ := base64.StdEncoding.DecodeString(s)
+	id, err := uuid.FromBytes(b)
+	if err != nil {
+		return uuid.Nil
+	}
+	return id
+}
+
+func encodeUUID(id uuid.UUID) string {
+	if id == uuid.Nil {
+		id = uuid.Must(uuid.NewV4())
+	}
+	return base64.StdEncoding.EncodeToString(id.Bytes())
+}
+
+// decodeTime reads the base64 encoded seconds of KDBX 4, or the ISO 8601
+// times of earlier versions.
+func decodeTime(s string) time.Time {
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 8 {
+		return time.Unix(int64(binary.LittleEndian.Uint64(b))-epoch, 0).UTC()
+	}
+
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+func encodeTime(t time.Time) string {
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(t.Unix()+epoch))
+	return base64.StdEncoding.EncodeToString(b[:])
+}
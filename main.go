@@ -33,6 +33,36 @@ func main() {
 				Log: log,
 			}, nil
 		},
+		"migrate": func() (cli.Command, error) {
+			return &api.MigrateCommand{
+				Cfg: cfg,
+				Log: log,
+			}, nil
+		},
+		"encrypt": func() (cli.Command, error) {
+			return &api.EncryptCommand{
+				Cfg: cfg,
+				Log: log,
+			}, nil
+		},
+		"export": func() (cli.Command, error) {
+			return &api.ExportCommand{
+				Cfg: cfg,
+				Log: log,
+			}, nil
+		},
+		"import": func() (cli.Command, error) {
+			return &api.ImportCommand{
+				Cfg: cfg,
+				Log: log,
+			}, nil
+		},
+		"rotate-keys": func() (cli.Command, error) {
+			return &api.RotateKeysCommand{
+				Cfg: cfg,
+				Log: log,
+			}, nil
+		},
 	}
 
 	_, err := c.Run()
@@ -0,0 +1,261 @@
+package manifest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Name is the metadata document holding a user's manifest. The S3 store
+// keeps it at users/<userId>/_index.json.
+const Name = "index"
+
+// Manifest summarises every credential of a user so listings can be served
+// from a single read instead of one read per credential.
+type Manifest struct {
+	Credentials []models.CredentialSummary `json:"credentials"`
+	// UpdatedAt is when the manifest last changed, including deletions, so
+	// it can serve as the Last-Modified time of a user's listing.
+	UpdatedAt models.CustomTime `json:"updatedAt"`
+}
+
+// Index keeps the manifests of a store up to date. Writes to a single user's
+// manifest are serialised within the process; drift from concurrent writers
+// elsewhere is repaired by Reconcile.
+type Index struct {
+	log   *logrus.Logger
+	store storage.CredentialStore
+
+	mu    sync.Mutex
+	locks map[string]*userLock
+}
+
+// userLock is a user's lock and the number of writers holding or waiting for
+// it, so it can be dropped when there are none.
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+func New(log *logrus.Logger, store storage.CredentialStore) *Index {
+	return &Index{
+		log:   log,
+		store: store,
+		locks: make(map[string]*userLock),
+	}
+}
+
+// Get returns the user's manifest, building it from their credentials if it
+// does not exist yet.
+func (i *Index) Get(ctx context.Context, userId string) (Manifest, error) {
+	var m Manifest
+	err := i.store.GetMetadata(ctx, userId, Name, &m)
+	if errors.Is(err, storage.ErrNotFound) {
+		m, _, err = i.Rebuild(ctx, userId)
+	}
+	return m, err
+}
+
+// Put adds or replaces the summary of a credential in the user's manifest.
+// When the manifest cannot be updated it is dropped, to be rebuilt on the
+// next read, so an error means the stored manifest may be stale.
+func (i *Index) Put(ctx context.Context, userId string, c models.Credential) error {
+	return i.update(ctx, userId, func(m *Manifest) {
+		m.remove(c.Uid)
+		m.Credentials = append(m.Credentials, c.Summary())
+		m.sort()
+	})
+}
+
+// Remove drops a credential from the user's manifest, see Put for errors.
+func (i *Index) Remove(ctx context.Context, userId string, credentialUid uuid.UUID) error {
+	return i.update(ctx, userId, func(m *Manifest) {
+		m.remove(credentialUid)
+	})
+}
+
+// Rebuild replaces the user's manifest with one built from their stored
+// credentials and reports whether it differed from the stored manifest. Like
+// Put, it drops the manifest when it cannot be rebuilt.
+func (i *Index) Rebuild(ctx context.Context, userId string) (Manifest, bool, error) {
+	unlock := i.lock(userId)
+	defer unlock()
+
+	m, drifted, err := i.rebuild(ctx, userId)
+	if err != nil {
+		return m, false, i.invalidate(ctx, userId, err)
+	}
+	return m, drifted, nil
+}
+
+func (i *Index) rebuild(ctx context.Context, userId string) (Manifest, bool, error) {
+	credentials, err := i.store.List(ctx, userId)
+	if err != nil {
+		return Manifest{}, false, err
+	}
+
+	m := Manifest{Credentials: make([]models.CredentialSummary, 0, len(credentials))}
+	for j := range credentials {
+		m.Credentials = append(m.Credentials, credentials[j].Summary())
+	}
+	m.sort()
+
+	var existing Manifest
+	err = i.store.GetMetadata(ctx, userId, Name, &existing)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return m, false, err
+	}
+
+	if err == nil && existing.equal(m) {
+		return existing, false, nil
+	}
+	m.UpdatedAt = models.CustomTime(time.Now())
+	return m, true, i.store.PutMetadata(ctx, userId, Name, m)
+}
+
+// Reconcile rebuilds the manifest of every user in the store, logging the
+// users whose manifest had drifted from their credentials.
+func (i *Index) Reconcile(ctx context.Context) error {
+	users, err := i.store.Users(ctx)
+	if err != nil {
+		return err
+	}
+
+	for j := range users {
+		_, drifted, err := i.Rebuild(ctx, users[j])
+		if err != nil {
+			i.log.WithError(err).WithFields(logrus.Fields{"userId": users[j]}).Error("error reconciling manifest")
+			continue
+		}
+
+		if drifted {
+			i.log.WithFields(logrus.Fields{"userId": users[j]}).Warn("rebuilt drifted manifest")
+		}
+	}
+	return nil
+}
+
+// Run reconciles every interval until the context is done.
+func (i *Index) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := i.Reconcile(ctx); err != nil {
+				i.log.WithError(err).Error("error reconciling manifests")
+			}
+		}
+	}
+}
+
+// update applies fn to the stored manifest, rebuilding it from the
+// credentials instead when there is none yet.
+func (i *Index) update(ctx context.Context, userId string, fn func(m *Manifest)) error {
+	unlock := i.lock(userId)
+
+	var m Manifest
+	err := i.store.GetMetadata(ctx, userId, Name, &m)
+	if errors.Is(err, storage.ErrNotFound) {
+		unlock()
+		_, _, err = i.Rebuild(ctx, userId)
+		return err
+	}
+	defer unlock()
+
+	if err == nil {
+		fn(&m)
+		m.UpdatedAt = models.CustomTime(time.Now())
+		err = i.store.PutMetadata(ctx, userId, Name, m)
+	}
+
+	if err != nil {
+		return i.invalidate(ctx, userId, err)
+	}
+	return nil
+}
+
+// invalidate drops the user's manifest after the update that failed with err,
+// so a listing rebuilds it rather than answering from a stale manifest. It
+// returns nil once the manifest is gone.
+func (i *Index) invalidate(ctx context.Context, userId string, err error) error {
+	i.log.WithError(err).WithFields(logrus.Fields{"userId": userId}).Warn("error updating manifest, dropping it")
+	if derr := i.store.DeleteMetadata(ctx, userId, Name); derr != nil && !errors.Is(derr, storage.ErrNotFound) {
+		return fmt.Errorf("error dropping stale manifest %v after %w", derr, err)
+	}
+	return nil
+}
+
+// lock locks the user's manifest and returns the function that unlocks it.
+func (i *Index) lock(userId string) func() {
+	i.mu.Lock()
+	l, ok := i.locks[userId]
+	if !ok {
+		l = &userLock{}
+		i.locks[userId] = l
+	}
+	l.refs++
+	i.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(i.locks, userId)
+		}
+	}
+}
+
+func (m *Manifest) remove(credentialUid uuid.UUID) {
+	kept := m.Credentials[:0]
+	for i := range m.Credentials {
+		if m.Credentials[i].Uid != credentialUid {
+			kept = append(kept, m.Credentials[i])
+		}
+	}
+	m.Credentials = kept
+}
+
+// sort orders the summaries by uid, the same order the stores list in.
+func (m *Manifest) sort() {
+	sort.Slice(m.Credentials, func(i, j int) bool {
+		return m.Credentials[i].Uid.String() < m.Credentials[j].Uid.String()
+	})
+}
+
+// Find returns the summary of a credential in the manifest.
+func (m Manifest) Find(credentialUid uuid.UUID) (models.CredentialSummary, bool) {
+	for i := range m.Credentials {
+		if m.Credentials[i].Uid == credentialUid {
+			return m.Credentials[i], true
+		}
+	}
+	return models.CredentialSummary{}, false
+}
+
+func (m Manifest) equal(other Manifest) bool {
+	if len(m.Credentials) != len(other.Credentials) {
+		return false
+	}
+
+	for i := range m.Credentials {
+		if !reflect.DeepEqual(m.Credentials[i], other.Credentials[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package manifest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brianvoe/gofakeit"
+	"github.com/dbubel/jackstand-api/memory"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func randomCredential() models.Credential {
+	return models.Credential{
+		Uid:      uuid.Must(uuid.NewV4()),
+		Service:  gofakeit.HackerVerb(),
+		Username: gofakeit.BeerAlcohol(),
+		Password: gofakeit.JobLevel(),
+	}
+}
+
+// TestMain runs the tests in America/New_York, where models.CustomTime
+// writes times, so that they are read back as the same instants.
+func TestMain(m *testing.M) {
+	time.Local, _ = time.LoadLocation("America/New_York")
+	os.Exit(m.Run())
+}
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	store := memory.NewStore()
+	index := New(logrus.New(), store)
+
+	first := randomCredential()
+	assert.NoError(t, store.Create(ctx, userId, first))
+
+	t.Run("test get builds a missing manifest", func(t *testing.T) {
+		m, err := index.Get(ctx, userId)
+		assert.NoError(t, err)
+		assert.Len(t, m.Credentials, 1)
+		assert.Equal(t, first.Uid, m.Credentials[0].Uid)
+	})
+
+	second := randomCredential()
+	t.Run("test locks are dropped once released", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, index.Put(ctx, userId, first))
+			}()
+		}
+		wg.Wait()
+		assert.Empty(t, index.locks)
+	})
+
+	t.Run("test put", func(t *testing.T) {
+		assert.NoError(t, store.Create(ctx, userId, second))
+		assert.NoError(t, index.Put(ctx, userId, second))
+
+		second.Username = "coffee"
+		assert.NoError(t, index.Put(ctx, userId, second))
+
+		m, err := index.Get(ctx, userId)
+		assert.NoError(t, err)
+		assert.Len(t, m.Credentials, 2)
+		for _, s := range m.Credentials {
+			if s.Uid == second.Uid {
+				assert.Equal(t, "coffee", s.Username)
+			}
+		}
+	})
+
+	t.Run("test remove", func(t *testing.T) {
+		assert.NoError(t, index.Remove(ctx, userId, first.Uid))
+		m, err := index.Get(ctx, userId)
+		assert.NoError(t, err)
+		assert.Len(t, m.Credentials, 1)
+		assert.Equal(t, second.Uid, m.Credentials[0].Uid)
+	})
+
+	t.Run("test rebuild repairs drift", func(t *testing.T) {
+		_, drifted, err := index.Rebuild(ctx, userId)
+		assert.NoError(t, err)
+		assert.True(t, drifted)
+
+		m, err := index.Get(ctx, userId)
+		assert.NoError(t, err)
+		assert.Len(t, m.Credentials, 2)
+
+		_, drifted, err = index.Rebuild(ctx, userId)
+		assert.NoError(t, err)
+		assert.False(t, drifted)
+	})
+
+	t.Run("test reconcile", func(t *testing.T) {
+		other := gofakeit.Username()
+		assert.NoError(t, store.Create(ctx, other, randomCredential()))
+		assert.NoError(t, index.Reconcile(ctx))
+
+		m, err := index.Get(ctx, other)
+		assert.NoError(t, err)
+		assert.Len(t, m.Credentials, 1)
+	})
+	t.Run("test failed update drops the manifest", func(t *testing.T) {
+		store.SetFaults(memory.Faults{Err: func(op string) error {
+			if op == "PutMetadata" {
+				return errors.New("slow down")
+			}
+			return nil
+		}})
+		assert.NoError(t, index.Remove(ctx, userId, first.Uid))
+		store.SetFaults(memory.Faults{})
+
+		var m Manifest
+		assert.ErrorIs(t, store.GetMetadata(ctx, userId, Name, &m), storage.ErrNotFound)
+		m, err := index.Get(ctx, userId)
+		assert.NoError(t, err)
+		assert.Len(t, m.Credentials, 2)
+	})
+
+	t.Run("test failed drop is returned", func(t *testing.T) {
+		store.SetFaults(memory.Faults{Err: func(op string) error {
+			if op == "PutMetadata" || op == "DeleteMetadata" {
+				return errors.New("slow down")
+			}
+			return nil
+		}})
+		defer store.SetFaults(memory.Faults{})
+		assert.Error(t, index.Put(ctx, userId, first))
+	})
+}
@@ -0,0 +1,263 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+)
+
+// Faults makes a Store misbehave so tests can exercise slow and failing
+// storage without a real backend.
+type Faults struct {
+	// Latency delays every call, or until the context is done.
+	Latency time.Duration
+	// Err is called with the name of the operation ("Create", "Get", ...)
+	// before it runs; a non nil error is returned instead of running it.
+	Err func(op string) error
+}
+
+// Store is a thread safe in memory storage.CredentialStore. Credentials are
+// kept JSON encoded, just like the other stores, so callers never share maps
+// or slices with the store.
+type Store struct {
+	mu       sync.RWMutex
+	users    map[string]map[uuid.UUID][]byte
+	metadata map[string]map[string][]byte
+	faults   Faults
+}
+
+func NewStore() *Store {
+	return &Store{
+		users:    make(map[string]map[uuid.UUID][]byte),
+		metadata: make(map[string]map[string][]byte),
+	}
+}
+
+// SetFaults replaces the faults injected into every following call.
+func (s *Store) SetFaults(f Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = f
+}
+
+func (s *Store) Create(ctx context.Context, userId string, credential models.Credential) error {
+	if err := s.inject(ctx, "Create"); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users[userId] == nil {
+		s.users[userId] = make(map[uuid.UUID][]byte)
+	}
+	s.users[userId][credential.Uid] = buf
+	return nil
+}
+
+func (s *Store) Get(ctx context.Context, userId string, credentialUid uuid.UUID) (models.Credential, error) {
+	var credential models.Credential
+	if err := s.inject(ctx, "Get"); err != nil {
+		return credential, err
+	}
+
+	s.mu.RLock()
+	buf, ok := s.users[userId][credentialUid]
+	s.mu.RUnlock()
+	if !ok {
+		return credential, storage.ErrNotFound
+	}
+
+	err := json.Unmarshal(buf, &credential)
+	return credential, err
+}
+
+// List returns the user's credentials ordered by uid, matching the key order
+// of the other stores.
+func (s *Store) List(ctx context.Context, userId string) ([]models.Credential, error) {
+	if err := s.inject(ctx, "List"); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	credentials := make([]models.Credential, 0, len(s.users[userId]))
+	for _, buf := range s.users[userId] {
+		var credential models.Credential
+		if err := json.Unmarshal(buf, &credential); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].Uid.String() < credentials[j].Uid.String()
+	})
+	return credentials, nil
+}
+
+func (s *Store) Update(ctx context.Context, userId string, credential models.Credential) error {
+	if err := s.inject(ctx, "Update"); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[userId][credential.Uid]; !ok {
+		return storage.ErrNotFound
+	}
+	s.users[userId][credential.Uid] = buf
+	return nil
+}
+
+func (s *Store) Delete(ctx context.Context, userId string, credentialUid uuid.UUID) error {
+	if err := s.inject(ctx, "Delete"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users[userId], credentialUid)
+	return nil
+}
+
+func (s *Store) DeleteAll(ctx context.Context, userId string) error {
+	if err := s.inject(ctx, "DeleteAll"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, userId)
+	return nil
+}
+
+func (s *Store) Users(ctx context.Context) ([]string, error) {
+	if err := s.inject(ctx, "Users"); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seen := make(map[string]bool)
+	users := make([]string, 0, len(s.users))
+	for userId := range s.users {
+		if len(s.users[userId]) > 0 {
+			seen[userId] = true
+			users = append(users, userId)
+		}
+	}
+
+	for userId := range s.metadata {
+		if len(s.metadata[userId]) > 0 && !seen[userId] {
+			users = append(users, userId)
+		}
+	}
+
+	sort.Strings(users)
+	return users, nil
+}
+
+func (s *Store) GetMetadata(ctx context.Context, userId, name string, v interface{}) error {
+	if err := s.inject(ctx, "GetMetadata"); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	buf, ok := s.metadata[userId][name]
+	s.mu.RUnlock()
+	if !ok {
+		return storage.ErrNotFound
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func (s *Store) PutMetadata(ctx context.Context, userId, name string, v interface{}) error {
+	if err := s.inject(ctx, "PutMetadata"); err != nil {
+		return err
+	}
+
+	if err := storage.CheckMetadataName(name); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.metadata[userId] == nil {
+		s.metadata[userId] = make(map[string][]byte)
+	}
+	s.metadata[userId][name] = buf
+	return nil
+}
+
+func (s *Store) DeleteMetadata(ctx context.Context, userId, name string) error {
+	if err := s.inject(ctx, "DeleteMetadata"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.metadata[userId], name)
+	return nil
+}
+
+func (s *Store) ListMetadata(ctx context.Context, userId, prefix string) ([]string, error) {
+	if err := s.inject(ctx, "ListMetadata"); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var names []string
+	for name := range s.metadata[userId] {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// inject applies the configured faults for op.
+func (s *Store) inject(ctx context.Context, op string) error {
+	s.mu.RLock()
+	f := s.faults
+	s.mu.RUnlock()
+
+	if f.Latency > 0 {
+		timer := time.NewTimer(f.Latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if f.Err != nil {
+		return f.Err(op)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func testCredential(service string) models.Credential {
+	return models.Credential{
+		Uid:      uuid.Must(uuid.NewV4()),
+		Service:  service,
+		Username: "jon",
+		Password: "hunter2",
+		Metadata: map[string]string{"url": "https://example.com"},
+	}
+}
+
+// TestMain runs the tests in America/New_York, where models.CustomTime
+// writes times, so that they are read back as the same instants.
+func TestMain(m *testing.M) {
+	time.Local, _ = time.LoadLocation("America/New_York")
+	os.Exit(m.Run())
+}
+
+// inUTC returns the credentials with their times in UTC, like the ones they
+// were stored from.
+func inUTC(credentials ...models.Credential) []models.Credential {
+	for i := range credentials {
+		credentials[i].CreatedAt = models.CustomTime(time.Time(credentials[i].CreatedAt).UTC())
+		credentials[i].UpdatedAt = models.CustomTime(time.Time(credentials[i].UpdatedAt).UTC())
+	}
+	return credentials
+}
+
+func TestMemory(t *testing.T) {
+	store := NewStore()
+	ctx := context.Background()
+	cred1 := testCredential("github")
+	cred2 := testCredential("gitlab")
+
+	t.Run("test create and get credential", func(t *testing.T) {
+		assert.NoError(t, store.Create(ctx, "user1", cred1))
+		assert.NoError(t, store.Create(ctx, "user1", cred2))
+		c, err := store.Get(ctx, "user1", cred1.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, cred1, inUTC(c)[0])
+	})
+
+	t.Run("test returned credentials are copies", func(t *testing.T) {
+		c, err := store.Get(ctx, "user1", cred1.Uid)
+		assert.NoError(t, err)
+		c.Metadata["url"] = "changed"
+		c, err = store.Get(ctx, "user1", cred1.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, "https://example.com", c.Metadata["url"])
+	})
+
+	t.Run("test get credential of another user", func(t *testing.T) {
+		_, err := store.Get(ctx, "user2", cred1.Uid)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("test list credentials", func(t *testing.T) {
+		c, err := store.List(ctx, "user1")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []models.Credential{cred1, cred2}, inUTC(c...))
+
+		users, err := store.Users(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user1"}, users)
+	})
+
+	t.Run("test update credential does not exist", func(t *testing.T) {
+		err := store.Update(ctx, "user1", testCredential("bitbucket"))
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("test injected error", func(t *testing.T) {
+		boom := errors.New("boom")
+		store.SetFaults(Faults{Err: func(op string) error {
+			if op == "Get" {
+				return boom
+			}
+			return nil
+		}})
+		defer store.SetFaults(Faults{})
+
+		_, err := store.Get(ctx, "user1", cred1.Uid)
+		assert.ErrorIs(t, err, boom)
+		_, err = store.List(ctx, "user1")
+		assert.NoError(t, err)
+	})
+
+	t.Run("test injected latency honors context", func(t *testing.T) {
+		store.SetFaults(Faults{Latency: time.Minute})
+		defer store.SetFaults(Faults{})
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err := store.List(ctx, "user1")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("test delete credentials", func(t *testing.T) {
+		assert.NoError(t, store.Delete(ctx, "user1", cred1.Uid))
+		_, err := store.Get(ctx, "user1", cred1.Uid)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		assert.NoError(t, store.DeleteAll(ctx, "user1"))
+		c, err := store.List(ctx, "user1")
+		assert.NoError(t, err)
+		assert.Empty(t, c)
+	})
+}
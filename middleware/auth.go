@@ -118,6 +118,11 @@ func Auth(next intake.Handler) intake.Handler {
 
 		ctx := context.WithValue(r.Context(), "userId", localId)
 		ctx = context.WithValue(ctx, "email", email)
+
+		// When the token was issued tells how recently the user signed in.
+		if iat, ok := tok.Claims.(jwt.MapClaims)["iat"].(float64); ok {
+			ctx = context.WithValue(ctx, "issuedAt", time.Unix(int64(iat), 0))
+		}
 		*r = *r.WithContext(ctx)
 		next(w, r, params)
 	}
@@ -10,8 +10,9 @@ import (
 func Cors(next intake.Handler) intake.Handler {
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Authorization, If-Match, If-None-Match, If-Modified-Since, X-Import-Password, X-Export-Password")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified, X-Next-Cursor, Warning, Content-Disposition")
 		next(w, r, params)
 	}
 }
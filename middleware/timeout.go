@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/dbubel/intake"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Timeout cancels the context of a request after timeout, or after the
+// timeout long gives its path instead, for the routes that read or write all
+// of a user's credentials at once.
+func Timeout(timeout time.Duration, long map[string]time.Duration) intake.MiddleWare {
+	return func(next intake.Handler) intake.Handler {
+		return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+			t, ok := long[r.URL.Path]
+			if !ok {
+				t = timeout
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), t)
+			defer cancel()
+			*r = *r.WithContext(ctx)
+			next(w, r, params)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -15,8 +19,104 @@ type Credential struct {
 	Password    string `json:"password" validate:"required"`
 	Description string
 	Metadata    map[string]string
+	Tags        []string `json:"tags,omitempty"`
 	CreatedAt   CustomTime
 	UpdatedAt   CustomTime
+	// Blob is the client encrypted credential of a user in vault mode, in
+	// which case the fields above other than Uid and the timestamps are
+	// empty.
+	Blob *Blob `json:"blob,omitempty"`
+	// BlindIndex holds keyed hashes of the credential's searchable values
+	// when it is stored encrypted, so it can be found without decrypting it.
+	BlindIndex []string `json:"blindIndex,omitempty"`
+	// Envelope holds the encrypted credential when it is stored encrypted,
+	// in which case the fields above other than Uid and the timestamps are
+	// empty.
+	Envelope *Envelope `json:"envelope,omitempty"`
+}
+
+// SecretMetadataPrefix marks metadata keys whose values are secrets, like
+// "secret:pin", and are treated like the password.
+const SecretMetadataPrefix = "secret:"
+
+// IsSecretMetadata reports whether the metadata key holds a secret.
+func IsSecretMetadata(key string) bool {
+	return strings.HasPrefix(key, SecretMetadataPrefix)
+}
+
+// FolderMetadataKey holds the folder a credential is filed in, with
+// subfolders separated by "/", like "Work/Email".
+const FolderMetadataKey = "folder"
+
+// MaxBlobSize bounds the size of a blob's data.
+const MaxBlobSize = 64 << 10
+
+// Blob is a credential encrypted by the client. The server never has its key
+// and only checks its shape.
+type Blob struct {
+	KeyId         string `json:"keyId"`
+	SchemaVersion int    `json:"schemaVersion"`
+	Data          []byte `json:"data"`
+}
+
+// Validate checks the structure of the blob, not its contents.
+func (b Blob) Validate() error {
+	switch {
+	case b.KeyId == "" || len(b.KeyId) > 128:
+		return errors.New("blob keyId must be 1 to 128 characters")
+	case b.SchemaVersion < 1:
+		return errors.New("blob schemaVersion must be at least 1")
+	case len(b.Data) == 0:
+		return errors.New("blob data is required")
+	case len(b.Data) > MaxBlobSize:
+		return fmt.Errorf("blob data must be at most %d bytes", MaxBlobSize)
+	}
+	return nil
+}
+
+// Envelope is a document encrypted with AES-GCM under the data key KeyId.
+type Envelope struct {
+	KeyId      string `json:"keyId"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// CredentialSummary is the part of a credential that is safe to list without
+// exposing any secrets.
+type CredentialSummary struct {
+	Uid       uuid.UUID
+	Service   string   `json:"service"`
+	Username  string   `json:"username"`
+	Tags      []string `json:"tags,omitempty"`
+	CreatedAt CustomTime
+	UpdatedAt CustomTime
+	// ETag is the entity tag of the full credential, so a summary changes
+	// with any change to the credential, secrets included.
+	ETag string `json:"etag,omitempty"`
+}
+
+// Summary returns the summary of the credential.
+func (c Credential) Summary() CredentialSummary {
+	return CredentialSummary{
+		Uid:       c.Uid,
+		Service:   c.Service,
+		Username:  c.Username,
+		Tags:      c.Tags,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+		ETag:      c.ETag(),
+	}
+}
+
+// ETag returns a strong entity tag for the credential's current content. Any
+// change to a field, including UpdatedAt, changes the tag.
+func (c Credential) ETag() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return fmt.Sprintf("%q", hex.EncodeToString(sum[:16]))
 }
 
 type CustomTime time.Time
@@ -0,0 +1,264 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrTestFailed is returned when a test operation of a JSON Patch does not
+// match the document.
+var ErrTestFailed = errors.New("patch test failed")
+
+// Operation is a single operation of a JSON Patch.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Apply applies a JSON Patch, an array of operations, to the document. The
+// operations are applied in order and the patch fails as a whole if any of
+// them does.
+func Apply(doc, patch []byte) ([]byte, error) {
+	var d interface{}
+	if err := decode(doc, &d); err != nil {
+		return nil, err
+	}
+
+	var ops []Operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("%w %v", ErrInvalidPatch, err)
+	}
+
+	for i, op := range ops {
+		var err error
+		if d, err = apply(d, op); err != nil {
+			return nil, fmt.Errorf("operation %d %w", i, err)
+		}
+	}
+	return json.Marshal(d)
+}
+
+func apply(doc interface{}, op Operation) (interface{}, error) {
+	path, err := Pointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		var value interface{}
+		if len(op.Value) == 0 {
+			return nil, fmt.Errorf("%w %s needs a value", ErrInvalidPatch, op.Op)
+		}
+
+		if err := decode(op.Value, &value); err != nil {
+			return nil, fmt.Errorf("%w %v", ErrInvalidPatch, err)
+		}
+
+		switch op.Op {
+		case "add":
+			return add(doc, path, value)
+		case "replace":
+			if len(path) == 0 {
+				return value, nil
+			}
+
+			if doc, _, err = remove(doc, path); err != nil {
+				return nil, err
+			}
+			return add(doc, path, value)
+		default:
+			current, err := get(doc, path)
+			if err != nil {
+				return nil, err
+			}
+
+			if !reflect.DeepEqual(current, value) {
+				return nil, fmt.Errorf("%w at %s", ErrTestFailed, op.Path)
+			}
+			return doc, nil
+		}
+	case "remove":
+		doc, _, err = remove(doc, path)
+		return doc, err
+	case "move", "copy":
+		from, err := Pointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		if op.Op == "move" {
+			if op.Path != op.From && strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, fmt.Errorf("%w cannot move %s into itself", ErrInvalidPatch, op.From)
+			}
+
+			if doc, value, err = remove(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			if value, err = get(doc, from); err != nil {
+				return nil, err
+			}
+
+			// Copy the value so later operations on either location do not
+			// change the other.
+			buf, _ := json.Marshal(value)
+			if err := decode(buf, &value); err != nil {
+				return nil, err
+			}
+		}
+		return add(doc, path, value)
+	default:
+		return nil, fmt.Errorf("%w unknown op %q", ErrInvalidPatch, op.Op)
+	}
+}
+
+// Pointer splits a JSON Pointer (RFC 6901) into its unescaped reference
+// tokens. The empty pointer refers to the whole document.
+func Pointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w pointer %q must start with /", ErrInvalidPatch, pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(tokens[i], "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			value, ok := d[token]
+			if !ok {
+				return nil, fmt.Errorf("%w %q not found", ErrInvalidPatch, token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := index(token, len(d)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("%w %q not found", ErrInvalidPatch, token)
+		}
+	}
+	return doc, nil
+}
+
+// add returns the document with the value added at path, replacing an
+// existing object member or inserting into an array.
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	token, rest := path[0], path[1:]
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		if len(rest) == 0 {
+			d[token] = value
+			return d, nil
+		}
+
+		child, ok := d[token]
+		if !ok {
+			return nil, fmt.Errorf("%w %q not found", ErrInvalidPatch, token)
+		}
+
+		child, err := add(child, rest, value)
+		d[token] = child
+		return d, err
+	case []interface{}:
+		if len(rest) == 0 {
+			if token == "-" {
+				return append(d, value), nil
+			}
+
+			i, err := index(token, len(d))
+			if err != nil {
+				return nil, err
+			}
+
+			d = append(d, nil)
+			copy(d[i+1:], d[i:])
+			d[i] = value
+			return d, nil
+		}
+
+		i, err := index(token, len(d)-1)
+		if err != nil {
+			return nil, err
+		}
+
+		child, err := add(d[i], rest, value)
+		d[i] = child
+		return d, err
+	default:
+		return nil, fmt.Errorf("%w %q not found", ErrInvalidPatch, token)
+	}
+}
+
+// remove returns the document without the value at path, and the value.
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w cannot remove the whole document", ErrInvalidPatch)
+	}
+
+	token, rest := path[0], path[1:]
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w %q not found", ErrInvalidPatch, token)
+		}
+
+		if len(rest) == 0 {
+			delete(d, token)
+			return d, child, nil
+		}
+
+		child, removed, err := remove(child, rest)
+		d[token] = child
+		return d, removed, err
+	case []interface{}:
+		i, err := index(token, len(d)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(rest) == 0 {
+			removed := d[i]
+			return append(d[:i], d[i+1:]...), removed, nil
+		}
+
+		child, removed, err := remove(d[i], rest)
+		d[i] = child
+		return d, removed, err
+	default:
+		return nil, nil, fmt.Errorf("%w %q not found", ErrInvalidPatch, token)
+	}
+}
+
+// index parses an array index no greater than max.
+func index(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || token[0] < '0' || token[0] > '9' || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%w invalid array index %q", ErrInvalidPatch, token)
+	}
+	return i, nil
+}
@@ -0,0 +1,58 @@
+// Package patch applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902)
+// documents to JSON documents.
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidPatch is returned for patches that are malformed or cannot be
+// applied to the document.
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// Merge applies a JSON Merge Patch to the document. Members of the patch
+// replace those of the document, objects are merged recursively and null
+// removes a member.
+func Merge(doc, patch []byte) ([]byte, error) {
+	var d interface{}
+	if err := decode(doc, &d); err != nil {
+		return nil, err
+	}
+
+	var p interface{}
+	if err := decode(patch, &p); err != nil {
+		return nil, fmt.Errorf("%w %v", ErrInvalidPatch, err)
+	}
+	return json.Marshal(merge(d, p))
+}
+
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+			continue
+		}
+		t[key] = merge(t[key], value)
+	}
+	return t
+}
+
+// decode unmarshals JSON keeping numbers as they were written.
+func decode(buf []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
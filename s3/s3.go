@@ -4,33 +4,48 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/dbubel/jackstand-api/storage"
 	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
 )
 
+// fetchWorkers bounds the number of concurrent GetObject calls made by
+// GetCredentials for a single listing.
+const fetchWorkers = 16
+
+// ErrNoResults is returned by List when nothing exists under the prefix.
+var ErrNoResults = errors.New("no results found")
+
 func GetKeyForAllCredentials(userID string) string {
-	return fmt.Sprintf("users/%s", userID)
+	return fmt.Sprintf("users/%s/", userID)
 }
 
 func GetKeyForSingleCredential(userId string, credentialUid uuid.UUID) string {
 	return fmt.Sprintf("users/%s/%s", userId, credentialUid.String())
 }
 
-func CreateCredential(log *logrus.Logger, sess *session.Session, bucket, s3ObjectKey string, v interface{}) error {
+// GetKeyForMetadata returns the key of a user's metadata document, for
+// example users/<userId>/_index.json for the manifest.
+func GetKeyForMetadata(userId, name string) string {
+	return fmt.Sprintf("users/%s/_%s.json", userId, name)
+}
+
+func CreateCredential(ctx context.Context, log *logrus.Logger, svc s3iface.S3API, bucket, s3ObjectKey string, v interface{}) error {
 	log.WithFields(logrus.Fields{"bucket": bucket, "objectKey": s3ObjectKey}).Debug("s3 create")
 	buf, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
 
-	svc := s3.New(sess)
-	_, err = svc.PutObject(&s3.PutObjectInput{
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
 		Bucket:               aws.String(bucket),
 		Key:                  aws.String("" + s3ObjectKey),
 		Body:                 bytes.NewReader(buf),
@@ -40,37 +55,38 @@ func CreateCredential(log *logrus.Logger, sess *session.Session, bucket, s3Objec
 	return err
 }
 
-func List(ctx context.Context, log *logrus.Logger, sess *session.Session, bucket, prefix string) (*s3.ListObjectsOutput, error) {
+// List returns every object under the prefix, following continuation tokens
+// past the 1000 keys a single ListObjectsV2 call returns.
+func List(ctx context.Context, log *logrus.Logger, svc s3iface.S3API, bucket, prefix string) ([]*s3.Object, error) {
 	log.WithFields(logrus.Fields{"bucket": bucket, "objectPrefix": prefix}).Debug("s3 List")
-	svc := s3.New(sess)
-	input := &s3.ListObjectsInput{
+	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
 		Prefix: aws.String(prefix),
 	}
 
-	result, err := svc.ListObjectsWithContext(ctx, input)
-	//if aerr, ok := err.(awserr.Error); ok {
-	//	fmt.Println(aerr.Code())
-	//}
+	var objects []*s3.Object
+	err := svc.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
 
 	if err != nil {
-		return &s3.ListObjectsOutput{}, fmt.Errorf("error listing credentials %w", err)
+		return nil, fmt.Errorf("error listing credentials %w", err)
 	}
 
-	if len(result.Contents) < 1 {
-		return &s3.ListObjectsOutput{}, fmt.Errorf("no results found")
+	if len(objects) < 1 {
+		return nil, ErrNoResults
 	}
 
-	for i := range result.Contents {
-		log.WithFields(logrus.Fields{"objectKey": *result.Contents[i].Key}).Debug("found object in s3 list")
+	for i := range objects {
+		log.WithFields(logrus.Fields{"objectKey": *objects[i].Key}).Debug("found object in s3 list")
 	}
-	return result, nil
+	return objects, nil
 }
 
-func Get(log *logrus.Logger, sess *session.Session, bucket, s3ObjectKey string) ([]byte, error) {
+func Get(ctx context.Context, log *logrus.Logger, svc s3iface.S3API, bucket, s3ObjectKey string) ([]byte, error) {
 	log.WithFields(logrus.Fields{"bucket": bucket, "objectKey": s3ObjectKey}).Debug("s3 get")
-	svc := s3.New(sess)
-	resp, err := svc.GetObject(&s3.GetObjectInput{
+	resp, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(s3ObjectKey),
 	})
@@ -83,9 +99,9 @@ func Get(log *logrus.Logger, sess *session.Session, bucket, s3ObjectKey string)
 	return ioutil.ReadAll(resp.Body)
 }
 
-func GetCredential(log *logrus.Logger, sess *session.Session, bucket, s3ObjectKey string, v interface{}) error {
+func GetCredential(ctx context.Context, log *logrus.Logger, svc s3iface.S3API, bucket, s3ObjectKey string, v interface{}) error {
 	// TODO: refactor err on return to break out awserr fields
-	resp, err := Get(log, sess, bucket, s3ObjectKey)
+	resp, err := Get(ctx, log, svc, bucket, s3ObjectKey)
 	if err != nil {
 		return err
 	}
@@ -93,50 +109,108 @@ func GetCredential(log *logrus.Logger, sess *session.Session, bucket, s3ObjectKe
 	return json.Unmarshal(resp, v)
 }
 
-func GetCredentials(ctx context.Context, log *logrus.Logger, sess *session.Session, bucket, s3ObjectKey string, v interface{}) error {
-	objects, err := List(ctx, log, sess, bucket, s3ObjectKey)
+// GetCredentials fetches every object under the prefix and unmarshals them as
+// a JSON array into v, see GetObjects.
+func GetCredentials(ctx context.Context, log *logrus.Logger, svc s3iface.S3API, bucket, s3ObjectKey string, v interface{}) error {
+	objects, err := List(ctx, log, svc, bucket, s3ObjectKey)
 	if err != nil {
 		return fmt.Errorf("error listing credentials list %w", err)
 	}
 
-	var objectBlobs []json.RawMessage
-	for i := range objects.Contents {
-		objectBlob, err := Get(log, sess, bucket, *objects.Contents[i].Key)
-		if err != nil {
-			return fmt.Errorf("error getting credential in list %w", err)
+	keys := make([]string, 0, len(objects))
+	for i := range objects {
+		keys = append(keys, *objects[i].Key)
+	}
+	return GetObjects(ctx, log, svc, bucket, keys, v)
+}
+
+// GetObjects fetches the objects using a bounded pool of concurrent requests
+// and unmarshals them, in key order, as a JSON array into v. Objects that
+// cannot be fetched are left out of v and reported in a *storage.PartialError
+// rather than failing the whole listing.
+func GetObjects(ctx context.Context, log *logrus.Logger, svc s3iface.S3API, bucket string, keys []string, v interface{}) error {
+	objectBlobs := make([]json.RawMessage, len(keys))
+	objectErrs := make([]error, len(keys))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < fetchWorkers && w < len(keys); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				objectBlobs[i], objectErrs[i] = Get(ctx, log, svc, bucket, keys[i])
+			}
+		}()
+	}
+
+send:
+	for i := range keys {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break send
 		}
+	}
+	close(indexes)
+	wg.Wait()
 
-		objectBlobs = append(objectBlobs, objectBlob)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("error getting credentials in list %w", err)
 	}
 
-	jsonBlobs, err := json.Marshal(objectBlobs)
+	var partial storage.PartialError
+	fetched := objectBlobs[:0]
+	for i := range objectBlobs {
+		if objectErrs[i] == nil && !json.Valid(objectBlobs[i]) {
+			objectErrs[i] = fmt.Errorf("object is not valid json")
+		}
+
+		if objectErrs[i] != nil {
+			log.WithError(objectErrs[i]).WithFields(logrus.Fields{"objectKey": keys[i]}).Warn("error getting credential in list")
+			partial.Failures = append(partial.Failures, storage.Failure{
+				Key: keys[i],
+				Err: objectErrs[i].Error(),
+			})
+			continue
+		}
+		fetched = append(fetched, objectBlobs[i])
+	}
+
+	jsonBlobs, err := json.Marshal(fetched)
 	if err != nil {
 		return fmt.Errorf("error marshalling credential list %w", err)
 	}
 
-	return json.Unmarshal(jsonBlobs, v)
+	if err := json.Unmarshal(jsonBlobs, v); err != nil {
+		return err
+	}
+
+	if len(partial.Failures) > 0 {
+		return &partial
+	}
+	return nil
 }
 
-func DeleteCredential(log *logrus.Logger, sess *session.Session, bucket, s3ObjectKey string) error {
+func DeleteCredential(ctx context.Context, log *logrus.Logger, svc s3iface.S3API, bucket, s3ObjectKey string) error {
 	log.WithFields(logrus.Fields{"bucket": bucket, "objectKey": s3ObjectKey}).Debug("s3 delete")
-	svc := s3.New(sess)
 	input := &s3.DeleteObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(s3ObjectKey),
 	}
 
-	_, err := svc.DeleteObject(input)
+	_, err := svc.DeleteObjectWithContext(ctx, input)
 	return err
 }
 
-func DeleteAll(ctx context.Context, log *logrus.Logger, sess *session.Session, bucket, s3ObjectKey string) error {
-	objects, err := List(ctx, log, sess, bucket, s3ObjectKey)
+func DeleteAll(ctx context.Context, log *logrus.Logger, svc s3iface.S3API, bucket, s3ObjectKey string) error {
+	objects, err := List(ctx, log, svc, bucket, s3ObjectKey)
 	if err != nil {
 		return err
 	}
 
-	for i := range objects.Contents {
-		if err := DeleteCredential(log, sess, bucket, *objects.Contents[i].Key); err != nil {
+	for i := range objects {
+		if err := DeleteCredential(ctx, log, svc, bucket, *objects[i].Key); err != nil {
 			return err
 		}
 	}
@@ -1,18 +1,34 @@
 package s3
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
 var sess *session.Session
+var svc s3iface.S3API
 var log *logrus.Logger
 
 func init() {
@@ -23,12 +39,19 @@ func init() {
 		Endpoint:         &testEndpoint,
 		S3ForcePathStyle: &bs,
 	})
+	svc = s3.New(sess)
 	log = logrus.New()
 	log.SetLevel(logrus.FatalLevel)
 
 }
 
 func TestS3(t *testing.T) {
+	conn, err := net.DialTimeout("tcp", "localhost:5002", time.Second)
+	if err != nil {
+		t.Skip("localstack is not running on localhost:5002, see make localstack")
+	}
+	conn.Close()
+
 	type testStruct struct {
 		Name    string
 		Address string
@@ -46,34 +69,34 @@ func TestS3(t *testing.T) {
 	_, _ = ts, ts2
 
 	t.Run("test upload object to s3", func(t *testing.T) {
-		err := CreateCredential(log, sess, "jackstand-s3-test", "testStruct.json", ts)
+		err := CreateCredential(context.Background(), log, svc, "jackstand-s3-test", "testStruct.json", ts)
 		assert.NoError(t, err)
 	})
 
 	t.Run("test listing objects from s3", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
-		objects, err := List(ctx, log, sess, "jackstand-s3-test", "testStruct.json")
+		objects, err := List(ctx, log, svc, "jackstand-s3-test", "testStruct.json")
 		assert.NoError(t, err)
-		assert.Len(t, objects.Contents, 1)
+		assert.Len(t, objects, 1)
 	})
 
 	t.Run("test get object from s3", func(t *testing.T) {
-		resp, err := Get(log, sess, "jackstand-s3-test", "testStruct.json")
+		resp, err := Get(context.Background(), log, svc, "jackstand-s3-test", "testStruct.json")
 		_ = resp
 		assert.NoError(t, err)
 		assert.JSONEq(t, `{"Name":"Jon","Address":"Home"}`, string(resp))
 	})
 
 	t.Run("test get object from s3 does not exist", func(t *testing.T) {
-		resp, err := Get(log, sess, "jackstand-s3-test", "dne.json")
+		resp, err := Get(context.Background(), log, svc, "jackstand-s3-test", "dne.json")
 		assert.Error(t, err)
 		assert.Equal(t, []byte{}, resp)
 	})
 
 	t.Run("test get marshalled object from s3", func(t *testing.T) {
 		var m testStruct
-		err := GetCredential(log, sess, "jackstand-s3-test", "testStruct.json", &m)
+		err := GetCredential(context.Background(), log, svc, "jackstand-s3-test", "testStruct.json", &m)
 		assert.NoError(t, err)
 		assert.Equal(t, m.Name, ts.Name)
 		assert.Equal(t, m.Address, ts.Address)
@@ -83,24 +106,299 @@ func TestS3(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
 		var m []testStruct
-		err := CreateCredential(log, sess, "jackstand-s3-test", "testStruct.json", ts)
+		err := CreateCredential(context.Background(), log, svc, "jackstand-s3-test", "testStruct.json", ts)
+		assert.NoError(t, err)
+		err = CreateCredential(context.Background(), log, svc, "jackstand-s3-test", "testStruct2.json", ts2)
 		assert.NoError(t, err)
-		err = CreateCredential(log, sess, "jackstand-s3-test", "testStruct2.json", ts2)
+		err = GetCredentials(ctx, log, svc, "jackstand-s3-test", "testStruct", &m)
 		assert.NoError(t, err)
-		err = GetCredentials(ctx, log, sess, "jackstand-s3-test", "testStruct", &m)
+		assert.Contains(t, m, ts)
+		assert.Contains(t, m, ts2)
+	})
+
+	t.Run("test get marshalled object slice with cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		var m []testStruct
+		err := GetCredentials(ctx, log, svc, "jackstand-s3-test", "testStruct", &m)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("test get marshalled object slice with a bad object", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
+		defer cancel()
+		_, err := svc.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String("jackstand-s3-test"),
+			Key:    aws.String("testStruct3.json"),
+			Body:   strings.NewReader("{not json"),
+		})
 		assert.NoError(t, err)
+
+		var m []testStruct
+		err = GetCredentials(ctx, log, svc, "jackstand-s3-test", "testStruct", &m)
+		var partial *storage.PartialError
+		assert.ErrorAs(t, err, &partial)
+		assert.Len(t, partial.Failures, 1)
+		assert.Equal(t, "testStruct3.json", partial.Failures[0].Key)
 		assert.Contains(t, m, ts)
 		assert.Contains(t, m, ts2)
+		assert.NoError(t, DeleteCredential(context.Background(), log, svc, "jackstand-s3-test", "testStruct3.json"))
 	})
 
 	t.Run("test remove object from s3", func(t *testing.T) {
-		err := DeleteCredential(log, sess, "jackstand-s3-test", "testStruct.json")
+		err := DeleteCredential(context.Background(), log, svc, "jackstand-s3-test", "testStruct.json")
 		assert.NoError(t, err)
 	})
 
 	t.Run("nuke bucket", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 4000*time.Millisecond)
 		defer cancel()
-		DeleteAll(ctx, log, sess, "jackstand-s3-test", "users/")
+		DeleteAll(ctx, log, svc, "jackstand-s3-test", "users/")
 	})
 }
+
+// stubS3 is an in memory s3iface.S3API for testing without localstack. It
+// lists keys in pages of pageSize like ListObjectsV2 does, and fails
+// GetObject for the keys in failures.
+type stubS3 struct {
+	s3iface.S3API
+	mu       sync.Mutex
+	objects  map[string][]byte
+	failures map[string]error
+	pageSize int
+	pages    int
+}
+
+func newStubS3() *stubS3 {
+	return &stubS3{objects: map[string][]byte{}, failures: map[string]error{}, pageSize: 1000}
+}
+
+func (s *stubS3) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	after := aws.StringValue(input.StartAfter)
+	if token := aws.StringValue(input.ContinuationToken); token != "" {
+		after = token
+	}
+
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	s.pages++
+	out := &s3.ListObjectsV2Output{}
+	if len(keys) > s.pageSize {
+		keys = keys[:s.pageSize]
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+
+	for i := range keys {
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(keys[i])})
+	}
+	return out, nil
+}
+
+func (s *stubS3) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	in := *input
+	for {
+		out, err := s.ListObjectsV2WithContext(ctx, &in, opts...)
+		if err != nil {
+			return err
+		}
+
+		last := !aws.BoolValue(out.IsTruncated)
+		if !fn(out, last) || last {
+			return nil
+		}
+		in.ContinuationToken = out.NextContinuationToken
+	}
+}
+
+func (s *stubS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := aws.StringValue(input.Key)
+	if err := s.failures[key]; err != nil {
+		return nil, err
+	}
+
+	body, ok := s.objects[key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "the specified key does not exist", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+}
+
+// PutObjectWithContext and DeleteObjectWithContext fail once ctx is done,
+// like requests the SDK cancels.
+func (s *stubS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[aws.StringValue(input.Key)] = body
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (s *stubS3) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// putCredentials adds n credentials for the user to the stub and returns
+// them in key order.
+func (s *stubS3) putCredentials(t *testing.T, userId string, n int) []models.Credential {
+	credentials := make([]models.Credential, n)
+	for i := range credentials {
+		credentials[i] = models.Credential{Uid: uuid.Must(uuid.NewV4()), Service: "github", Username: "jon"}
+		b, err := json.Marshal(credentials[i])
+		assert.NoError(t, err)
+		s.objects[GetKeyForSingleCredential(userId, credentials[i].Uid)] = b
+	}
+
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].Uid.String() < credentials[j].Uid.String()
+	})
+	return credentials
+}
+
+func TestStubGetObjectsPartial(t *testing.T) {
+	stub := newStubS3()
+	credentials := stub.putCredentials(t, "user1", 50)
+	store := &Store{log: log, svc: stub, bucket: "jackstand-s3-test"}
+
+	failed := []string{
+		GetKeyForSingleCredential("user1", credentials[3].Uid),
+		GetKeyForSingleCredential("user1", credentials[17].Uid),
+		GetKeyForSingleCredential("user1", credentials[42].Uid),
+	}
+	for i := range failed {
+		stub.failures[failed[i]] = errors.New("slow down")
+	}
+	stub.objects[GetKeyForSingleCredential("user1", credentials[20].Uid)] = []byte("{not json")
+	failed = append(failed, GetKeyForSingleCredential("user1", credentials[20].Uid))
+	sort.Strings(failed)
+
+	list, err := store.List(context.Background(), "user1")
+	var partial *storage.PartialError
+	assert.ErrorAs(t, err, &partial)
+	assert.Len(t, partial.Failures, len(failed))
+	for i := range partial.Failures {
+		assert.Equal(t, failed[i], partial.Failures[i].Key)
+	}
+
+	var want []uuid.UUID
+	for i := range credentials {
+		switch i {
+		case 3, 17, 20, 42:
+			continue
+		}
+		want = append(want, credentials[i].Uid)
+	}
+
+	var got []uuid.UUID
+	for i := range list {
+		got = append(got, list[i].Uid)
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestStubListPages(t *testing.T) {
+	stub := newStubS3()
+	credentials := stub.putCredentials(t, "user1", 2500)
+	stub.putCredentials(t, "user2", 10)
+	stub.objects[GetKeyForMetadata("user1", "index")] = []byte("{}")
+	store := &Store{log: log, svc: stub, bucket: "jackstand-s3-test"}
+	ctx := context.Background()
+
+	t.Run("test list follows continuation tokens", func(t *testing.T) {
+		stub.pages = 0
+		objects, err := List(ctx, log, stub, "jackstand-s3-test", GetKeyForAllCredentials("user1"))
+		assert.NoError(t, err)
+		assert.Len(t, objects, 2501)
+		assert.Equal(t, 3, stub.pages)
+	})
+
+	t.Run("test store list skips metadata across pages", func(t *testing.T) {
+		list, err := store.List(ctx, "user1")
+		assert.NoError(t, err)
+		assert.Len(t, list, 2500)
+		for i := range list {
+			assert.Equal(t, credentials[i].Uid, list[i].Uid)
+		}
+	})
+
+	t.Run("test query pages past the first thousand keys", func(t *testing.T) {
+		q := storage.Query{Limit: 300}
+		var got []uuid.UUID
+		for {
+			page, err := store.Query(ctx, "user1", q)
+			assert.NoError(t, err)
+			for i := range page.Credentials {
+				got = append(got, page.Credentials[i].Uid)
+			}
+
+			if page.Next == "" {
+				break
+			}
+			q.Cursor = page.Next
+		}
+
+		assert.Len(t, got, 2500)
+		for i := range got {
+			assert.Equal(t, credentials[i].Uid, got[i])
+		}
+	})
+
+	t.Run("test query stops listing once the page is full", func(t *testing.T) {
+		stub.pages = 0
+		page, err := store.Query(ctx, "user1", storage.Query{Limit: 10})
+		assert.NoError(t, err)
+		assert.Len(t, page.Credentials, 10)
+		assert.NotEmpty(t, page.Next)
+		assert.Equal(t, 1, stub.pages)
+	})
+}
+
+func TestStubWritesUseContext(t *testing.T) {
+	stub := newStubS3()
+	store := &Store{log: log, svc: stub, bucket: "jackstand-s3-test"}
+	userId := "user1"
+	credential := models.Credential{Uid: uuid.Must(uuid.NewV4()), Service: "github", Username: "jon"}
+	key := GetKeyForSingleCredential(userId, credential.Uid)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Error(t, store.Create(cancelled, userId, credential))
+	assert.NotContains(t, stub.objects, key)
+
+	assert.NoError(t, store.Create(context.Background(), userId, credential))
+	assert.Contains(t, stub.objects, key)
+
+	assert.Error(t, store.Delete(cancelled, userId, credential.Uid))
+	assert.Contains(t, stub.objects, key)
+
+	assert.NoError(t, store.Delete(context.Background(), userId, credential.Uid))
+	assert.NotContains(t, stub.objects, key)
+}
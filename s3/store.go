@@ -0,0 +1,223 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Store is a storage.CredentialStore that keeps each credential as a JSON
+// object under users/<userId>/<credentialUid> in a single bucket.
+type Store struct {
+	log    *logrus.Logger
+	svc    s3iface.S3API
+	bucket string
+}
+
+func NewStore(log *logrus.Logger, sess *session.Session, bucket string) *Store {
+	return &Store{
+		log:    log,
+		svc:    s3.New(sess),
+		bucket: bucket,
+	}
+}
+
+func (s *Store) Create(ctx context.Context, userId string, credential models.Credential) error {
+	return CreateCredential(ctx, s.log, s.svc, s.bucket, GetKeyForSingleCredential(userId, credential.Uid), credential)
+}
+
+func (s *Store) Get(ctx context.Context, userId string, credentialUid uuid.UUID) (models.Credential, error) {
+	var credential models.Credential
+	err := GetCredential(ctx, s.log, s.svc, s.bucket, GetKeyForSingleCredential(userId, credentialUid), &credential)
+	return credential, notFound(err)
+}
+
+func (s *Store) List(ctx context.Context, userId string) ([]models.Credential, error) {
+	keys, err := s.credentialKeys(ctx, userId, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := []models.Credential{}
+	err = GetObjects(ctx, s.log, s.svc, s.bucket, keys, &credentials)
+	return credentials, err
+}
+
+// Query pages through the user's credentials with ListObjectsV2, only
+// fetching the objects on the requested page. Filtered, sorted or descending
+// queries need every credential and fall back to storage.Filter.
+func (s *Store) Query(ctx context.Context, userId string, q storage.Query) (storage.Page, error) {
+	if q.Service != "" || q.Username != "" || q.Filtered() || q.SortBy != "" || q.Desc || q.Limit == 0 {
+		return storage.Filter(ctx, s, userId, q)
+	}
+
+	after, err := q.After()
+	if err != nil {
+		return storage.Page{}, err
+	}
+
+	var startAfter string
+	if after != nil {
+		startAfter = GetKeyForSingleCredential(userId, after.Uid)
+	}
+
+	keys, err := s.credentialKeys(ctx, userId, startAfter, q.Limit+1)
+	if err != nil {
+		return storage.Page{}, err
+	}
+
+	page := storage.Page{Credentials: []models.Credential{}}
+	if len(keys) > q.Limit {
+		keys = keys[:q.Limit]
+		last := uuid.FromStringOrNil(strings.TrimPrefix(keys[q.Limit-1], GetKeyForAllCredentials(userId)))
+		page.Next = q.CursorFor(models.Credential{Uid: last})
+	}
+
+	err = GetObjects(ctx, s.log, s.svc, s.bucket, keys, &page.Credentials)
+	return page, err
+}
+
+func (s *Store) Update(ctx context.Context, userId string, credential models.Credential) error {
+	objectKey := GetKeyForSingleCredential(userId, credential.Uid)
+	_, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return notFound(err)
+	}
+
+	return CreateCredential(ctx, s.log, s.svc, s.bucket, objectKey, credential)
+}
+
+func (s *Store) Delete(ctx context.Context, userId string, credentialUid uuid.UUID) error {
+	return DeleteCredential(ctx, s.log, s.svc, s.bucket, GetKeyForSingleCredential(userId, credentialUid))
+}
+
+func (s *Store) DeleteAll(ctx context.Context, userId string) error {
+	keys, err := s.credentialKeys(ctx, userId, "", 0)
+	if err != nil {
+		return err
+	}
+
+	for i := range keys {
+		if err := DeleteCredential(ctx, s.log, s.svc, s.bucket, keys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetMetadata(ctx context.Context, userId, name string, v interface{}) error {
+	return notFound(GetCredential(ctx, s.log, s.svc, s.bucket, GetKeyForMetadata(userId, name), v))
+}
+
+func (s *Store) PutMetadata(ctx context.Context, userId, name string, v interface{}) error {
+	if err := storage.CheckMetadataName(name); err != nil {
+		return err
+	}
+	return CreateCredential(ctx, s.log, s.svc, s.bucket, GetKeyForMetadata(userId, name), v)
+}
+
+func (s *Store) DeleteMetadata(ctx context.Context, userId, name string) error {
+	return DeleteCredential(ctx, s.log, s.svc, s.bucket, GetKeyForMetadata(userId, name))
+}
+
+func (s *Store) ListMetadata(ctx context.Context, userId, prefix string) ([]string, error) {
+	keyPrefix := GetKeyForAllCredentials(userId) + "_"
+	objects, err := List(ctx, s.log, s.svc, s.bucket, keyPrefix+prefix)
+	if errors.Is(err, ErrNoResults) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(objects))
+	for i := range objects {
+		key := aws.StringValue(objects[i].Key)
+		if strings.HasSuffix(key, ".json") {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(key, keyPrefix), ".json"))
+		}
+	}
+	return names, nil
+}
+
+func (s *Store) Users(ctx context.Context) ([]string, error) {
+	var users []string
+	err := s.svc.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String("users/"),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for i := range page.CommonPrefixes {
+			prefix := strings.TrimPrefix(aws.StringValue(page.CommonPrefixes[i].Prefix), "users/")
+			users = append(users, strings.TrimSuffix(prefix, "/"))
+		}
+		return true
+	})
+
+	return users, err
+}
+
+// credentialKeys lists the keys of the user's credentials after startAfter,
+// skipping any other objects under the user's prefix. It stops once max keys
+// are found unless max is zero.
+func (s *Store) credentialKeys(ctx context.Context, userId, startAfter string, max int) ([]string, error) {
+	prefix := GetKeyForAllCredentials(userId)
+	s.log.WithFields(logrus.Fields{"bucket": s.bucket, "objectPrefix": prefix, "startAfter": startAfter}).Debug("s3 list credential keys")
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+
+	var keys []string
+	err := s.svc.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for i := range page.Contents {
+			key := aws.StringValue(page.Contents[i].Key)
+			if _, err := uuid.FromString(strings.TrimPrefix(key, prefix)); err != nil {
+				continue
+			}
+
+			keys = append(keys, key)
+			if max > 0 && len(keys) == max {
+				return false
+			}
+		}
+		return true
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing credentials %w", err)
+	}
+	return keys, nil
+}
+
+// notFound translates the S3 missing object errors into storage.ErrNotFound.
+func notFound(err error) error {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return storage.ErrNotFound
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,40 @@
+package settings
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dbubel/jackstand-api/storage"
+)
+
+// Name is the metadata document holding a user's settings.
+const Name = "settings"
+
+const (
+	// ModeStandard stores credentials the server can read.
+	ModeStandard = "standard"
+	// ModeVault stores credentials as blobs encrypted by the client, so the
+	// server never sees them in plaintext.
+	ModeVault = "vault"
+)
+
+// Settings are the per-user options of a vault.
+type Settings struct {
+	Mode string `json:"mode" validate:"required,oneof=standard vault"`
+}
+
+// Get returns the user's settings, or the defaults if they never changed
+// them.
+func Get(ctx context.Context, store storage.MetadataStore, userId string) (Settings, error) {
+	s := Settings{Mode: ModeStandard}
+	err := store.GetMetadata(ctx, userId, Name, &s)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Settings{Mode: ModeStandard}, nil
+	}
+	return s, err
+}
+
+// Put stores the user's settings.
+func Put(ctx context.Context, store storage.MetadataStore, userId string, s Settings) error {
+	return store.PutMetadata(ctx, userId, Name, s)
+}
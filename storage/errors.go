@@ -0,0 +1,19 @@
+package storage
+
+import "fmt"
+
+// Failure describes a single credential that could not be read.
+type Failure struct {
+	Key string `json:"key"`
+	Err string `json:"error"`
+}
+
+// PartialError is returned together with the credentials that could be read
+// when some of a user's credentials could not be.
+type PartialError struct {
+	Failures []Failure
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d credentials could not be read", len(e.Failures))
+}
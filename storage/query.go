@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/gofrs/uuid"
+)
+
+// Sort orders understood by Query.SortBy.
+const (
+	SortByService   = "service"
+	SortByUsername  = "username"
+	SortByCreatedAt = "createdAt"
+	SortByUpdatedAt = "updatedAt"
+)
+
+// ErrInvalidCursor is returned for a cursor that was not produced by a
+// previous page.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Query narrows, orders and pages a credential listing. Service and Username
+// match credentials whose value starts with the given text ignoring case.
+// Results are ordered by SortBy, ties and the default order are by
+// credential uid.
+type Query struct {
+	Service  string
+	Username string
+	// Search matches credentials containing every word of it, ignoring case,
+	// in their service, username, description or a metadata value. Secret
+	// metadata values are not searched.
+	Search string
+	// Tags matches credentials that have all of the tags, ignoring case.
+	Tags []string
+	// CreatedAfter, CreatedBefore, UpdatedAfter and UpdatedBefore match
+	// credentials created or updated strictly within the range when set.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	SortBy        string
+	Desc          bool
+	// Limit caps the number of credentials returned, zero means no limit.
+	Limit int
+	// Cursor continues a listing after the last credential of a previous
+	// page, see Page.Next.
+	Cursor string
+}
+
+// Page is one page of a credential listing. Next is the cursor for the
+// following page and is empty on the last one.
+type Page struct {
+	Credentials []models.Credential
+	Next        string
+}
+
+// Querier is implemented by stores that can answer a Query natively, for
+// example from an index, instead of loading every credential for the user.
+type Querier interface {
+	Query(ctx context.Context, userId string, q Query) (Page, error)
+}
+
+// Run answers q using the store's own Querier when it has one and by
+// filtering a full listing otherwise, so every backend returns the same
+// results for the same query. A *PartialError from the listing is returned
+// along with the matches that could be read.
+func Run(ctx context.Context, store CredentialStore, userId string, q Query) (Page, error) {
+	if querier, ok := store.(Querier); ok {
+		return querier.Query(ctx, userId, q)
+	}
+	return Filter(ctx, store, userId, q)
+}
+
+// Filter answers q by applying it to a full listing of the user's
+// credentials. Stores use it for the queries they cannot answer natively.
+func Filter(ctx context.Context, store CredentialStore, userId string, q Query) (Page, error) {
+	credentials, err := store.List(ctx, userId)
+	var partial *PartialError
+	if err != nil && !errors.As(err, &partial) {
+		return Page{}, err
+	}
+
+	page, applyErr := q.Apply(credentials)
+	if applyErr != nil {
+		return Page{}, applyErr
+	}
+	return page, err
+}
+
+// Filtered reports whether the query has any filter beyond Service and
+// Username.
+func (q Query) Filtered() bool {
+	return q.Search != "" || len(q.Tags) > 0 ||
+		!q.CreatedAfter.IsZero() || !q.CreatedBefore.IsZero() ||
+		!q.UpdatedAfter.IsZero() || !q.UpdatedBefore.IsZero()
+}
+
+// Match reports whether the credential satisfies the filters of the query.
+func (q Query) Match(c models.Credential) bool {
+	if q.Service != "" && !strings.HasPrefix(strings.ToLower(c.Service), strings.ToLower(q.Service)) {
+		return false
+	}
+
+	if q.Username != "" && !strings.HasPrefix(strings.ToLower(c.Username), strings.ToLower(q.Username)) {
+		return false
+	}
+
+	if !q.Filtered() {
+		return true
+	}
+
+	if !inRange(time.Time(c.CreatedAt), q.CreatedAfter, q.CreatedBefore) ||
+		!inRange(time.Time(c.UpdatedAt), q.UpdatedAfter, q.UpdatedBefore) {
+		return false
+	}
+
+	for _, tag := range q.Tags {
+		if !hasTag(c, tag) {
+			return false
+		}
+	}
+
+	for _, word := range strings.Fields(strings.ToLower(q.Search)) {
+		if !contains(c, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func inRange(t, after, before time.Time) bool {
+	if !after.IsZero() && !t.After(after) {
+		return false
+	}
+	return before.IsZero() || t.Before(before)
+}
+
+func hasTag(c models.Credential, tag string) bool {
+	for i := range c.Tags {
+		if strings.EqualFold(c.Tags[i], tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether the lower case word appears in any searchable
+// field of the credential.
+func contains(c models.Credential, word string) bool {
+	for _, field := range []string{c.Service, c.Username, c.Description} {
+		if strings.Contains(strings.ToLower(field), word) {
+			return true
+		}
+	}
+
+	for key, value := range c.Metadata {
+		if !models.IsSecretMetadata(key) && strings.Contains(strings.ToLower(value), word) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply filters, sorts and pages the credentials in place.
+func (q Query) Apply(credentials []models.Credential) (Page, error) {
+	after, err := q.After()
+	if err != nil {
+		return Page{}, err
+	}
+
+	matches := credentials[:0]
+	for i := range credentials {
+		if q.Match(credentials[i]) && (after == nil || q.Before(*after, credentials[i])) {
+			matches = append(matches, credentials[i])
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return q.Before(matches[i], matches[j])
+	})
+
+	page := Page{Credentials: matches}
+	if q.Limit > 0 && len(matches) > q.Limit {
+		page.Credentials = matches[:q.Limit]
+		page.Next = q.CursorFor(matches[q.Limit-1])
+	}
+	return page, nil
+}
+
+// Before reports whether a is listed before b in the order of the query.
+func (q Query) Before(a, b models.Credential) bool {
+	if q.Desc {
+		return q.less(b, a)
+	}
+	return q.less(a, b)
+}
+
+func (q Query) less(a, b models.Credential) bool {
+	switch q.SortBy {
+	case SortByService:
+		if x, y := strings.ToLower(a.Service), strings.ToLower(b.Service); x != y {
+			return x < y
+		}
+	case SortByUsername:
+		if x, y := strings.ToLower(a.Username), strings.ToLower(b.Username); x != y {
+			return x < y
+		}
+	case SortByCreatedAt:
+		if x, y := time.Time(a.CreatedAt).Unix(), time.Time(b.CreatedAt).Unix(); x != y {
+			return x < y
+		}
+	case SortByUpdatedAt:
+		if x, y := time.Time(a.UpdatedAt).Unix(), time.Time(b.UpdatedAt).Unix(); x != y {
+			return x < y
+		}
+	}
+	return a.Uid.String() < b.Uid.String()
+}
+
+// cursor holds the uid and sort value of the last credential on a page.
+type cursor struct {
+	Uid   uuid.UUID `json:"u"`
+	Value string    `json:"v,omitempty"`
+}
+
+// CursorFor returns the cursor that continues the listing after c.
+func (q Query) CursorFor(c models.Credential) string {
+	cur := cursor{Uid: c.Uid}
+	switch q.SortBy {
+	case SortByService:
+		cur.Value = c.Service
+	case SortByUsername:
+		cur.Value = c.Username
+	case SortByCreatedAt:
+		cur.Value = strconv.FormatInt(time.Time(c.CreatedAt).Unix(), 10)
+	case SortByUpdatedAt:
+		cur.Value = strconv.FormatInt(time.Time(c.UpdatedAt).Unix(), 10)
+	}
+
+	buf, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// After decodes the cursor of the query into the credential it points at,
+// with only the uid and sort field set. It returns nil without a cursor.
+func (q Query) After() (*models.Credential, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cur cursor
+	if err := json.Unmarshal(buf, &cur); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	after := models.Credential{Uid: cur.Uid}
+	switch q.SortBy {
+	case SortByService:
+		after.Service = cur.Value
+	case SortByUsername:
+		after.Username = cur.Value
+	case SortByCreatedAt, SortByUpdatedAt:
+		sec, err := strconv.ParseInt(cur.Value, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+
+		if q.SortBy == SortByCreatedAt {
+			after.CreatedAt = models.CustomTime(time.Unix(sec, 0))
+		} else {
+			after.UpdatedAt = models.CustomTime(time.Unix(sec, 0))
+		}
+	}
+	return &after, nil
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/dbubel/jackstand-api/models"
+)
+
+// Searchable fields of a Search.
+const (
+	SearchService  = "service"
+	SearchUsername = "username"
+	SearchURL      = "url"
+)
+
+// URLMetadataKey is the metadata key holding the address of a credential's
+// site.
+const URLMetadataKey = "url"
+
+// ErrEmptySearch is returned for a search without any terms.
+var ErrEmptySearch = errors.New("search needs at least one term")
+
+// Search finds credentials whose normalized fields equal every term that is
+// set. Unlike a Query it only matches whole values, which lets stores answer
+// it from blind indexes without decrypting credentials.
+type Search struct {
+	Service  string
+	Username string
+	URL      string
+}
+
+// Searcher is implemented by stores that can answer a Search without loading
+// every credential for the user.
+type Searcher interface {
+	Search(ctx context.Context, userId string, search Search) ([]models.Credential, error)
+}
+
+// RunSearch answers the search using the store's own Searcher when it has one
+// and by filtering a full listing otherwise. A *PartialError from the listing
+// is returned along with the matches that could be read.
+func RunSearch(ctx context.Context, store CredentialStore, userId string, search Search) ([]models.Credential, error) {
+	if len(search.Terms()) == 0 {
+		return nil, ErrEmptySearch
+	}
+
+	if searcher, ok := store.(Searcher); ok {
+		return searcher.Search(ctx, userId, search)
+	}
+
+	credentials, err := store.List(ctx, userId)
+	var partial *PartialError
+	if err != nil && !errors.As(err, &partial) {
+		return nil, err
+	}
+	return search.Apply(credentials), err
+}
+
+// Terms returns the normalized terms of the search keyed by field, leaving out
+// the fields that are not set.
+func (s Search) Terms() map[string]string {
+	terms := make(map[string]string)
+	for field, value := range map[string]string{
+		SearchService:  s.Service,
+		SearchUsername: s.Username,
+		SearchURL:      s.URL,
+	} {
+		if value = Normalize(field, value); value != "" {
+			terms[field] = value
+		}
+	}
+	return terms
+}
+
+// Match reports whether the credential satisfies every term of the search.
+func (s Search) Match(c models.Credential) bool {
+	values := SearchValues(c)
+	for field, term := range s.Terms() {
+		if values[field] != term {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply filters the credentials in place.
+func (s Search) Apply(credentials []models.Credential) []models.Credential {
+	matches := credentials[:0]
+	for i := range credentials {
+		if s.Match(credentials[i]) {
+			matches = append(matches, credentials[i])
+		}
+	}
+	return matches
+}
+
+// SearchValues returns the normalized searchable values of the credential
+// keyed by field, leaving out the empty ones.
+func SearchValues(c models.Credential) map[string]string {
+	values := make(map[string]string)
+	for field, value := range map[string]string{
+		SearchService:  c.Service,
+		SearchUsername: c.Username,
+		SearchURL:      c.Metadata[URLMetadataKey],
+	} {
+		if value = Normalize(field, value); value != "" {
+			values[field] = value
+		}
+	}
+	return values
+}
+
+// Normalize returns the form of a field's value that searches compare:
+// trimmed and lower case, and for URLs only the host without "www.", so
+// "https://www.GitHub.com/login" and "github.com" match.
+func Normalize(field, value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if field != SearchURL || value == "" {
+		return value
+	}
+
+	if !strings.Contains(value, "://") {
+		value = "https://" + value
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || u.Hostname() == "" {
+		return strings.TrimPrefix(strings.TrimPrefix(value, "https://"), "www.")
+	}
+	return strings.TrimPrefix(u.Hostname(), "www.")
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/gofrs/uuid"
+)
+
+// ErrNotFound is returned when a credential does not exist for a user.
+var ErrNotFound = errors.New("credential not found")
+
+// CredentialStore persists credentials. Every call is scoped to the id of the
+// user that owns the credentials so one user can never read another's data.
+type CredentialStore interface {
+	MetadataStore
+
+	// Create stores a new credential for the user.
+	Create(ctx context.Context, userId string, credential models.Credential) error
+	// Get returns a single credential or ErrNotFound.
+	Get(ctx context.Context, userId string, credentialUid uuid.UUID) (models.Credential, error)
+	// List returns every credential owned by the user. A user without any
+	// credentials gets an empty slice and no error.
+	List(ctx context.Context, userId string) ([]models.Credential, error)
+	// Update replaces an existing credential or returns ErrNotFound.
+	Update(ctx context.Context, userId string, credential models.Credential) error
+	// Delete removes a single credential.
+	Delete(ctx context.Context, userId string, credentialUid uuid.UUID) error
+	// DeleteAll removes every credential owned by the user, leaving their
+	// metadata documents in place.
+	DeleteAll(ctx context.Context, userId string) error
+	// Users returns the id of every user that has stored credentials or
+	// metadata documents.
+	Users(ctx context.Context) ([]string, error)
+}
+
+// MetadataStore keeps small named JSON documents, such as the credential
+// manifest, next to a user's credentials. Names are slash separated paths
+// like "index" or "history/<credentialUid>" and never collide with
+// credentials.
+type MetadataStore interface {
+	// GetMetadata unmarshals the named document into v or returns ErrNotFound.
+	GetMetadata(ctx context.Context, userId, name string, v interface{}) error
+	// PutMetadata marshals v and stores it under name, replacing any
+	// existing document.
+	PutMetadata(ctx context.Context, userId, name string, v interface{}) error
+	// DeleteMetadata removes the named document if it exists.
+	DeleteMetadata(ctx context.Context, userId, name string) error
+	// ListMetadata returns the sorted names of the user's documents that
+	// start with prefix.
+	ListMetadata(ctx context.Context, userId, prefix string) ([]string, error)
+}
+
+// CheckMetadataName rejects document names that are empty or could escape the
+// user's prefix.
+func CheckMetadataName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return fmt.Errorf("invalid metadata name %q", name)
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." || strings.Contains(part, `\`) {
+			return fmt.Errorf("invalid metadata name %q", name)
+		}
+	}
+	return nil
+}
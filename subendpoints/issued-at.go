@@ -0,0 +1,17 @@
+package subendpoints
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dbubel/intake"
+)
+
+func IssuedAtFromClaims(w http.ResponseWriter, r *http.Request, next func(issuedAt time.Time)) {
+	issuedAt, ok := r.Context().Value("issuedAt").(time.Time)
+	if !ok {
+		intake.RespondJSON(w, r, http.StatusBadRequest, map[string]string{"error": "no issuedAt present in claims"})
+		return
+	}
+	next(issuedAt)
+}
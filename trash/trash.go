@@ -0,0 +1,152 @@
+package trash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dbubel/jackstand-api/history"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// prefix starts the names of the metadata documents holding trashed
+// credentials, one document per credential.
+const prefix = "trash/"
+
+// Item is a deleted credential waiting in the trash.
+type Item struct {
+	DeletedAt  models.CustomTime `json:"deletedAt"`
+	Credential models.Credential `json:"credential"`
+}
+
+// Bin keeps deleted credentials in each user's trash until they are restored
+// or purged. The history of a trashed credential is kept until it is purged.
+// Callers serialise writes to a user's credentials.
+type Bin struct {
+	log     *logrus.Logger
+	store   storage.CredentialStore
+	history *history.Recorder
+}
+
+func New(log *logrus.Logger, store storage.CredentialStore, hist *history.Recorder) *Bin {
+	return &Bin{log: log, store: store, history: hist}
+}
+
+// Put moves a credential into the user's trash.
+func (b *Bin) Put(ctx context.Context, userId string, credential models.Credential) error {
+	return b.store.PutMetadata(ctx, userId, name(credential.Uid), Item{
+		DeletedAt:  models.CustomTime(time.Now()),
+		Credential: credential,
+	})
+}
+
+// Get returns a trashed credential or storage.ErrNotFound.
+func (b *Bin) Get(ctx context.Context, userId string, credentialUid uuid.UUID) (Item, error) {
+	var item Item
+	err := b.store.GetMetadata(ctx, userId, name(credentialUid), &item)
+	return item, err
+}
+
+// List returns the user's trashed credentials, most recently deleted first.
+func (b *Bin) List(ctx context.Context, userId string) ([]Item, error) {
+	names, err := b.store.ListMetadata(ctx, userId, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]Item, 0, len(names))
+	for i := range names {
+		var item Item
+		err := b.store.GetMetadata(ctx, userId, names[i], &item)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	sortByDeletedAt(items)
+	return items, nil
+}
+
+// Remove takes a credential out of the trash after it has been restored.
+func (b *Bin) Remove(ctx context.Context, userId string, credentialUid uuid.UUID) error {
+	return b.store.DeleteMetadata(ctx, userId, name(credentialUid))
+}
+
+// Purge permanently deletes a trashed credential and its history.
+func (b *Bin) Purge(ctx context.Context, userId string, credentialUid uuid.UUID) error {
+	if err := b.history.Delete(ctx, userId, credentialUid); err != nil {
+		return err
+	}
+	return b.Remove(ctx, userId, credentialUid)
+}
+
+// PurgeExpired purges every trashed credential deleted more than retention
+// ago, logging the users whose trash could not be emptied.
+func (b *Bin) PurgeExpired(ctx context.Context, retention time.Duration) error {
+	users, err := b.store.Users(ctx)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	for i := range users {
+		items, err := b.List(ctx, users[i])
+		if err != nil {
+			b.log.WithError(err).WithFields(logrus.Fields{"userId": users[i]}).Error("error listing trash")
+			continue
+		}
+
+		for j := range items {
+			if !time.Time(items[j].DeletedAt).Before(cutoff) {
+				continue
+			}
+
+			if err := b.Purge(ctx, users[i], items[j].Credential.Uid); err != nil {
+				b.log.WithError(err).WithFields(logrus.Fields{"userId": users[i], "credentialUid": items[j].Credential.Uid}).Error("error purging trash")
+				continue
+			}
+			b.log.WithFields(logrus.Fields{"userId": users[i], "credentialUid": items[j].Credential.Uid}).Info("purged expired credential")
+		}
+	}
+	return nil
+}
+
+// Run purges credentials older than retention every interval until the
+// context is done.
+func (b *Bin) Run(ctx context.Context, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := b.PurgeExpired(ctx, retention); err != nil {
+				b.log.WithError(err).Error("error purging trash")
+			}
+		}
+	}
+}
+
+func name(credentialUid uuid.UUID) string {
+	return fmt.Sprintf("%s%s", prefix, credentialUid)
+}
+
+// sortByDeletedAt orders items most recently deleted first, then by uid.
+func sortByDeletedAt(items []Item) {
+	sort.Slice(items, func(i, j int) bool {
+		ti, tj := time.Time(items[i].DeletedAt), time.Time(items[j].DeletedAt)
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return items[i].Credential.Uid.String() < items[j].Credential.Uid.String()
+	})
+}
@@ -0,0 +1,64 @@
+package trash
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brianvoe/gofakeit"
+	"github.com/dbubel/jackstand-api/history"
+	"github.com/dbubel/jackstand-api/memory"
+	"github.com/dbubel/jackstand-api/models"
+	"github.com/dbubel/jackstand-api/storage"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func randomCredential() models.Credential {
+	return models.Credential{
+		Uid:      uuid.Must(uuid.NewV4()),
+		Service:  gofakeit.HackerVerb(),
+		Username: gofakeit.BeerAlcohol(),
+		Password: gofakeit.JobLevel(),
+	}
+}
+
+func TestBin(t *testing.T) {
+	ctx := context.Background()
+	userId := gofakeit.Username()
+	store := memory.NewStore()
+	hist := history.New(store, 5)
+	bin := New(logrus.New(), store, hist)
+
+	old, recent := randomCredential(), randomCredential()
+	assert.NoError(t, hist.Record(ctx, userId, old))
+	assert.NoError(t, store.PutMetadata(ctx, userId, name(old.Uid), Item{
+		DeletedAt:  models.CustomTime(time.Now().Add(-48 * time.Hour)),
+		Credential: old,
+	}))
+	assert.NoError(t, bin.Put(ctx, userId, recent))
+
+	t.Run("test list is most recent first", func(t *testing.T) {
+		items, err := bin.List(ctx, userId)
+		assert.NoError(t, err)
+		assert.Len(t, items, 2)
+		assert.Equal(t, recent.Uid, items[0].Credential.Uid)
+		assert.Equal(t, old.Uid, items[1].Credential.Uid)
+	})
+
+	t.Run("test expired items are purged with their history", func(t *testing.T) {
+		assert.NoError(t, bin.PurgeExpired(ctx, 24*time.Hour))
+
+		_, err := bin.Get(ctx, userId, old.Uid)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		h, err := hist.Get(ctx, userId, old.Uid)
+		assert.NoError(t, err)
+		assert.Empty(t, h.Versions)
+
+		item, err := bin.Get(ctx, userId, recent.Uid)
+		assert.NoError(t, err)
+		assert.Equal(t, recent.Password, item.Credential.Password)
+	})
+}